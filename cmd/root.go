@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"MediaNinja/core/config"
 	"MediaNinja/core/crawler"
+	"MediaNinja/core/request/downloader"
 
 	"github.com/spf13/cobra"
 )
@@ -37,16 +41,53 @@ var rootCmd = &cobra.Command{
 			fmt.Printf("Error creating output directory: %v\n", err)
 			os.Exit(1)
 		}
+
+		// 校验变体选择策略
+		if _, err := downloader.ParseVariantPolicy(cfg.Variant); err != nil {
+			fmt.Printf("Error parsing --variant: %v\n", err)
+			os.Exit(1)
+		}
+		if _, err := downloader.ParseRenditionPolicy(cfg.AudioLanguages, cfg.SubtitleLanguages, cfg.SubtitleMode); err != nil {
+			fmt.Printf("Error parsing rendition options: %v\n", err)
+			os.Exit(1)
+		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		c := crawler.NewCrawler(cfg)
-		if err := c.Start(cfg.URL); err != nil {
+		ctx, stop := interruptContext()
+		defer stop()
+
+		// 代理、cookie、TLS 指纹和录制回放的设置由 NewCrawler 解析，无效时退出
+		c, err := crawler.NewCrawler(cfg)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := c.Start(ctx, cfg.URL); err != nil {
 			fmt.Printf("Crawler error: %v\n", err)
 			os.Exit(1)
 		}
 	},
 }
 
+// interruptContext 返回在收到 SIGINT/SIGTERM 时取消的 context。第一次信号让下载保存进度后退出，
+// 之后恢复默认的信号处理，再按一次 Ctrl-C 直接结束进程。
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+			fmt.Println("\nInterrupted, saving download progress (press Ctrl-C again to quit immediately)")
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		stop()
+	}
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -60,8 +101,34 @@ func init() {
 	rootCmd.MarkFlagRequired("url")
 
 	// 可选参数
-	rootCmd.Flags().StringVarP(&cfg.ProxyURL, "proxy", "p", "", "Proxy URL (optional)")
+	rootCmd.Flags().StringVarP(&cfg.ProxyURL, "proxy", "p", "", "Proxy URL (optional): http://, https://, socks5:// or socks5h://, with optional user:pass@; comma separated to rotate between several")
+	rootCmd.Flags().StringVar(&cfg.ProxyFile, "proxy-file", "", "File with one proxy URL per line to add to the rotation")
+	rootCmd.Flags().StringVar(&cfg.ProxyRotation, "proxy-rotation", "round-robin", "Proxy rotation: round-robin or least-failures")
+	rootCmd.Flags().StringArrayVar(&cfg.ProxyRules, "proxy-rule", nil, "Route matching hosts through a proxy or direct, e.g. '*ddys*=http://proxy-a:8080' or 'yhdm.*=direct' (repeatable, first match wins)")
 	rootCmd.Flags().IntVarP(&cfg.Concurrency, "concurrency", "c", 5, "Number of concurrent downloads")
+	rootCmd.Flags().IntVar(&cfg.SegmentConcurrency, "segment-concurrency", 8, "Number of concurrent segment downloads per m3u8 video")
+	rootCmd.Flags().IntVar(&cfg.Connections, "connections", 4, "Number of parallel connections per regular file download (1 to disable)")
+	rootCmd.Flags().StringVar(&cfg.Variant, "variant", "best", "HLS variant selection: best, worst, <=1080p, codec=avc1, index=N (comma separated)")
+	rootCmd.Flags().StringVar(&cfg.AudioLanguages, "audio-lang", "", "HLS alternate audio languages to download, e.g. en,ja (default track if empty, all, none)")
+	rootCmd.Flags().StringVar(&cfg.SubtitleLanguages, "sub-lang", "", "HLS subtitle languages to download, e.g. en,zh (all if empty, none)")
+	rootCmd.Flags().StringVar(&cfg.SubtitleMode, "sub-mode", "sidecar", "How to save HLS subtitles: sidecar (.vtt files) or mux (into the mp4)")
+	rootCmd.Flags().BoolVar(&cfg.FragmentedMP4, "fragmented-mp4", false, "Write fragmented MP4 (moov first, one fragment per keyframe) instead of a regular MP4")
+	rootCmd.Flags().BoolVar(&cfg.LiveRecord, "live", false, "Record live/event HLS playlists until EXT-X-ENDLIST, a limit or Ctrl-C instead of downloading a single snapshot")
+	rootCmd.Flags().IntVar(&cfg.RecordDuration, "record-duration", 0, "Stop live recording after this many seconds of media (0 for no limit)")
+	rootCmd.Flags().IntVar(&cfg.RecordMaxSize, "record-max-size", 0, "Stop live recording after this many MB (0 for no limit)")
+	rootCmd.Flags().IntVar(&cfg.RequestTimeout, "request-timeout", 30, "Seconds to wait for a response before a request times out (0 for no limit)")
+	rootCmd.Flags().IntVar(&cfg.IdleTimeout, "idle-timeout", 60, "Seconds without receiving data before a stalled download is aborted (0 for no limit)")
+	rootCmd.Flags().IntVar(&cfg.FileTimeout, "file-timeout", 0, "Maximum seconds for downloading a single file, unfinished downloads resume on the next run (0 for no limit)")
+	rootCmd.Flags().Float64Var(&cfg.RateLimit, "rate-limit", 0, "Maximum requests per second to each host, for page fetches and downloads (0 for no limit)")
+	rootCmd.Flags().IntVar(&cfg.RateBurst, "rate-burst", 1, "Number of requests to a host that may be sent back to back before --rate-limit applies")
+	rootCmd.Flags().Float64Var(&cfg.MinDelay, "min-delay", 0, "Minimum seconds between two requests to the same host")
+	rootCmd.Flags().StringVar(&cfg.TLSProfile, "tls-profile", "chrome", "TLS fingerprint for HTTPS requests: chrome, firefox, safari, go, or a uTLS ClientHello JSON file")
+	rootCmd.Flags().StringArrayVar(&cfg.TLSProfileRules, "tls-profile-rule", nil, "Use another TLS fingerprint for a site and its subdomains, e.g. 'ddys.pro=firefox' (repeatable)")
+	rootCmd.Flags().StringArrayVar(&cfg.SiteHeaders, "site-header", nil, "Send a header to a site and its subdomains, overriding the site parser's defaults, e.g. 'ddys.pro=Referer: https://ddys.pro/' (repeatable)")
+	rootCmd.Flags().StringVar(&cfg.Cookies, "cookies", "", "Netscape format cookies.txt to load, e.g. exported by a browser extension")
+	rootCmd.Flags().BoolVar(&cfg.SaveCookies, "save-cookies", false, "Write updated cookies back to the --cookies file at the end of the run")
+	rootCmd.Flags().StringVar(&cfg.RecordSession, "record-session", "", "Record every HTTP request and response of this run to a cassette file for offline replay (media downloads are recorded as status and headers only)")
+	rootCmd.Flags().StringVar(&cfg.ReplaySession, "replay-session", "", "Serve HTTP responses from a cassette file written by --record-session instead of the network")
 	rootCmd.Flags().StringVarP(&cfg.OutputDir, "output", "o", "downloads", "Output directory for downloaded files")
 
 	// Add new flags for retry configuration
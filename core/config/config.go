@@ -2,20 +2,54 @@ package config
 
 // Config 存储所有配置信息
 type Config struct {
-	URL         string // 目标URL
-	ProxyURL    string // 代理URL
-	Concurrency int    // 并发数
-	OutputDir   string // 输出目录
-	MaxRetries  int    // Add this field
-	RetryDelay  int    // Add this field in seconds
+	URL                string   // 目标URL
+	ProxyURL           string   // 代理URL，多个代理用逗号分隔
+	ProxyFile          string   // 每行一个代理地址的文件
+	ProxyRotation      string   // 代理轮换方式：round-robin 或 least-failures
+	ProxyRules         []string // 按站点选择代理的规则，格式为 "域名模式=代理地址" 或 "域名模式=direct"
+	Concurrency        int      // 并发数
+	SegmentConcurrency int      // 单个 m3u8 视频的分片并发数
+	Connections        int      // 单个普通文件的并发连接数
+	Variant            string   // m3u8 变体选择策略
+	AudioLanguages     string   // 备用音轨语言
+	SubtitleLanguages  string   // 字幕语言
+	SubtitleMode       string   // 字幕处理方式：sidecar 或 mux
+	FragmentedMP4      bool     // 输出 fragmented MP4
+	LiveRecord         bool     // 录制直播流
+	RecordDuration     int      // 直播录制时长上限（秒）
+	RecordMaxSize      int      // 直播录制大小上限（MB）
+	RequestTimeout     int      // 等待响应头的超时时间（秒）
+	IdleTimeout        int      // 下载中连续没有收到数据的超时时间（秒）
+	FileTimeout        int      // 单个文件下载的总时长上限（秒），0 表示不限制
+	RateLimit          float64  // 每个主机每秒的请求数，0 表示不限制
+	RateBurst          int      // 每个主机允许连续发出的请求数
+	MinDelay           float64  // 同一主机相邻请求之间的最小间隔（秒）
+	TLSProfile         string   // TLS 指纹：chrome、firefox、safari、go 或 ClientHello JSON 文件
+	TLSProfileRules    []string // 按站点覆盖 TLS 指纹的规则，格式为 "域名=指纹"
+	SiteHeaders        []string // 按站点添加的请求头，格式为 "域名=名称: 值"
+	Cookies            string   // Netscape 格式的 cookies.txt
+	SaveCookies        bool     // 运行结束时把更新后的 cookie 写回 Cookies 文件
+	RecordSession      string   // 把本次运行的请求和响应录制到 cassette 文件
+	ReplaySession      string   // 从 cassette 文件回放响应，不访问网络
+	OutputDir          string   // 输出目录
+	MaxRetries         int      // Add this field
+	RetryDelay         int      // Add this field in seconds
 }
 
 // New 创建默认配置
 func New() *Config {
 	return &Config{
-		Concurrency: 5,           // 默认并发数
-		OutputDir:   "downloads", // 默认下载目录
-		MaxRetries:  3,           // Default value
-		RetryDelay:  5,           // Default value in seconds
+		Concurrency:        5,           // 默认并发数
+		SegmentConcurrency: 8,           // 默认分片并发数
+		Connections:        4,           // 默认每个文件 4 个连接
+		Variant:            "best",      // 默认选择码率最高的变体
+		SubtitleMode:       "sidecar",   // 默认将字幕保存为独立文件
+		RequestTimeout:     30,          // 默认 30 秒内没有响应视为超时
+		IdleTimeout:        60,          // 默认 60 秒没有收到数据视为连接卡住
+		RateBurst:          1,           // 默认不允许突发请求
+		TLSProfile:         "chrome",    // 默认使用 Chrome 的 TLS 指纹
+		OutputDir:          "downloads", // 默认下载目录
+		MaxRetries:         3,           // Default value
+		RetryDelay:         5,           // Default value in seconds
 	}
 }
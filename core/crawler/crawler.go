@@ -1,7 +1,9 @@
 package crawler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"MediaNinja/core/config"
 	"MediaNinja/core/parsers"
@@ -10,7 +12,9 @@ import (
 	"MediaNinja/utils/format"
 	"MediaNinja/utils/io"
 	"MediaNinja/utils/logger"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -22,6 +26,7 @@ type Crawler struct {
 	currentTitle *string
 	config       *config.Config
 	ioManager    *io.Manager
+	cassette     *client.Cassette // --record-session 录制的请求和响应
 }
 
 // 添加元数据结构
@@ -33,27 +38,116 @@ type CrawlMetadata struct {
 	CrawledTime string              `json:"crawled_time"`
 }
 
-func NewCrawler(cfg *config.Config) *Crawler {
+// NewCrawler 按配置创建爬虫，代理、cookie、TLS 指纹和录制回放的设置无效时返回错误
+func NewCrawler(cfg *config.Config) (*Crawler, error) {
+	httpClient := client.NewClient(cfg.ProxyURL, cfg.MaxRetries, cfg.RetryDelay)
+	if cfg.SegmentConcurrency > 0 {
+		httpClient.DownloadOption.MaxParallel = cfg.SegmentConcurrency
+	}
+	httpClient.DownloadOption.Connections = cfg.Connections
+	httpClient.DownloadOption.VariantPolicy = cfg.Variant
+	httpClient.DownloadOption.AudioLanguages = cfg.AudioLanguages
+	httpClient.DownloadOption.SubtitleLanguages = cfg.SubtitleLanguages
+	httpClient.DownloadOption.SubtitleMode = cfg.SubtitleMode
+	httpClient.DownloadOption.FragmentedMP4 = cfg.FragmentedMP4
+	httpClient.DownloadOption.LiveRecord = cfg.LiveRecord
+	httpClient.DownloadOption.RecordDuration = cfg.RecordDuration
+	httpClient.DownloadOption.RecordMaxSize = int64(cfg.RecordMaxSize) << 20
+	httpClient.DownloadOption.FileTimeout = cfg.FileTimeout
+	httpClient.RequestTimeout = time.Duration(cfg.RequestTimeout) * time.Second
+	httpClient.IdleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
+	httpClient.SetRateLimit(client.RateLimit{
+		RPS:      cfg.RateLimit,
+		Burst:    cfg.RateBurst,
+		MinDelay: time.Duration(cfg.MinDelay * float64(time.Second)),
+	})
+	proxies, err := client.NewProxyPool(ProxyOptions(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy options: %w", err)
+	}
+	httpClient.SetProxyPool(proxies)
+
+	if cfg.SaveCookies && cfg.Cookies == "" {
+		return nil, errors.New("saving cookies requires a cookies file")
+	}
+	if cfg.Cookies != "" {
+		// 保存 cookie 时允许文件还不存在
+		if n, err := httpClient.Cookies.Load(cfg.Cookies); err == nil {
+			logger.Info(fmt.Sprintf("Loaded %d cookies from %s", n, cfg.Cookies))
+		} else if !(cfg.SaveCookies && errors.Is(err, os.ErrNotExist)) {
+			return nil, fmt.Errorf("failed to load cookies: %w", err)
+		}
+	}
+
+	profile, err := client.LoadTLSProfile(cfg.TLSProfile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS profile: %w", err)
+	}
+	httpClient.TLSProfile = profile
+	if httpClient.HostTLSProfiles, err = client.ParseHostTLSProfiles(cfg.TLSProfileRules); err != nil {
+		return nil, fmt.Errorf("invalid TLS profile rule: %w", err)
+	}
+	if httpClient.SiteHeaders, err = client.ParseSiteHeaders(cfg.SiteHeaders); err != nil {
+		return nil, fmt.Errorf("invalid site header: %w", err)
+	}
+
+	var cassette *client.Cassette
+	switch {
+	case cfg.RecordSession != "" && cfg.ReplaySession != "":
+		return nil, errors.New("a session cannot be recorded and replayed at the same time")
+	case cfg.ReplaySession != "":
+		replay, err := client.LoadCassette(cfg.ReplaySession)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load session to replay: %w", err)
+		}
+		httpClient.Replay(replay)
+		logger.Info(fmt.Sprintf("Replaying %d recorded responses from %s", len(replay.Interactions), cfg.ReplaySession))
+	case cfg.RecordSession != "":
+		cassette = client.NewCassette()
+		httpClient.Record(cassette)
+	}
+
 	return &Crawler{
-		client:    client.NewClient(cfg.ProxyURL, cfg.MaxRetries, cfg.RetryDelay),
+		client:    httpClient,
 		limiter:   concurrent.NewLimiter(cfg.Concurrency),
 		outputDir: cfg.OutputDir,
 		config:    cfg,
 		ioManager: io.NewManager(cfg.OutputDir),
-	}
+		cassette:  cassette,
+	}, nil
+}
 
+// ProxyOptions 从配置中读取代理池的设置
+func ProxyOptions(cfg *config.Config) client.ProxyOptions {
+	var proxies []string
+	if cfg.ProxyURL != "" {
+		proxies = strings.Split(cfg.ProxyURL, ",")
+	}
+	return client.ProxyOptions{
+		Proxies:  proxies,
+		File:     cfg.ProxyFile,
+		Rotation: cfg.ProxyRotation,
+		Rules:    cfg.ProxyRules,
+	}
 }
 
-func (c *Crawler) Start(url string) error {
+// Start 抓取并下载 url 中的媒体。ctx 取消后不再开始新的下载，正在进行的下载保存断点续传状态后退出。
+func (c *Crawler) Start(ctx context.Context, url string) error {
 	logger.Info("Starting crawler for URL: " + url)
+	defer c.saveCookies()
+	defer c.saveSession()
 	c.parser = parsers.GetParser(url, c.client)
 
-	html, err := c.client.Get(url, nil)
+	html, err := c.client.Get(ctx, url, nil)
 	if err != nil {
+		var challenge *client.ChallengeError
+		if errors.As(err, &challenge) {
+			logger.Error(fmt.Sprintf("%s is protected by a %s challenge, try --cookies exported from a browser that passed it, another --tls-profile or a different proxy", url, challenge.Provider))
+		}
 		return fmt.Errorf("failed to fetch URL: %w", err)
 	}
 
-	result, err := c.parser.Parse(html)
+	result, err := c.parser.Parse(ctx, html)
 	if err != nil {
 		return fmt.Errorf("failed to parse HTML: %w", err)
 	}
@@ -80,17 +174,53 @@ func (c *Crawler) Start(url string) error {
 	}
 
 	// Handle media downloads
-	for _, media := range result.Media {
-		mediaInfo := media
+	for i := range result.Media {
+		if ctx.Err() != nil {
+			break
+		}
+		mediaInfo := &result.Media[i]
 		c.limiter.Execute(func() {
-			c.downloadMedia(&mediaInfo)
+			c.downloadMedia(ctx, mediaInfo)
 		})
 	}
 
 	c.limiter.Wait()
+
+	// 重新保存元数据，记录下载结果
+	if err := c.saveMetadata(url, result); err != nil {
+		logger.Error(fmt.Sprintf("Failed to save metadata: %v", err))
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("crawl interrupted, run again to resume unfinished downloads: %w", context.Cause(ctx))
+	}
 	return nil
 }
 
+// saveCookies 在配置了 --save-cookies 时把 cookie 写回文件
+func (c *Crawler) saveCookies() {
+	if !c.config.SaveCookies || c.config.Cookies == "" {
+		return
+	}
+	if err := c.client.Cookies.Save(c.config.Cookies); err != nil {
+		logger.Error(fmt.Sprintf("Failed to save cookies: %v", err))
+		return
+	}
+	logger.Info("Saved cookies to " + c.config.Cookies)
+}
+
+// saveSession 在配置了 --record-session 时保存录制的请求和响应
+func (c *Crawler) saveSession() {
+	if c.cassette == nil {
+		return
+	}
+	if err := c.cassette.Save(c.config.RecordSession); err != nil {
+		logger.Error(fmt.Sprintf("Failed to save recorded session: %v", err))
+		return
+	}
+	logger.Info(fmt.Sprintf("Recorded %d responses to %s", len(c.cassette.Interactions), c.config.RecordSession))
+}
+
 // 添加获取标题目录的辅助方法
 func (c *Crawler) getTitleDir() string {
 	titleDir := "unnamed"
@@ -100,7 +230,7 @@ func (c *Crawler) getTitleDir() string {
 	return titleDir
 }
 
-func (c *Crawler) downloadMedia(media *parsers.MediaInfo) {
+func (c *Crawler) downloadMedia(ctx context.Context, media *parsers.MediaInfo) {
 	if media.URL == nil {
 		logger.Error("Invalid media URL")
 		return
@@ -129,13 +259,19 @@ func (c *Crawler) downloadMedia(media *parsers.MediaInfo) {
 
 	logger.Info(fmt.Sprintf("Starting download of %s", filename))
 
-	err := c.parser.GetDownloader().Download(c.client, media.URL.String(), savePath)
+	downloadResult, err := c.parser.GetDownloader().Download(ctx, c.client, media.URL.String(), savePath)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to download %s: %v", media.URL.String(), err))
 		return
 	}
+	media.Download = downloadResult
+
+	// 下载器可能根据 Content-Disposition 或文件内容修改了文件名
+	if downloadResult != nil && downloadResult.Path != "" {
+		media.Filename = filepath.Base(downloadResult.Path)
+	}
 
-	logger.Info(fmt.Sprintf("Successfully downloaded %s", filename))
+	logger.Info(fmt.Sprintf("Successfully downloaded %s", media.Filename))
 }
 
 // 添加保存元数据的方法
@@ -3,6 +3,7 @@ package parsers
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/json"
@@ -27,6 +28,12 @@ type DDYSParser struct {
 func NewDDYSParser(client *client.Client) *DDYSParser {
 	if client == nil {
 		log.Printf("Warning: NTDMParser initialized with nil client")
+	} else {
+		// 视频和字幕服务器都校验来源，对 ddys.pro 的所有子域名发送
+		client.AddSiteHeaders("ddys.pro", map[string]string{
+			"Referer": "https://ddys.pro/",
+			"Origin":  "https://ddys.pro",
+		})
 	}
 	return &DDYSParser{
 		client: client,
@@ -39,7 +46,7 @@ func (p *DDYSParser) GetDownloader() Downloader {
 	return &p.downloader
 }
 
-func (p *DDYSParser) Parse(html string) (*ParseResult, error) {
+func (p *DDYSParser) Parse(ctx context.Context, html string) (*ParseResult, error) {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse HTML: %w", err)
@@ -74,7 +81,7 @@ func (p *DDYSParser) Parse(html string) (*ParseResult, error) {
 	}
 
 	for _, subtitleURLStr := range subtitleURLs {
-		data, err := p.fetchSubtitleThenDecrypt(subtitleURLStr)
+		data, err := p.fetchSubtitleThenDecrypt(ctx, subtitleURLStr)
 		if err != nil {
 			log.Printf("Failed to process subtitle: %v", err)
 			continue
@@ -131,32 +138,28 @@ func (p *DDYSParser) parseEpisodeVideo(html string) ([]string, []string, error)
 	return urls, subtitleURLs, nil
 }
 
-func (d *DDYSDownloader) Download(client *client.Client, url string, filepath string) error {
+func (d *DDYSDownloader) Download(ctx context.Context, client *client.Client, url string, filepath string) (*downloader.Result, error) {
+	// User-Agent 和 Accept-Language 使用客户端的默认值，Referer 和 Origin 来自站点请求头
 	opts := &types.RequestOption{
 		Headers: map[string]string{
 			"Accept":          "*/*",
 			"Accept-Encoding": "identity;q=1, *;q=0",
-			"Accept-Language": "en,zh-CN;q=0.9,zh;q=0.8",
 			"Cache-Control":   "no-cache",
-			"Connection":      "keep-alive",
 			"Pragma":          "no-cache",
 			"Sec-Fetch-Dest":  "video",
 			"Sec-Fetch-Mode":  "no-cors",
 			"Sec-Fetch-Site":  "cross-site",
-			"User-Agent":      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/112.0.0.0 Safari/537.36",
-			"Referer":         "https://ddys.pro/",
-			"Origin":          "https://ddys.pro",
 		},
 	}
-	return downloader.NewDownloader(client, true).DownloadFile(url, filepath, opts)
+	return downloader.NewDownloader(client, true).DownloadFile(ctx, url, filepath, opts)
 }
 
-func (d *DDYSDownloader) DownloadWithPrefix(client *client.Client, url string, filepath string, urlPrefix string) error {
-	return nil
+func (d *DDYSDownloader) DownloadWithPrefix(ctx context.Context, client *client.Client, url string, filepath string, urlPrefix string) (*downloader.Result, error) {
+	return nil, nil
 }
 
-func (p *DDYSParser) fetchSubtitleThenDecrypt(url string) (string, error) {
-	resp, err := p.client.GetStream("GET", url, nil, nil)
+func (p *DDYSParser) fetchSubtitleThenDecrypt(ctx context.Context, url string) (string, error) {
+	resp, err := p.client.GetStream(ctx, "GET", url, nil, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch subtitle: %w", err)
 	}
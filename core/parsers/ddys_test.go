@@ -0,0 +1,37 @@
+package parsers
+
+import (
+	"testing"
+
+	"MediaNinja/core/request/client"
+)
+
+func TestDDYSParser(t *testing.T) {
+	result := replayParse(t, "ddys.json", "https://ddys.pro/sample-show/")
+	checkResult(t, result, "示例剧集 第1季", []wantMedia{
+		{"https://v.ddys.pro/v/2024/sample-show/S01E01.mp4", "S01E01.mp4"},
+		{"https://v.ddys.pro/v/2024/sample-show/S01E02.mp4", "S01E02.mp4"},
+	})
+
+	// 字幕解密、解压后去掉 &lrm;
+	if len(result.Files) != 1 {
+		t.Fatalf("got %d subtitle files, want 1", len(result.Files))
+	}
+	want := "WEBVTT\n\n00:00:01.000 --> 00:00:03.000\n你好，世界\n\n00:00:04.000 --> 00:00:06.000\nHello, world\n"
+	if f := result.Files[0]; f.Filename != "S01E01.vtt" || f.ContentType != "text" || f.Data != want {
+		t.Errorf("got subtitle %s (%s): %q", f.Filename, f.ContentType, f.Data)
+	}
+}
+
+func TestDDYSSiteHeaders(t *testing.T) {
+	c := client.NewClient("", 1, 0)
+	c.SiteHeaders = map[string]map[string]string{"ddys.pro": {"Referer": "https://ddys.pro/movie/"}}
+	NewDDYSParser(c)
+	// --site-header 配置的 Referer 优先
+	want := map[string]string{"Referer": "https://ddys.pro/movie/", "Origin": "https://ddys.pro"}
+	for k, v := range want {
+		if got := c.SiteHeaders["ddys.pro"][k]; got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package parsers
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/base64"
@@ -8,6 +9,7 @@ import (
 	"fmt"
 	"log"
 	"MediaNinja/core/request/client"
+	"MediaNinja/utils/concurrent"
 	"net/url"
 	"regexp"
 	"strings"
@@ -17,6 +19,9 @@ import (
 
 const tokenKey = "57A891D97E332A9D"
 
+// maxEpisodeFetches 是同时解析的剧集数，请求频率另由 client 的限速控制
+const maxEpisodeFetches = 4
+
 type NTDMParser struct {
 	client *client.Client
 	DefaultDownloader
@@ -31,7 +36,7 @@ func NewNTDMParser(client *client.Client) *NTDMParser {
 	}
 }
 
-func (p *NTDMParser) Parse(html string) (*ParseResult, error) {
+func (p *NTDMParser) Parse(ctx context.Context, html string) (*ParseResult, error) {
 	title := p.parseTitle(html)
 	log.Printf("Parsed title: %s", title)
 
@@ -55,11 +60,13 @@ func (p *NTDMParser) Parse(html string) (*ParseResult, error) {
 	}
 	resultChan := make(chan episodeResult, len(urls))
 
-	// 启动goroutine处理每个episode
+	// 启动goroutine处理每个episode，同时运行的数量由 limiter 限制
+	limiter := concurrent.NewLimiter(maxEpisodeFetches)
 	for i, episodeURL := range urls {
-		go func(idx int, u string) {
+		idx, u := i, episodeURL
+		limiter.Execute(func() {
 			log.Printf("Processing episode %d: %s", idx+1, u)
-			videoURL, err := p.parseEpisodeVideo(u)
+			videoURL, err := p.parseEpisodeVideo(ctx, u)
 			if err != nil {
 				resultChan <- episodeResult{idx, nil, err}
 				return
@@ -82,7 +89,7 @@ func (p *NTDMParser) Parse(html string) (*ParseResult, error) {
 				Filename:  fmt.Sprintf("%s-%d.mp4", title, idx+1),
 			}
 			resultChan <- episodeResult{idx, mediaInfo, nil}
-		}(i, episodeURL)
+		})
 	}
 
 	// 收集所有结果
@@ -137,20 +144,20 @@ func (p *NTDMParser) parseEpisodeURLs(html string) []string {
 	return urls
 }
 
-func (p *NTDMParser) parseEpisodeVideo(url string) (string, error) {
+func (p *NTDMParser) parseEpisodeVideo(ctx context.Context, url string) (string, error) {
 	if p.client == nil {
 		return "", fmt.Errorf("client is nil")
 	}
 
 	log.Printf("Fetching episode page: %s", url)
-	html, err := p.client.Get(url, nil)
+	html, err := p.client.Get(ctx, url, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch episode page: %w", err)
 	}
-	return p.parseVideoInfo(html)
+	return p.parseVideoInfo(ctx, html)
 }
 
-func (p *NTDMParser) parseVideoInfo(html string) (string, error) {
+func (p *NTDMParser) parseVideoInfo(ctx context.Context, html string) (string, error) {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
 	if err != nil {
 		return "", err
@@ -177,12 +184,12 @@ func (p *NTDMParser) parseVideoInfo(html string) (string, error) {
 
 	yhdmURL := fmt.Sprintf("https://danmu.yhdmjx.com/m3u8.php?url=%s", playerInfo.URL)
 	log.Printf("Generated YHDM URL: %s", yhdmURL)
-	return p.parseYhdmURL(yhdmURL)
+	return p.parseYhdmURL(ctx, yhdmURL)
 }
 
-func (p *NTDMParser) parseYhdmURL(url string) (string, error) {
+func (p *NTDMParser) parseYhdmURL(ctx context.Context, url string) (string, error) {
 	log.Printf("Fetching YHDM page: %s", url)
-	html, err := p.client.Get(url, nil)
+	html, err := p.client.Get(ctx, url, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch yhdm page: %w", err)
 	}
@@ -0,0 +1,12 @@
+package parsers
+
+import "testing"
+
+func TestNTDMParser(t *testing.T) {
+	result := replayParse(t, "ntdm.json", "https://www.ntdm9.com/video/5678.html")
+	// 第 3 集的页面没有播放器，跳过；第二个播放源不下载
+	checkResult(t, result, "示例动画", []wantMedia{
+		{"https://vip.example-cdn.com/20240101/5678-01/index.m3u8", "示例动画-1.mp4"},
+		{"https://vip.example-cdn.com/20240108/5678-02/index.m3u8", "示例动画-2.mp4"},
+	})
+}
@@ -1,6 +1,7 @@
 package parsers
 
 import (
+	"context"
 	"MediaNinja/core/request/client"
 	"MediaNinja/core/request/downloader"
 	"net/url"
@@ -16,9 +17,10 @@ const (
 )
 
 type MediaInfo struct {
-	URL       *url.URL  `json:"url"`
-	MediaType MediaType `json:"media_type"`
-	Filename  string    `json:"filename"`
+	URL       *url.URL           `json:"url"`
+	MediaType MediaType          `json:"media_type"`
+	Filename  string             `json:"filename"`
+	Download  *downloader.Result `json:"download,omitempty"` // 下载完成后由 crawler 填写
 }
 
 // FileContent represents content to be written to a file
@@ -36,27 +38,28 @@ type ParseResult struct {
 	Files   []FileContent          `json:"files,omitempty"` // New field for direct file contents
 }
 
+// Parser 解析页面，ctx 取消时应当停止发起新的请求
 type Parser interface {
-	Parse(html string) (*ParseResult, error)
+	Parse(ctx context.Context, html string) (*ParseResult, error)
 	GetDownloader() Downloader
 }
 
 type Downloader interface {
-	Download(client *client.Client, url string, filepath string) error
-	DownloadWithPrefix(client *client.Client, url string, filepath string, urlPrefix string) error
+	Download(ctx context.Context, client *client.Client, url string, filepath string) (*downloader.Result, error)
+	DownloadWithPrefix(ctx context.Context, client *client.Client, url string, filepath string, urlPrefix string) (*downloader.Result, error)
 }
 
 // DefaultDownloader 提供默认的下载实现
 type DefaultDownloader struct{}
 
 // Download 默认的下载实现
-func (d *DefaultDownloader) Download(client *client.Client, url string, filepath string) error {
-	return downloader.NewDownloader(client, true).DownloadFile(url, filepath, nil)
+func (d *DefaultDownloader) Download(ctx context.Context, client *client.Client, url string, filepath string) (*downloader.Result, error) {
+	return downloader.NewDownloader(client, true).DownloadFile(ctx, url, filepath, nil)
 }
 
 // DownloadWithPrefix 带前缀的下载实现
-func (d *DefaultDownloader) DownloadWithPrefix(client *client.Client, url string, filepath string, urlPrefix string) error {
-	return downloader.NewDownloader(client, true).DownloadFileWithPrefix(url, filepath, nil, urlPrefix)
+func (d *DefaultDownloader) DownloadWithPrefix(ctx context.Context, client *client.Client, url string, filepath string, urlPrefix string) (*downloader.Result, error) {
+	return downloader.NewDownloader(client, true).DownloadFileWithPrefix(ctx, url, filepath, nil, urlPrefix)
 }
 
 func GetParser(url string, client *client.Client) Parser {
@@ -86,7 +89,7 @@ func (p *DefaultParser) GetDownloader() Downloader {
 	return p
 }
 
-func (p *DefaultParser) Parse(html string) (*ParseResult, error) {
+func (p *DefaultParser) Parse(ctx context.Context, html string) (*ParseResult, error) {
 	// 实现默认的解析逻辑
 	return &ParseResult{
 		Extra: make(map[string]interface{}),
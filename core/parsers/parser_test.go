@@ -0,0 +1,54 @@
+package parsers
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"MediaNinja/core/request/client"
+)
+
+// replayParse 像 crawler 一样获取 pageURL 并交给对应的解析器，所有请求都从 testdata 中的 cassette 回放。
+// cassette 可以用 --record-session 录制真实会话得到。
+func replayParse(t *testing.T, fixture, pageURL string) *ParseResult {
+	t.Helper()
+	cassette, err := client.LoadCassette(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client.NewClient("", 1, 0)
+	c.Replay(cassette)
+
+	ctx := context.Background()
+	html, err := c.Get(ctx, pageURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := GetParser(pageURL, c).Parse(ctx, html)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return result
+}
+
+// wantMedia 是期望的解析结果，只比较 URL 和文件名
+type wantMedia struct {
+	url      string
+	filename string
+}
+
+func checkResult(t *testing.T, result *ParseResult, title string, media []wantMedia) {
+	t.Helper()
+	if result.Title == nil || *result.Title != title {
+		t.Errorf("title = %v, want %q", result.Title, title)
+	}
+	if len(result.Media) != len(media) {
+		t.Fatalf("got %d media, want %d: %+v", len(result.Media), len(media), result.Media)
+	}
+	for i, want := range media {
+		got := result.Media[i]
+		if got.URL.String() != want.url || got.Filename != want.filename {
+			t.Errorf("media %d = %s %q, want %s %q", i, got.URL, got.Filename, want.url, want.filename)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package parsers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -37,16 +38,16 @@ func (p *PornhubParser) GetDownloader() Downloader {
 }
 
 // Download 重写下载方法，使用存储的 prefix
-func (p *PornhubParser) Download(client *client.Client, url string, filepath string) error {
+func (p *PornhubParser) Download(ctx context.Context, client *client.Client, url string, filepath string) (*downloader.Result, error) {
 	if p.prefix != "" {
-		return p.DownloadWithPrefix(client, url, filepath, p.prefix)
+		return p.DownloadWithPrefix(ctx, client, url, filepath, p.prefix)
 	}
-	return p.DefaultDownloader.Download(client, url, filepath)
+	return p.DefaultDownloader.Download(ctx, client, url, filepath)
 }
 
 // DownloadWithPrefix 带前缀的下载方法
-func (p *PornhubParser) DownloadWithPrefix(client *client.Client, url string, filepath string, urlPrefix string) error {
-	return downloader.NewDownloader(client, true).DownloadFileWithPrefix(url, filepath, nil, urlPrefix)
+func (p *PornhubParser) DownloadWithPrefix(ctx context.Context, client *client.Client, url string, filepath string, urlPrefix string) (*downloader.Result, error) {
+	return downloader.NewDownloader(client, true).DownloadFileWithPrefix(ctx, url, filepath, nil, urlPrefix)
 }
 
 // GetPrefix 返回从 master.m3u8 URL 中提取的前缀
@@ -102,7 +103,7 @@ func (p *PornhubParser) writeDebugHTML(html string, reason string) string {
 	return filepath
 }
 
-func (p *PornhubParser) Parse(html string) (*ParseResult, error) {
+func (p *PornhubParser) Parse(ctx context.Context, html string) (*ParseResult, error) {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
 	if err != nil {
 		// 写入调试文件
@@ -0,0 +1,11 @@
+package parsers
+
+import "testing"
+
+func TestPornhubParser(t *testing.T) {
+	result := replayParse(t, "pornhub.json", "https://www.pornhub.com/view_video.php?viewkey=ph5f0000000001")
+	// 跳过 remote 的 mp4，选择分辨率最高的 HLS
+	checkResult(t, result, "Sample Video - Pornhub.com", []wantMedia{
+		{"https://ev-h.phncdn.com/hls/videos/202401/01/412345/1080P_4000K_412345.mp4/master.m3u8?validfrom=1704067200&hash=c3", "video_1080.mp4"},
+	})
+}
@@ -1,6 +1,7 @@
 package parsers
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"path"
@@ -13,7 +14,7 @@ type Rule34VideoParser struct {
 	DefaultDownloader
 }
 
-func (p *Rule34VideoParser) Parse(html string) (*ParseResult, error) {
+func (p *Rule34VideoParser) Parse(ctx context.Context, html string) (*ParseResult, error) {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse HTML: %w", err)
@@ -0,0 +1,11 @@
+package parsers
+
+import "testing"
+
+func TestRule34VideoParser(t *testing.T) {
+	result := replayParse(t, "rule34video.json", "https://rule34video.com/video/3412345/sample-title/")
+	// 选择第一个下载链接，标题中的非法字符替换为下划线
+	checkResult(t, result, "Sample: Title / Part 1", []wantMedia{
+		{"https://rule34video.com/get_file/47/8d1c9f0a/3412000/3412345/3412345_1080p.mp4/?download=true&download_filename=sample_1080p.mp4", "Sample_ Title _ Part 1.mp4"},
+	})
+}
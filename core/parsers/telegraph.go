@@ -1,6 +1,7 @@
 package parsers
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"path"
@@ -13,7 +14,7 @@ type TelegraphParser struct {
 	DefaultDownloader
 }
 
-func (p *TelegraphParser) Parse(html string) (*ParseResult, error) {
+func (p *TelegraphParser) Parse(ctx context.Context, html string) (*ParseResult, error) {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
 	if err != nil {
 
@@ -44,12 +45,8 @@ func (p *TelegraphParser) Parse(html string) (*ParseResult, error) {
 			return
 		}
 
-		// 生成文件名 (格式: 001.jpg, 002.jpg, ...)
-		ext := path.Ext(imgURL.Path)
-		if ext == "" {
-			ext = ".jpg" // 默认扩展名
-		}
-		filename := fmt.Sprintf("%03d%s", i+1, ext)
+		// 生成文件名 (格式: 001.jpg, 002.jpg, ...)，没有扩展名时由下载器根据文件内容补上
+		filename := fmt.Sprintf("%03d%s", i+1, path.Ext(imgURL.Path))
 
 		result.Media = append(result.Media, MediaInfo{
 			URL:       imgURL,
@@ -64,9 +61,11 @@ func (p *TelegraphParser) Parse(html string) (*ParseResult, error) {
 
 // normalizeURL 标准化图片URL
 func (p *TelegraphParser) normalizeURL(src string) (*url.URL, error) {
-	// 如果URL不是以http开头，添加协议
-	if !strings.HasPrefix(src, "http") {
-		src = "https://telegra.ph/" + strings.TrimPrefix(src, "//")
+	// 协议相对的 //host/path 只补充协议，其他相对路径补充 telegra.ph
+	if strings.HasPrefix(src, "//") {
+		src = "https:" + src
+	} else if !strings.HasPrefix(src, "http") {
+		src = "https://telegra.ph/" + strings.TrimLeft(src, "/")
 	}
 
 	imgURL, err := url.Parse(src)
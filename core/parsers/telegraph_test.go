@@ -0,0 +1,39 @@
+package parsers
+
+import "testing"
+
+func TestTelegraphParser(t *testing.T) {
+	result := replayParse(t, "telegraph.json", "https://telegra.ph/Sample-Post-01-01")
+	checkResult(t, result, "Sample Post", []wantMedia{
+		{"https://telegra.ph/file/6a5b15e7eb4d7329ca7af.jpg", "001.jpg"},
+		{"https://telegra.ph/file/0c8b7d3f2a1e9b4c5d6e7.png", "002.png"},
+		{"https://img.example.net/upload/photo", "003"},
+	})
+	for _, m := range result.Media {
+		if m.MediaType != Image {
+			t.Errorf("%s has media type %d, want Image", m.URL, m.MediaType)
+		}
+	}
+}
+
+// telegra.ph 页面中的图片通常是 /file/xxx.jpg 这样的根路径，
+// 直接拼接在 https://telegra.ph/ 后面会得到 https://telegra.ph//file/xxx.jpg
+func TestTelegraphNormalizeURL(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"/file/abc.jpg", "https://telegra.ph/file/abc.jpg"},
+		{"file/abc.jpg", "https://telegra.ph/file/abc.jpg"},
+		{"https://telegra.ph/file/abc.jpg", "https://telegra.ph/file/abc.jpg"},
+		{"http://img.example.net/abc.jpg", "http://img.example.net/abc.jpg"},
+		{"//cdn.example.net/abc.jpg", "https://cdn.example.net/abc.jpg"},
+	}
+	p := &TelegraphParser{}
+	for _, tt := range tests {
+		got, err := p.normalizeURL(tt.src)
+		if err != nil || got.String() != tt.want {
+			t.Errorf("normalizeURL(%q) = %v, %v, want %s", tt.src, got, err, tt.want)
+		}
+	}
+}
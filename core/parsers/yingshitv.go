@@ -1,6 +1,7 @@
 package parsers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -26,9 +27,9 @@ func NewYingshitvParser(client *client.Client, url string) *YingshitvParser {
 	}
 }
 
-func (p *YingshitvParser) Parse(_ string) (*ParseResult, error) {
+func (p *YingshitvParser) Parse(ctx context.Context, _ string) (*ParseResult, error) {
 	log.Printf("Starting to parse URL: %s", p.url)
-	videoInfo, err := p.fetchVideoInfo()
+	videoInfo, err := p.fetchVideoInfo(ctx)
 	if err != nil {
 		log.Printf("Error fetching video info: %v", err)
 		return nil, fmt.Errorf("failed to fetch video info: %w", err)
@@ -127,7 +128,7 @@ type VideoInfoResponse struct {
 	} `json:"data"`
 }
 
-func (p *YingshitvParser) fetchVideoInfo() (VideoInfo, error) {
+func (p *YingshitvParser) fetchVideoInfo(ctx context.Context) (VideoInfo, error) {
 	log.Printf("Fetching video info for videoMeta: %v", p.url)
 	videoMeta, err := p.parseVideoMeta()
 	if err != nil {
@@ -139,7 +140,7 @@ func (p *YingshitvParser) fetchVideoInfo() (VideoInfo, error) {
 	log.Printf("Requesting video info from URL: %s", url)
 
 	var videoInfo VideoInfoResponse
-	resp, err := p.client.Get(url, nil)
+	resp, err := p.client.Get(ctx, url, nil)
 
 	if err != nil {
 		return VideoInfo{}, fmt.Errorf("failed to fetch video info: %w", err)
@@ -0,0 +1,11 @@
+package parsers
+
+import "testing"
+
+func TestYingshitvParser(t *testing.T) {
+	result := replayParse(t, "yingshitv.json", "https://www.yingshi.tv/vod/play/id/198765/sid/2/nid/1.html")
+	checkResult(t, result, "示例剧集", []wantMedia{
+		{"https://play.example-cdn.com/20240101/a1b2c3/index.m3u8", "第1集"},
+		{"https://play.example-cdn.com/20240108/d4e5f6/index.m3u8", "第2集"},
+	})
+}
@@ -0,0 +1,421 @@
+package remux
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	codecH264 = "avc1"
+	codecH265 = "hvc1"
+	codecAAC  = "mp4a"
+)
+
+// H.264 NAL 单元类型
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+	h264NALPPS = 8
+	h264NALAUD = 9
+	h264NALFD  = 12
+)
+
+// H.265 NAL 单元类型
+const (
+	h265NALIRAPMin = 16
+	h265NALIRAPMax = 21
+	h265NALVPS     = 32
+	h265NALSPS     = 33
+	h265NALPPS     = 34
+	h265NALAUD     = 35
+	h265NALFD      = 38
+)
+
+// videoConfig 是从参数集中得到的视频解码配置
+type videoConfig struct {
+	width  int
+	height int
+
+	vps [][]byte // 仅 H.265
+	sps [][]byte
+	pps [][]byte
+
+	chromaFormat   int
+	bitDepthLuma   int
+	bitDepthChroma int
+
+	// H.265 专用
+	generalPTL     []byte // general_profile_space 到 general_level_idc 的 12 个字节
+	maxSubLayers   int
+	temporalNested bool
+}
+
+// splitNALUnits 按起始码切分 Annex B 字节流
+func splitNALUnits(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, data[start:end])
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+// unescapeRBSP 去除 NAL 单元中的防竞争字节（00 00 03）
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bitReader 按位读取 RBSP，越界时返回 0 并记录错误
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.data)*8 {
+		r.err = fmt.Errorf("unexpected end of parameter set")
+		return 0
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint32(b)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) {
+	r.pos += n
+}
+
+// ue 读取无符号指数哥伦布编码
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = fmt.Errorf("invalid exp-golomb code")
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se 读取有符号指数哥伦布编码
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+// parseH264SPS 解析 H.264 SPS，得到分辨率和色度信息
+func parseH264SPS(nalu []byte, cfg *videoConfig) error {
+	if len(nalu) < 4 {
+		return fmt.Errorf("h264 sps too short")
+	}
+	r := &bitReader{data: unescapeRBSP(nalu[1:])}
+	profile := r.bits(8)
+	r.skip(16) // constraint_set_flags, level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	separateColourPlane := false
+	cfg.bitDepthLuma, cfg.bitDepthChroma = 8, 8
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlane = r.bit() == 1
+		}
+		cfg.bitDepthLuma = int(r.ue()) + 8
+		cfg.bitDepthChroma = int(r.ue()) + 8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	cfg.chromaFormat = int(chromaFormat)
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1)
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bit())
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bit() == 1 {
+		cropLeft, cropRight = int(r.ue()), int(r.ue())
+		cropTop, cropBottom = int(r.ue()), int(r.ue())
+	}
+	if r.err != nil {
+		return fmt.Errorf("failed to parse h264 sps: %w", r.err)
+	}
+
+	cropUnitX, cropUnitY := 1, 2-frameMbsOnly
+	if chromaFormat != 0 && !separateColourPlane {
+		subWidth, subHeight := 2, 2
+		if chromaFormat == 2 {
+			subHeight = 1
+		} else if chromaFormat == 3 {
+			subWidth, subHeight = 1, 1
+		}
+		cropUnitX = subWidth
+		cropUnitY = subHeight * (2 - frameMbsOnly)
+	}
+
+	cfg.width = widthMbs*16 - (cropLeft+cropRight)*cropUnitX
+	cfg.height = (2-frameMbsOnly)*heightMapUnits*16 - (cropTop+cropBottom)*cropUnitY
+	return nil
+}
+
+// parseH265SPS 解析 H.265 SPS，得到分辨率、色度信息和 profile_tier_level
+func parseH265SPS(nalu []byte, cfg *videoConfig) error {
+	if len(nalu) < 15 {
+		return fmt.Errorf("h265 sps too short")
+	}
+	rbsp := unescapeRBSP(nalu[2:])
+	if len(rbsp) < 13 {
+		return fmt.Errorf("h265 sps too short")
+	}
+	cfg.generalPTL = append([]byte(nil), rbsp[1:13]...)
+
+	r := &bitReader{data: rbsp}
+	r.skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1 := int(r.bits(3))
+	cfg.maxSubLayers = maxSubLayersMinus1 + 1
+	cfg.temporalNested = r.bit() == 1
+
+	// profile_tier_level
+	r.skip(96)
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = r.bit() == 1
+		levelPresent[i] = r.bit() == 1
+	}
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			r.skip(2)
+		}
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chromaFormat := int(r.ue())
+	if chromaFormat == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	width := int(r.ue())
+	height := int(r.ue())
+	if r.bit() == 1 {
+		subWidth, subHeight := 1, 1
+		if chromaFormat == 1 {
+			subWidth, subHeight = 2, 2
+		} else if chromaFormat == 2 {
+			subWidth = 2
+		}
+		left, right := int(r.ue()), int(r.ue())
+		top, bottom := int(r.ue()), int(r.ue())
+		width -= (left + right) * subWidth
+		height -= (top + bottom) * subHeight
+	}
+	cfg.bitDepthLuma = int(r.ue()) + 8
+	cfg.bitDepthChroma = int(r.ue()) + 8
+	if r.err != nil {
+		return fmt.Errorf("failed to parse h265 sps: %w", r.err)
+	}
+
+	cfg.chromaFormat = chromaFormat
+	cfg.width = width
+	cfg.height = height
+	return nil
+}
+
+// avcC 构造 AVCDecoderConfigurationRecord
+func (cfg *videoConfig) avcC() []byte {
+	sps := cfg.sps[0]
+	b := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe0 | byte(len(cfg.sps))}
+	for _, s := range cfg.sps {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+		b = append(b, s...)
+	}
+	b = append(b, byte(len(cfg.pps)))
+	for _, p := range cfg.pps {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(p)))
+		b = append(b, p...)
+	}
+	switch sps[1] {
+	case 100, 110, 122, 144:
+		b = append(b,
+			0xfc|byte(cfg.chromaFormat),
+			0xf8|byte(cfg.bitDepthLuma-8),
+			0xf8|byte(cfg.bitDepthChroma-8),
+			0, // numOfSequenceParameterSetExt
+		)
+	}
+	return b
+}
+
+// hvcC 构造 HEVCDecoderConfigurationRecord
+func (cfg *videoConfig) hvcC() []byte {
+	b := []byte{1}
+	b = append(b, cfg.generalPTL...)
+	b = append(b,
+		0xf0, 0x00, // min_spatial_segmentation_idc
+		0xfc, // parallelismType
+		0xfc|byte(cfg.chromaFormat),
+		0xf8|byte(cfg.bitDepthLuma-8),
+		0xf8|byte(cfg.bitDepthChroma-8),
+		0, 0, // avgFrameRate
+	)
+	nested := byte(0)
+	if cfg.temporalNested {
+		nested = 1
+	}
+	b = append(b, byte(cfg.maxSubLayers&7)<<3|nested<<2|3)
+
+	arrays := []struct {
+		nalType byte
+		nalus   [][]byte
+	}{
+		{h265NALVPS, cfg.vps},
+		{h265NALSPS, cfg.sps},
+		{h265NALPPS, cfg.pps},
+	}
+	b = append(b, byte(len(arrays)))
+	for _, array := range arrays {
+		b = append(b, 0x80|array.nalType)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(array.nalus)))
+		for _, nalu := range array.nalus {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(nalu)))
+			b = append(b, nalu...)
+		}
+	}
+	return b
+}
+
+// adtsHeader 是 ADTS 帧头中用到的字段
+type adtsHeader struct {
+	objectType   int
+	sampleRateIx int
+	channels     int
+	headerSize   int
+	frameSize    int
+}
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// parseADTS 解析 ADTS 帧头，数据不足一个帧头时返回 false
+func parseADTS(data []byte) (adtsHeader, bool, error) {
+	if len(data) < 7 {
+		return adtsHeader{}, false, nil
+	}
+	if data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+		return adtsHeader{}, false, fmt.Errorf("invalid ADTS sync word")
+	}
+	h := adtsHeader{
+		objectType:   int(data[2]>>6) + 1,
+		sampleRateIx: int(data[2] >> 2 & 0x0f),
+		channels:     int(data[2]&1)<<2 | int(data[3]>>6),
+		headerSize:   7,
+		frameSize:    int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5]>>5),
+	}
+	if data[1]&1 == 0 {
+		h.headerSize = 9 // 带 CRC
+	}
+	if h.sampleRateIx >= len(aacSampleRates) {
+		return h, false, fmt.Errorf("invalid ADTS sample rate index %d", h.sampleRateIx)
+	}
+	if h.frameSize < h.headerSize {
+		return h, false, fmt.Errorf("invalid ADTS frame size %d", h.frameSize)
+	}
+	return h, true, nil
+}
+
+// audioSpecificConfig 构造 AAC 的 AudioSpecificConfig
+func (h adtsHeader) audioSpecificConfig() []byte {
+	v := uint16(h.objectType)<<11 | uint16(h.sampleRateIx)<<7 | uint16(h.channels)<<3
+	return binary.BigEndian.AppendUint16(nil, v)
+}
@@ -0,0 +1,490 @@
+package remux
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+)
+
+const movieTimescale = 1000
+
+// box 构造一个 MP4 box
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// fullBox 构造带 version 和 flags 的 box
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// 单位矩阵
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func matrix() []byte {
+	var b []byte
+	for _, v := range unityMatrix {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// writeMP4 输出普通 MP4：ftyp、moov 在前（便于在线播放），mdat 在后
+func writeMP4(w io.Writer, data *os.File, tracks []*track) error {
+	ftyp := box("ftyp", []byte("isom"), u32(512), []byte("isomiso2avc1mp41"))
+
+	// co64 的大小固定，先用 0 作为基准偏移计算 moov 的大小
+	moov := buildMoov(tracks, 0, false)
+	base := int64(len(ftyp) + len(moov) + 16)
+	moov = buildMoov(tracks, base, false)
+
+	info, err := data.Stat()
+	if err != nil {
+		return err
+	}
+	mdatHeader := append(u32(1), "mdat"...)
+	mdatHeader = append(mdatHeader, u64(uint64(16+info.Size()))...)
+
+	for _, part := range [][]byte{ftyp, moov, mdatHeader} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, io.NewSectionReader(data, 0, info.Size()))
+	return err
+}
+
+// writeFragmentedMP4 输出 fragmented MP4：有视频时在每个关键帧处开始新的分片，
+// 纯音频时每两秒一个分片
+func writeFragmentedMP4(w io.Writer, data *os.File, tracks []*track) error {
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41"))
+	if _, err := w.Write(ftyp); err != nil {
+		return err
+	}
+	if _, err := w.Write(buildMoov(tracks, 0, true)); err != nil {
+		return err
+	}
+
+	boundaries := fragmentBoundaries(tracks)
+	cursors := make([]int, len(tracks))
+	for k := range boundaries {
+		end := math.Inf(1)
+		if k+1 < len(boundaries) {
+			end = boundaries[k+1]
+		}
+
+		// 收集本分片中每个轨道的样本
+		ranges := make([][2]int, len(tracks))
+		for i, t := range tracks {
+			start := cursors[i]
+			for cursors[i] < len(t.samples) && float64(t.samples[cursors[i]].dts)/float64(t.timescale) < end {
+				cursors[i]++
+			}
+			ranges[i] = [2]int{start, cursors[i]}
+		}
+		if err := writeFragment(w, data, tracks, ranges, uint32(k+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fragmentBoundaries 返回每个分片的起始时间（秒）
+func fragmentBoundaries(tracks []*track) []float64 {
+	for _, t := range tracks {
+		if t.kind != kindVideo {
+			continue
+		}
+		var boundaries []float64
+		for _, s := range t.samples {
+			if s.key {
+				boundaries = append(boundaries, float64(s.dts)/float64(t.timescale))
+			}
+		}
+		return boundaries
+	}
+
+	t := tracks[0]
+	start := float64(t.samples[0].dts) / float64(t.timescale)
+	end := float64(t.samples[len(t.samples)-1].dts) / float64(t.timescale)
+	boundaries := []float64{math.Inf(-1)}
+	for s := start + 2; s <= end; s += 2 {
+		boundaries = append(boundaries, s)
+	}
+	return boundaries
+}
+
+// writeFragment 写入一个 moof 和对应的 mdat
+func writeFragment(w io.Writer, data *os.File, tracks []*track, ranges [][2]int, sequence uint32) error {
+	build := func(offsets []int32) []byte {
+		var trafs [][]byte
+		for i, t := range tracks {
+			r := ranges[i]
+			if r[0] == r[1] {
+				continue
+			}
+			trafs = append(trafs, buildTraf(t, uint32(i+1), r[0], r[1], offsets[i]))
+		}
+		return box("moof", append([][]byte{fullBox("mfhd", 0, 0, u32(sequence))}, trafs...)...)
+	}
+
+	// trun 的大小与 data_offset 的值无关，先计算 moof 的大小再填入真实偏移
+	offsets := make([]int32, len(tracks))
+	moofSize := len(build(offsets))
+	var mdatSize int64
+	for i, t := range tracks {
+		offsets[i] = int32(int64(moofSize) + 8 + mdatSize)
+		for _, s := range t.samples[ranges[i][0]:ranges[i][1]] {
+			mdatSize += int64(s.size)
+		}
+	}
+	if mdatSize == 0 {
+		return nil
+	}
+
+	if _, err := w.Write(build(offsets)); err != nil {
+		return err
+	}
+	if _, err := w.Write(append(u32(uint32(8+mdatSize)), "mdat"...)); err != nil {
+		return err
+	}
+	for i, t := range tracks {
+		for _, s := range t.samples[ranges[i][0]:ranges[i][1]] {
+			if _, err := io.Copy(w, io.NewSectionReader(data, s.offset, int64(s.size))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func buildTraf(t *track, trackID uint32, from, to int, dataOffset int32) []byte {
+	firstDTS := t.samples[0].dts
+	tfhd := fullBox("tfhd", 0, 0x020000, u32(trackID)) // default-base-is-moof
+	tfdt := fullBox("tfdt", 1, 0, u64(uint64(t.samples[from].dts-firstDTS)))
+
+	// data-offset、sample-duration、sample-size、sample-flags、sample-composition-time-offset
+	entries := make([]byte, 0, 8+16*(to-from))
+	entries = append(entries, u32(uint32(to-from))...)
+	entries = append(entries, u32(uint32(dataOffset))...)
+	for i := from; i < to; i++ {
+		s := t.samples[i]
+		flags := uint32(0x02000000) // 不依赖其他帧
+		if !s.key {
+			flags = 0x01010000 // 依赖其他帧，非同步帧
+		}
+		entries = append(entries, u32(t.durations[i])...)
+		entries = append(entries, u32(s.size)...)
+		entries = append(entries, u32(flags)...)
+		entries = append(entries, u32(uint32(s.cto))...)
+	}
+	trun := fullBox("trun", 1, 0x000f01, entries)
+	return box("traf", tfhd, tfdt, trun)
+}
+
+// buildMoov 构造 moov。普通 MP4 中 chunkBase 是 mdat 数据在文件中的起始偏移；
+// fragmented MP4 中样本表为空，并加入 mvex
+func buildMoov(tracks []*track, chunkBase int64, fragmented bool) []byte {
+	start := math.Inf(1)
+	for _, t := range tracks {
+		start = math.Min(start, t.startSeconds())
+	}
+
+	audioTracks := 0
+	for _, t := range tracks {
+		if t.kind == kindAudio {
+			audioTracks++
+		}
+	}
+
+	var movieDuration uint64
+	traks := make([][]byte, 0, len(tracks))
+	seenAudio := false
+	for i, t := range tracks {
+		delay := uint64(math.Round((t.startSeconds() - start) * movieTimescale))
+		duration := uint64(t.duration) * movieTimescale / uint64(t.timescale)
+		movieDuration = max(movieDuration, delay+duration)
+
+		// 多个音轨互为备选，只启用第一个，播放器可以切换到其他音轨
+		flags, group := uint32(0x3), uint16(0) // track_enabled | track_in_movie
+		if t.kind == kindAudio && audioTracks > 1 {
+			group = 1
+			if seenAudio {
+				flags = 0x2
+			}
+			seenAudio = true
+		}
+		traks = append(traks, buildTrak(t, uint32(i+1), flags, group, delay, duration, chunkBase, fragmented))
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation_time, modification_time
+		u32(movieTimescale),
+		u32(uint32(movieDuration)),
+		u32(0x00010000), u16(0x0100), // rate, volume
+		make([]byte, 10),
+		matrix(),
+		make([]byte, 24),
+		u32(uint32(len(tracks)+1)), // next_track_ID
+	)
+
+	children := append([][]byte{mvhd}, traks...)
+	if fragmented {
+		var trexs [][]byte
+		for i := range tracks {
+			trexs = append(trexs, fullBox("trex", 0, 0, u32(uint32(i+1)), u32(1), u32(0), u32(0), u32(0)))
+		}
+		children = append(children, box("mvex", trexs...))
+	}
+	return box("moov", children...)
+}
+
+func buildTrak(t *track, trackID, flags uint32, alternateGroup uint16, delay, duration uint64, chunkBase int64, fragmented bool) []byte {
+	var width, height uint32
+	var volume uint16
+	if t.kind == kindVideo {
+		width, height = uint32(t.video.width), uint32(t.video.height)
+	} else {
+		volume = 0x0100
+	}
+
+	tkhd := fullBox("tkhd", 0, flags,
+		u32(0), u32(0),
+		u32(trackID),
+		u32(0),
+		u32(uint32(delay+duration)),
+		make([]byte, 8),
+		u16(0), u16(alternateGroup), u16(volume), u16(0),
+		matrix(),
+		u32(width<<16), u32(height<<16),
+	)
+
+	// 编辑列表：先用空编辑对齐轨道之间的起始时间，再跳过 B 帧引入的显示延迟
+	var edits [][]byte
+	if delay > 0 {
+		edits = append(edits, u32(uint32(delay)), u32(math.MaxUint32), u32(0x00010000))
+	}
+	mediaTime := t.minPTS - t.samples[0].dts
+	edits = append(edits, u32(uint32(duration)), u32(uint32(mediaTime)), u32(0x00010000))
+	edts := box("edts", fullBox("elst", 0, 0, append([][]byte{u32(uint32(len(edits) / 3))}, edits...)...))
+
+	mdhd := fullBox("mdhd", 0, 0,
+		u32(0), u32(0),
+		u32(t.timescale),
+		u32(uint32(t.duration)),
+		u16(packLanguage(t.language)),
+		u16(0),
+	)
+
+	handler, name, mediaHeader := "soun", "SoundHandler", fullBox("smhd", 0, 0, u16(0), u16(0))
+	if t.kind == kindVideo {
+		handler, name, mediaHeader = "vide", "VideoHandler", fullBox("vmhd", 0, 1, make([]byte, 8))
+	}
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name), []byte{0})
+
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	minf := box("minf", mediaHeader, dinf, buildStbl(t, chunkBase, fragmented))
+	mdia := box("mdia", mdhd, hdlr, minf)
+	return box("trak", tkhd, edts, mdia)
+}
+
+// packLanguage 把三字母语言代码打包为 mdhd 中的 15 位格式
+func packLanguage(lang string) uint16 {
+	if len(lang) != 3 {
+		lang = "und"
+	}
+	var v uint16
+	for i := 0; i < 3; i++ {
+		c := lang[i]
+		if c < 'a' || c > 'z' {
+			return packLanguage("und")
+		}
+		v = v<<5 | uint16(c-0x60)
+	}
+	return v
+}
+
+func buildStbl(t *track, chunkBase int64, fragmented bool) []byte {
+	stsd := fullBox("stsd", 0, 0, u32(1), sampleEntry(t))
+	if fragmented {
+		return box("stbl", stsd,
+			fullBox("stts", 0, 0, u32(0)),
+			fullBox("stsc", 0, 0, u32(0)),
+			fullBox("stsz", 0, 0, u32(0), u32(0)),
+			fullBox("stco", 0, 0, u32(0)),
+		)
+	}
+
+	children := [][]byte{stsd, buildStts(t)}
+	if ctts := buildCtts(t); ctts != nil {
+		children = append(children, ctts)
+	}
+	if stss := buildStss(t); stss != nil {
+		children = append(children, stss)
+	}
+
+	// 连续存放的同一轨道样本组成一个 chunk
+	var chunkOffsets []int64
+	var chunkSizes []uint32
+	for i, s := range t.samples {
+		if i == 0 || s.offset != t.samples[i-1].offset+int64(t.samples[i-1].size) {
+			chunkOffsets = append(chunkOffsets, chunkBase+s.offset)
+			chunkSizes = append(chunkSizes, 0)
+		}
+		chunkSizes[len(chunkSizes)-1]++
+	}
+
+	var stsc []byte
+	var stscCount uint32
+	for i, n := range chunkSizes {
+		if i == 0 || n != chunkSizes[i-1] {
+			stsc = append(stsc, u32(uint32(i+1))...)
+			stsc = append(stsc, u32(n)...)
+			stsc = append(stsc, u32(1)...)
+			stscCount++
+		}
+	}
+
+	sizes := make([]byte, 0, 4*len(t.samples))
+	for _, s := range t.samples {
+		sizes = binary.BigEndian.AppendUint32(sizes, s.size)
+	}
+	offsets := make([]byte, 0, 8*len(chunkOffsets))
+	for _, off := range chunkOffsets {
+		offsets = binary.BigEndian.AppendUint64(offsets, uint64(off))
+	}
+
+	children = append(children,
+		fullBox("stsc", 0, 0, u32(stscCount), stsc),
+		fullBox("stsz", 0, 0, u32(0), u32(uint32(len(t.samples))), sizes),
+		fullBox("co64", 0, 0, u32(uint32(len(chunkOffsets))), offsets),
+	)
+	return box("stbl", children...)
+}
+
+func buildStts(t *track) []byte {
+	var entries []byte
+	var count uint32
+	for i := 0; i < len(t.durations); {
+		j := i
+		for j < len(t.durations) && t.durations[j] == t.durations[i] {
+			j++
+		}
+		entries = append(entries, u32(uint32(j-i))...)
+		entries = append(entries, u32(t.durations[i])...)
+		count++
+		i = j
+	}
+	return fullBox("stts", 0, 0, u32(count), entries)
+}
+
+func buildCtts(t *track) []byte {
+	hasOffset := false
+	for _, s := range t.samples {
+		if s.cto != 0 {
+			hasOffset = true
+			break
+		}
+	}
+	if !hasOffset {
+		return nil
+	}
+
+	var entries []byte
+	var count uint32
+	for i := 0; i < len(t.samples); {
+		j := i
+		for j < len(t.samples) && t.samples[j].cto == t.samples[i].cto {
+			j++
+		}
+		entries = append(entries, u32(uint32(j-i))...)
+		entries = append(entries, u32(uint32(t.samples[i].cto))...)
+		count++
+		i = j
+	}
+	return fullBox("ctts", 0, 0, u32(count), entries)
+}
+
+// buildStss 列出关键帧，全部是关键帧时省略
+func buildStss(t *track) []byte {
+	var entries []byte
+	var count uint32
+	for i, s := range t.samples {
+		if s.key {
+			entries = append(entries, u32(uint32(i+1))...)
+			count++
+		}
+	}
+	if int(count) == len(t.samples) {
+		return nil
+	}
+	return fullBox("stss", 0, 0, u32(count), entries)
+}
+
+// sampleEntry 构造 stsd 中的 avc1、hvc1 或 mp4a
+func sampleEntry(t *track) []byte {
+	reserved := append(make([]byte, 6), u16(1)...) // data_reference_index
+	if t.kind == kindVideo {
+		config := box("avcC", t.video.avcC())
+		if t.codec == codecH265 {
+			config = box("hvcC", t.video.hvcC())
+		}
+		return box(t.codec,
+			reserved,
+			make([]byte, 16), // pre_defined、reserved
+			u16(uint16(t.video.width)), u16(uint16(t.video.height)),
+			u32(0x00480000), u32(0x00480000), // 72 dpi
+			u32(0),
+			u16(1), // frame_count
+			make([]byte, 32),
+			u16(0x0018), u16(0xffff),
+			config,
+		)
+	}
+
+	return box(codecAAC,
+		reserved,
+		make([]byte, 8),
+		u16(uint16(t.audio.channels)), u16(16),
+		u16(0), u16(0),
+		u32(t.timescale<<16),
+		esds(t.audio.audioSpecificConfig()),
+	)
+}
+
+// esds 构造 AAC 的 ES_Descriptor
+func esds(asc []byte) []byte {
+	descriptor := func(tag byte, payload ...[]byte) []byte {
+		var body []byte
+		for _, p := range payload {
+			body = append(body, p...)
+		}
+		return append([]byte{tag, byte(len(body))}, body...)
+	}
+
+	decoderSpecific := descriptor(0x05, asc)
+	decoderConfig := descriptor(0x04,
+		[]byte{0x40, 0x15}, // Audio ISO/IEC 14496-3，音频流
+		[]byte{0, 0, 0},    // bufferSizeDB
+		u32(0), u32(0),     // maxBitrate、avgBitrate
+		decoderSpecific,
+	)
+	es := descriptor(0x03, u16(1), []byte{0}, decoderConfig, descriptor(0x06, []byte{0x02}))
+	return fullBox("esds", 0, 0, es)
+}
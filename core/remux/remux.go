@@ -0,0 +1,357 @@
+// Package remux 将 MPEG-TS 转封装为 MP4，不重新编码，支持 H.264、H.265 和 AAC。
+package remux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrUnsupported 表示输入中包含无法原生转封装的内容，调用方可以改用 ffmpeg
+var ErrUnsupported = errors.New("unsupported by native remuxer")
+
+const (
+	kindVideo = "video"
+	kindAudio = "audio"
+
+	aacFrameSamples = 1024
+)
+
+// Input 是一个额外的音轨文件
+type Input struct {
+	Path     string
+	Language string // ISO 639-2 三字母语言代码
+}
+
+// Options 控制输出文件的格式
+type Options struct {
+	Fragmented bool // 输出 fragmented MP4（moov 在前，按关键帧切分为 moof/mdat）
+}
+
+// TSToMP4 把 input 中的视频和音频，以及 audio 中的额外音轨写入 output。
+// 额外音轨排在 input 自带的音轨之前，第一个音轨作为默认音轨。
+func TSToMP4(input string, audio []Input, output string, opts Options) (err error) {
+	dataFile := output + ".mdat"
+	data, err := os.Create(dataFile)
+	if err != nil {
+		return fmt.Errorf("failed to create sample data file: %w", err)
+	}
+	defer os.Remove(dataFile)
+	defer data.Close()
+
+	// 所有样本先按解出的顺序写入临时文件，最后再生成 moov 并拷贝到输出文件
+	samples := &sampleWriter{w: bufio.NewWriterSize(data, 1<<20)}
+
+	main := newTSDemuxer(samples, false, "und")
+	if err := main.demuxFile(input); err != nil {
+		return err
+	}
+
+	var tracks []*track
+	if main.video != nil {
+		tracks = append(tracks, main.video)
+	}
+	for _, in := range audio {
+		d := newTSDemuxer(samples, true, in.Language)
+		if err := d.demuxFile(in.Path); err != nil {
+			return err
+		}
+		tracks = append(tracks, d.audios...)
+	}
+	tracks = append(tracks, main.audios...)
+
+	if err := samples.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write sample data: %w", err)
+	}
+
+	result := tracks[:0]
+	for _, t := range tracks {
+		if len(t.samples) > 0 {
+			t.finish()
+			result = append(result, t)
+		}
+	}
+	if len(result) == 0 {
+		return fmt.Errorf("%w: no H.264, H.265 or AAC samples found", ErrUnsupported)
+	}
+
+	out, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(output)
+		}
+	}()
+
+	w := bufio.NewWriterSize(out, 1<<20)
+	if opts.Fragmented {
+		err = writeFragmentedMP4(w, data, result)
+	} else {
+		err = writeMP4(w, data, result)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write mp4: %w", err)
+	}
+	return w.Flush()
+}
+
+// sampleWriter 把样本数据追加到临时文件并返回偏移
+type sampleWriter struct {
+	w    *bufio.Writer
+	size int64
+}
+
+func (s *sampleWriter) write(parts ...[]byte) (int64, uint32, error) {
+	offset := s.size
+	var n int
+	for _, p := range parts {
+		written, err := s.w.Write(p)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to write sample data: %w", err)
+		}
+		n += written
+	}
+	s.size += int64(n)
+	return offset, uint32(n), nil
+}
+
+// sample 是一个视频帧或音频帧在临时文件中的位置和时间信息
+type sample struct {
+	offset int64
+	size   uint32
+	dts    int64 // 轨道时间刻度下的解码时间
+	cto    int32 // 显示时间与解码时间的差
+	key    bool
+}
+
+type track struct {
+	kind      string
+	codec     string
+	timescale uint32
+	language  string
+
+	video           *videoConfig
+	audio           adtsHeader
+	audioConfigured bool
+
+	samples []sample
+	nextDTS int64 // 音频：下一个帧的预期解码时间
+
+	// finish 之后可用
+	durations []uint32
+	duration  int64 // 轨道时长（轨道时间刻度）
+	minPTS    int64
+}
+
+func newTrack(kind, codec string, timescale uint32, language string) *track {
+	return &track{
+		kind:      kind,
+		codec:     codec,
+		timescale: timescale,
+		language:  language,
+		video:     &videoConfig{},
+	}
+}
+
+// addVideo 把一个访问单元转换为长度前缀格式并写入临时文件。
+// 参数集写入 avcC/hvcC，不保留在样本中；第一个关键帧之前的帧无法解码，直接丢弃。
+func (t *track) addVideo(samples *sampleWriter, payload []byte, pts, dts int64) error {
+	if pts < 0 {
+		return nil
+	}
+
+	var parts [][]byte
+	key := false
+	for _, nalu := range splitNALUnits(payload) {
+		if len(nalu) == 0 {
+			continue
+		}
+		skip, isKey, err := t.inspectNALU(nalu)
+		if err != nil {
+			return err
+		}
+		key = key || isKey
+		if skip {
+			continue
+		}
+		parts = append(parts, binary.BigEndian.AppendUint32(nil, uint32(len(nalu))), nalu)
+	}
+
+	if len(parts) == 0 || !t.configured() || (len(t.samples) == 0 && !key) {
+		return nil
+	}
+
+	offset, size, err := samples.write(parts...)
+	if err != nil {
+		return err
+	}
+	cto := pts - dts
+	if cto < 0 {
+		cto = 0
+	}
+	t.samples = append(t.samples, sample{offset: offset, size: size, dts: dts, cto: int32(cto), key: key})
+	return nil
+}
+
+// inspectNALU 记录参数集，返回该 NAL 单元是否应从样本中去掉以及是否为关键帧
+func (t *track) inspectNALU(nalu []byte) (skip, key bool, err error) {
+	cfg := t.video
+	if t.codec == codecH264 {
+		switch nalu[0] & 0x1f {
+		case h264NALSPS:
+			if cfg.sps == nil {
+				if err := parseH264SPS(nalu, cfg); err != nil {
+					return true, false, fmt.Errorf("%w: %v", ErrUnsupported, err)
+				}
+				cfg.sps = [][]byte{append([]byte(nil), nalu...)}
+			}
+			return true, false, nil
+		case h264NALPPS:
+			if cfg.pps == nil {
+				cfg.pps = [][]byte{append([]byte(nil), nalu...)}
+			}
+			return true, false, nil
+		case h264NALAUD, h264NALFD:
+			return true, false, nil
+		case h264NALIDR:
+			return false, true, nil
+		}
+		return false, false, nil
+	}
+
+	if len(nalu) < 2 {
+		return true, false, nil
+	}
+	switch nalType := nalu[0] >> 1 & 0x3f; {
+	case nalType == h265NALVPS:
+		if cfg.vps == nil {
+			cfg.vps = [][]byte{append([]byte(nil), nalu...)}
+		}
+		return true, false, nil
+	case nalType == h265NALSPS:
+		if cfg.sps == nil {
+			if err := parseH265SPS(nalu, cfg); err != nil {
+				return true, false, fmt.Errorf("%w: %v", ErrUnsupported, err)
+			}
+			cfg.sps = [][]byte{append([]byte(nil), nalu...)}
+		}
+		return true, false, nil
+	case nalType == h265NALPPS:
+		if cfg.pps == nil {
+			cfg.pps = [][]byte{append([]byte(nil), nalu...)}
+		}
+		return true, false, nil
+	case nalType == h265NALAUD, nalType == h265NALFD:
+		return true, false, nil
+	case nalType >= h265NALIRAPMin && nalType <= h265NALIRAPMax:
+		return false, true, nil
+	}
+	return false, false, nil
+}
+
+// configured 判断是否已经拿到生成 sample entry 所需的参数集
+func (t *track) configured() bool {
+	cfg := t.video
+	if t.codec == codecH265 && cfg.vps == nil {
+		return false
+	}
+	return cfg.sps != nil && cfg.pps != nil
+}
+
+// addAudio 把 PES 中的 ADTS 帧拆分为 AAC 样本，时间戳按每帧 1024 个采样连续递增，
+// 与 PES 时间戳相差过大时（如流中断）重新对齐
+func (t *track) addAudio(samples *sampleWriter, stream *pesStream, payload []byte, pts int64) error {
+	data := append(stream.carry, payload...)
+	stream.carry = nil
+
+	first := true
+	for len(data) > 0 {
+		h, ok, err := parseADTS(data)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUnsupported, err)
+		}
+		if !ok || len(data) < h.frameSize {
+			stream.carry = append([]byte(nil), data...)
+			break
+		}
+
+		if !t.audioConfigured {
+			t.audio = h
+			t.audioConfigured = true
+			t.timescale = uint32(aacSampleRates[h.sampleRateIx])
+		}
+
+		dts := t.nextDTS
+		if first && pts >= 0 {
+			expected := pts * int64(t.timescale) / 90000
+			if len(t.samples) == 0 || abs64(expected-dts) > 2*aacFrameSamples {
+				dts = expected
+			}
+		}
+		first = false
+
+		frame := data[h.headerSize:h.frameSize]
+		data = data[h.frameSize:]
+		if len(t.samples) == 0 && pts < 0 {
+			// 还没有可用的时间戳
+			continue
+		}
+
+		offset, size, err := samples.write(frame)
+		if err != nil {
+			return err
+		}
+		t.samples = append(t.samples, sample{offset: offset, size: size, dts: dts, key: true})
+		t.nextDTS = dts + aacFrameSamples
+	}
+	return nil
+}
+
+// finish 计算每个样本的时长和轨道的起始显示时间
+func (t *track) finish() {
+	n := len(t.samples)
+	t.durations = make([]uint32, n)
+	defaultDuration := int64(aacFrameSamples)
+	if t.kind == kindVideo {
+		defaultDuration = int64(t.timescale) / 25
+	}
+
+	t.minPTS = t.samples[0].dts + int64(t.samples[0].cto)
+	for i := range t.samples {
+		var d int64
+		if i+1 < n {
+			d = t.samples[i+1].dts - t.samples[i].dts
+		} else if i > 0 {
+			d = int64(t.durations[i-1])
+		} else {
+			d = defaultDuration
+		}
+		if d < 0 {
+			d = 0
+		}
+		t.durations[i] = uint32(d)
+		if pts := t.samples[i].dts + int64(t.samples[i].cto); pts < t.minPTS {
+			t.minPTS = pts
+		}
+	}
+	t.duration = t.samples[n-1].dts - t.samples[0].dts + int64(t.durations[n-1])
+}
+
+// startSeconds 返回轨道第一帧的显示时间（秒）
+func (t *track) startSeconds() float64 {
+	return float64(t.minPTS) / float64(t.timescale)
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
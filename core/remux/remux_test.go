@@ -0,0 +1,291 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bitWriter 用于在测试中构造参数集
+type bitWriter struct {
+	buf  []byte
+	bits int
+}
+
+func (w *bitWriter) put(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>i&1) << (7 - w.bits%8)
+		w.bits++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.put(0, n)
+	w.put(v, n+1)
+}
+
+// testSPS 构造一个 1280x720 的 H.264 baseline SPS
+func testSPS() []byte {
+	w := &bitWriter{}
+	w.put(0x67, 8) // NAL 头
+	w.put(66, 8)   // profile_idc
+	w.put(0, 8)    // constraint flags
+	w.put(31, 8)   // level_idc
+	w.ue(0)        // seq_parameter_set_id
+	w.ue(0)        // log2_max_frame_num_minus4
+	w.ue(0)        // pic_order_cnt_type
+	w.ue(0)        // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1)        // max_num_ref_frames
+	w.put(0, 1)    // gaps_in_frame_num_value_allowed_flag
+	w.ue(79)       // pic_width_in_mbs_minus1
+	w.ue(44)       // pic_height_in_map_units_minus1
+	w.put(1, 1)    // frame_mbs_only_flag
+	w.put(1, 1)    // direct_8x8_inference_flag
+	w.put(0, 1)    // frame_cropping_flag
+	w.put(0, 1)    // vui_parameters_present_flag
+	w.put(1, 1)    // rbsp_stop_one_bit
+	return w.buf
+}
+
+func TestParseH264SPS(t *testing.T) {
+	var cfg videoConfig
+	if err := parseH264SPS(testSPS(), &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.width != 1280 || cfg.height != 720 {
+		t.Errorf("got %dx%d, want 1280x720", cfg.width, cfg.height)
+	}
+}
+
+// tsWriter 把 PES 打包为 TS 包
+type tsWriter struct {
+	buf      bytes.Buffer
+	counters map[uint16]byte
+}
+
+func (w *tsWriter) write(pid uint16, payload []byte) {
+	pusi := true
+	for len(payload) > 0 {
+		pkt := make([]byte, tsPacketSize)
+		pkt[0] = 0x47
+		pkt[1] = byte(pid >> 8)
+		if pusi {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+		pkt[3] = 0x10 | w.counters[pid]
+		w.counters[pid] = (w.counters[pid] + 1) & 0x0f
+
+		n := copy(pkt[4:], payload)
+		if n < tsPacketSize-4 {
+			// 用自适应字段填充剩余空间
+			stuffing := tsPacketSize - 4 - n
+			pkt[3] |= 0x20
+			copy(pkt[4+stuffing:], payload[:n])
+			pkt[4] = byte(stuffing - 1)
+			if stuffing > 1 {
+				pkt[5] = 0
+				for i := 6; i < 4+stuffing; i++ {
+					pkt[i] = 0xff
+				}
+			}
+		}
+		w.buf.Write(pkt)
+		payload = payload[n:]
+		pusi = false
+	}
+}
+
+func psi(tableID byte, body []byte) []byte {
+	section := []byte{tableID, 0xb0 | byte((len(body)+4)>>8), byte(len(body) + 4)}
+	section = append(section, body...)
+	section = append(section, 0, 0, 0, 0) // 解复用时不校验 CRC
+	return append([]byte{0}, section...)
+}
+
+func pes(streamID byte, pts, dts int64, data []byte) []byte {
+	ts := func(marker byte, v int64) []byte {
+		return []byte{
+			marker<<4 | byte(v>>29)&0x0e | 1,
+			byte(v >> 22),
+			byte(v>>14) | 1,
+			byte(v >> 7),
+			byte(v<<1) | 1,
+		}
+	}
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0xc0, 10}
+	header = append(header, ts(3, pts)...)
+	header = append(header, ts(1, dts)...)
+	return append(header, data...)
+}
+
+func adtsFrame(payload []byte) []byte {
+	size := 7 + len(payload)
+	header := []byte{
+		0xff, 0xf1,
+		1<<6 | 3<<2, // AAC LC，48000 Hz
+		2<<6 | byte(size>>11),
+		byte(size >> 3),
+		byte(size<<5) | 0x1f,
+		0xfc,
+	}
+	return append(header, payload...)
+}
+
+// buildTestTS 构造包含 H.264 和 AAC 的 TS：每 3 帧一个关键帧，帧间隔 3000（30fps）
+func buildTestTS(frames int) []byte {
+	w := &tsWriter{counters: make(map[uint16]byte)}
+	w.write(0, psi(0x00, []byte{0, 1, 0xc1, 0, 0, 0, 1, 0xe1, 0x00}))
+	w.write(0x100, psi(0x02, []byte{
+		0, 1, 0xc1, 0, 0, 0xe1, 0x01, 0xf0, 0x00,
+		streamTypeH264, 0xe1, 0x01, 0xf0, 0x00,
+		streamTypeAAC, 0xe1, 0x02, 0xf0, 0x00,
+	}))
+
+	start := []byte{0, 0, 0, 1}
+	for i := 0; i < frames; i++ {
+		var au []byte
+		au = append(au, start...)
+		au = append(au, 0x09, 0xf0) // AUD
+		if i%3 == 0 {
+			au = append(au, start...)
+			au = append(au, testSPS()...)
+			au = append(au, start...)
+			au = append(au, 0x68, 0xce, 0x38, 0x80) // PPS
+			au = append(au, start...)
+			au = append(au, 0x65, 0x88, byte(i)) // IDR
+		} else {
+			au = append(au, start...)
+			au = append(au, 0x41, 0x9a, byte(i))
+		}
+		dts := int64(90000 + i*3000)
+		w.write(0x101, pes(0xe0, dts+3000, dts, au))
+
+		audio := adtsFrame([]byte{0x21, byte(i)})
+		w.write(0x102, pes(0xc0, int64(90000+i*1920), int64(90000+i*1920), audio))
+	}
+	return w.buf.Bytes()
+}
+
+// findBoxes 返回 data 中所有指定类型的 box（不含头部）
+func findBoxes(data []byte, path ...string) [][]byte {
+	var result [][]byte
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		header := 8
+		if size == 1 {
+			size = int(binary.BigEndian.Uint64(data[8:]))
+			header = 16
+		}
+		if size < header || size > len(data) {
+			break
+		}
+		if string(data[4:8]) == path[0] {
+			if len(path) == 1 {
+				result = append(result, data[header:size])
+			} else {
+				result = append(result, findBoxes(data[header:size], path[1:]...)...)
+			}
+		}
+		data = data[size:]
+	}
+	return result
+}
+
+func TestTSToMP4(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ts")
+	if err := os.WriteFile(input, buildTestTS(9), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "output.mp4")
+	if err := TSToMP4(input, nil, output, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traks := findBoxes(data, "moov", "trak")
+	if len(traks) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(traks))
+	}
+
+	stbl := []string{"mdia", "minf", "stbl"}
+	stsz := findBoxes(traks[0], append(stbl, "stsz")...)[0]
+	if count := binary.BigEndian.Uint32(stsz[8:]); count != 9 {
+		t.Errorf("got %d video samples, want 9", count)
+	}
+	stss := findBoxes(traks[0], append(stbl, "stss")...)[0]
+	if count := binary.BigEndian.Uint32(stss[4:]); count != 3 {
+		t.Errorf("got %d sync samples, want 3", count)
+	}
+
+	// 第一个视频样本应当只剩 IDR，参数集和 AUD 已去掉
+	co64 := findBoxes(traks[0], append(stbl, "co64")...)[0]
+	offset := binary.BigEndian.Uint64(co64[8:])
+	want := []byte{0, 0, 0, 3, 0x65, 0x88, 0}
+	if got := data[offset : offset+uint64(len(want))]; !bytes.Equal(got, want) {
+		t.Errorf("first video sample = %x, want %x", got, want)
+	}
+
+	if avcC := findBoxes(traks[0], append(stbl, "stsd")...)[0]; !bytes.Contains(avcC, []byte("avcC")) {
+		t.Errorf("video sample entry has no avcC box")
+	}
+	if esds := findBoxes(traks[1], append(stbl, "stsd")...)[0]; !bytes.Contains(esds, []byte("esds")) {
+		t.Errorf("audio sample entry has no esds box")
+	}
+}
+
+func TestTSToFragmentedMP4(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ts")
+	if err := os.WriteFile(input, buildTestTS(9), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "output.mp4")
+	if err := TSToMP4(input, nil, output, Options{Fragmented: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(findBoxes(data, "moov", "mvex", "trex")) != 2 {
+		t.Errorf("moov should contain a trex for each track")
+	}
+	// 每个关键帧开始一个分片
+	if moofs := findBoxes(data, "moof"); len(moofs) != 3 {
+		t.Errorf("got %d fragments, want 3", len(moofs))
+	}
+	if mdats := findBoxes(data, "mdat"); len(mdats) != 3 {
+		t.Errorf("got %d mdat boxes, want 3", len(mdats))
+	}
+}
+
+func TestTSToMP4Unsupported(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.mp4")
+	if err := os.WriteFile(input, bytes.Repeat([]byte("not a transport stream"), 20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := TSToMP4(input, nil, filepath.Join(dir, "output.mp4"), Options{})
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("got error %v, want ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,276 @@
+package remux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const tsPacketSize = 188
+
+// PMT 中的流类型
+const (
+	streamTypeH264 = 0x1b
+	streamTypeH265 = 0x24
+	streamTypeAAC  = 0x0f
+)
+
+// 无法原生处理的音视频流类型，遇到时交给 ffmpeg
+var unsupportedStreamTypes = map[byte]string{
+	0x01: "MPEG-1 video",
+	0x02: "MPEG-2 video",
+	0x03: "MPEG-1 audio",
+	0x04: "MPEG-2 audio",
+	0x11: "AAC LATM",
+	0x81: "AC-3",
+	0x87: "E-AC-3",
+	0xcf: "SAMPLE-AES AAC",
+	0xdb: "SAMPLE-AES H.264",
+}
+
+const timestampWrap = int64(1) << 33
+
+// pesStream 收集一个 PID 的 PES 数据
+type pesStream struct {
+	track *track
+	buf   []byte
+	carry []byte // 跨 PES 的不完整 ADTS 帧
+}
+
+// tsDemuxer 从 MPEG-TS 文件中解出视频和音频样本
+type tsDemuxer struct {
+	samples   *sampleWriter
+	audioOnly bool // 额外音轨文件只取音频
+	language  string
+
+	pmtPID  int
+	streams map[uint16]*pesStream
+	lastTS  int64 // 最近一个时间戳，用于处理 33 位时间戳回绕
+
+	video  *track
+	audios []*track
+}
+
+func newTSDemuxer(samples *sampleWriter, audioOnly bool, language string) *tsDemuxer {
+	return &tsDemuxer{
+		samples:   samples,
+		audioOnly: audioOnly,
+		language:  language,
+		pmtPID:    -1,
+		streams:   make(map[uint16]*pesStream),
+		lastTS:    -1,
+	}
+}
+
+func (d *tsDemuxer) demuxFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 1<<20)
+	pkt := make([]byte, tsPacketSize)
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(reader, pkt); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return err
+		}
+		if pkt[0] != 0x47 {
+			if n == 0 {
+				return fmt.Errorf("%w: %s is not an MPEG-TS stream", ErrUnsupported, path)
+			}
+			return fmt.Errorf("%w: lost MPEG-TS sync at packet %d", ErrUnsupported, n)
+		}
+		if err := d.packet(pkt); err != nil {
+			return err
+		}
+	}
+
+	for pid := range d.streams {
+		if err := d.flush(pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *tsDemuxer) packet(pkt []byte) error {
+	pusi := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	payload := tsPayload(pkt)
+	if payload == nil {
+		return nil
+	}
+
+	switch {
+	case pid == 0 && pusi:
+		d.parsePAT(payload)
+		return nil
+	case int(pid) == d.pmtPID && pusi:
+		return d.parsePMT(payload)
+	}
+
+	stream := d.streams[pid]
+	if stream == nil {
+		return nil
+	}
+	if pusi {
+		if err := d.flush(pid); err != nil {
+			return err
+		}
+		stream.buf = append(stream.buf[:0], payload...)
+	} else if len(stream.buf) > 0 {
+		stream.buf = append(stream.buf, payload...)
+	}
+	return nil
+}
+
+// tsPayload 返回 TS 包的负载部分，没有负载时返回 nil
+func tsPayload(pkt []byte) []byte {
+	control := pkt[3] >> 4 & 0x3
+	if control&0x1 == 0 {
+		return nil
+	}
+	start := 4
+	if control&0x2 != 0 {
+		start += 1 + int(pkt[4])
+	}
+	if start >= tsPacketSize {
+		return nil
+	}
+	return pkt[start:]
+}
+
+// psiSection 跳过 pointer_field，返回去掉 CRC 的 PSI 表
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) {
+		return nil
+	}
+	section := payload[start:]
+	length := int(binary.BigEndian.Uint16(section[1:]) & 0x0fff)
+	if 3+length > len(section) || length < 4 {
+		return nil
+	}
+	return section[:3+length-4]
+}
+
+func (d *tsDemuxer) parsePAT(payload []byte) {
+	section := psiSection(payload)
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := binary.BigEndian.Uint16(section[i:])
+		if program != 0 {
+			d.pmtPID = int(binary.BigEndian.Uint16(section[i+2:]) & 0x1fff)
+			return
+		}
+	}
+}
+
+func (d *tsDemuxer) parsePMT(payload []byte) error {
+	section := psiSection(payload)
+	if len(section) < 12 {
+		return nil
+	}
+	infoLength := int(binary.BigEndian.Uint16(section[10:]) & 0x0fff)
+	for i := 12 + infoLength; i+5 <= len(section); {
+		streamType := section[i]
+		pid := binary.BigEndian.Uint16(section[i+1:]) & 0x1fff
+		esInfoLength := int(binary.BigEndian.Uint16(section[i+3:]) & 0x0fff)
+		i += 5 + esInfoLength
+
+		if _, ok := d.streams[pid]; ok {
+			continue
+		}
+		if name, ok := unsupportedStreamTypes[streamType]; ok {
+			if d.audioOnly && streamType <= 0x02 {
+				continue
+			}
+			return fmt.Errorf("%w: %s stream", ErrUnsupported, name)
+		}
+
+		switch streamType {
+		case streamTypeH264, streamTypeH265:
+			if d.audioOnly || d.video != nil {
+				continue
+			}
+			codec := codecH264
+			if streamType == streamTypeH265 {
+				codec = codecH265
+			}
+			d.video = newTrack(kindVideo, codec, 90000, "und")
+			d.streams[pid] = &pesStream{track: d.video}
+		case streamTypeAAC:
+			audio := newTrack(kindAudio, codecAAC, 0, d.language)
+			d.audios = append(d.audios, audio)
+			d.streams[pid] = &pesStream{track: audio}
+		}
+	}
+	return nil
+}
+
+// flush 处理一个 PID 已收集完整的 PES
+func (d *tsDemuxer) flush(pid uint16) error {
+	stream := d.streams[pid]
+	if stream == nil || len(stream.buf) < 9 {
+		return nil
+	}
+	data := stream.buf
+	stream.buf = stream.buf[:0]
+
+	if data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil
+	}
+	headerEnd := 9 + int(data[8])
+	if headerEnd > len(data) {
+		return nil
+	}
+
+	pts, dts := int64(-1), int64(-1)
+	flags := data[7] >> 6
+	if flags&0x2 != 0 && len(data) >= 14 {
+		pts = d.unwrap(parsePESTimestamp(data[9:]))
+		dts = pts
+	}
+	if flags == 0x3 && len(data) >= 19 {
+		dts = d.unwrap(parsePESTimestamp(data[14:]))
+	}
+
+	payload := data[headerEnd:]
+	switch stream.track.kind {
+	case kindVideo:
+		return stream.track.addVideo(d.samples, payload, pts, dts)
+	default:
+		return stream.track.addAudio(d.samples, stream, payload, pts)
+	}
+}
+
+func parsePESTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
+
+// unwrap 把 33 位时间戳展开为连续的 64 位时间戳
+func (d *tsDemuxer) unwrap(ts int64) int64 {
+	if d.lastTS >= 0 {
+		for ts-d.lastTS > timestampWrap/2 {
+			ts -= timestampWrap
+		}
+		for d.lastTS-ts > timestampWrap/2 {
+			ts += timestampWrap
+		}
+	}
+	d.lastTS = ts
+	return ts
+}
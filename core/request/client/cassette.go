@@ -0,0 +1,248 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"unicode/utf8"
+
+	"MediaNinja/core/request/retry"
+)
+
+// ErrNotRecorded 表示回放时 cassette 中没有与请求匹配的响应
+var ErrNotRecorded = errors.New("no recorded response")
+
+// Cassette 保存一次会话中的请求和响应，用于录制真实会话后离线回放，例如解析器的回归测试。
+// 请求按方法、URL 和 Range 匹配，同一个请求的多个响应按录制的顺序回放，用完后重复最后一个。
+// 媒体请求（GetStream）只录制状态码和响应头，响应体照常流式返回，不写入文件。
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+
+	mu     sync.Mutex
+	played map[string]int // 每个请求已经回放的次数
+}
+
+// Interaction 是一对录制的请求和响应
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest 只记录用于匹配的字段，不保存请求头，避免 cookie 等凭据写入文件
+type RecordedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Range  string `json:"range,omitempty"`
+}
+
+// RecordedResponse 是解压后的响应，Body 不是合法的 UTF-8 时以 base64 保存在 BodyBase64 中。
+// BodyOmitted 为 true 表示这是媒体响应，没有录制响应体，回放时响应体为空。
+type RecordedResponse struct {
+	StatusCode  int         `json:"status"`
+	Header      http.Header `json:"headers,omitempty"`
+	Body        string      `json:"body,omitempty"`
+	BodyBase64  string      `json:"body_base64,omitempty"`
+	BodyOmitted bool        `json:"body_omitted,omitempty"`
+}
+
+func (r *RecordedRequest) key() string {
+	return r.Method + " " + r.URL + " " + r.Range
+}
+
+func NewCassette() *Cassette {
+	return &Cassette{}
+}
+
+// LoadCassette 读取 Save 保存的 cassette 文件
+func LoadCassette(name string) (*Cassette, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+	c := &Cassette{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %w", name, err)
+	}
+	for i, in := range c.Interactions {
+		if _, err := in.Response.body(); err != nil {
+			return nil, fmt.Errorf("failed to parse cassette %s: interaction %d: %w", name, i, err)
+		}
+	}
+	return c, nil
+}
+
+// Save 把录制的请求和响应写入文件
+func (c *Cassette) Save(name string) error {
+	// 不转义 HTML，录制的页面在文件中保持可读
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	c.mu.Lock()
+	err := enc.Encode(c)
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette: %w", err)
+	}
+
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to save cassette: %w", err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save cassette: %w", err)
+	}
+	return nil
+}
+
+func (r *RecordedResponse) body() ([]byte, error) {
+	if r.BodyBase64 != "" {
+		return base64.StdEncoding.DecodeString(r.BodyBase64)
+	}
+	return []byte(r.Body), nil
+}
+
+// record 保存一对请求和响应，body 为 nil 时只保存状态码和响应头
+func (c *Cassette) record(req *http.Request, resp *http.Response, body []byte) {
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie") // 与请求头一样，不把会话凭据写入文件
+
+	in := &Interaction{
+		Request:  RecordedRequest{Method: req.Method, URL: req.URL.String(), Range: req.Header.Get("Range")},
+		Response: RecordedResponse{StatusCode: resp.StatusCode, Header: header},
+	}
+	if body == nil {
+		in.Response.BodyOmitted = true
+	} else if utf8.Valid(body) {
+		in.Response.Body = string(body)
+	} else {
+		in.Response.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Interactions = append(c.Interactions, in)
+}
+
+// replay 返回与请求匹配的下一个录制的响应
+func (c *Cassette) replay(req *http.Request) (*http.Response, error) {
+	key := (&RecordedRequest{Method: req.Method, URL: req.URL.String(), Range: req.Header.Get("Range")}).key()
+
+	c.mu.Lock()
+	var matches []*Interaction
+	for _, in := range c.Interactions {
+		if in.Request.key() == key {
+			matches = append(matches, in)
+		}
+	}
+	if len(matches) == 0 {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w for %s %s", ErrNotRecorded, req.Method, req.URL)
+	}
+	if c.played == nil {
+		c.played = make(map[string]int)
+	}
+	in := matches[min(c.played[key], len(matches)-1)]
+	c.played[key]++
+	c.mu.Unlock()
+
+	body, err := in.Response.body()
+	if err != nil {
+		return nil, err
+	}
+	header := in.Response.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Response.StatusCode, http.StatusText(in.Response.StatusCode)),
+		StatusCode:    in.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// cassetteTransport 在 next 不为 nil 时录制经过 next 的请求，否则只从 cassette 回放
+type cassetteTransport struct {
+	cassette *Cassette
+	next     http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.next == nil {
+		resp, err := t.cassette.replay(req)
+		if err != nil {
+			// 回放是确定的，重试也不会有结果
+			return nil, retry.Stop(err)
+		}
+		return resp, nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// 媒体响应可能有几个 GB，不读入内存，保持流式下载、空闲超时和进度显示
+	if isMedia(req.Context()) {
+		t.cassette.record(req, resp, nil)
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	t.cassette.record(req, resp, body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (t *cassetteTransport) CloseIdleConnections() {
+	if ci, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+type mediaKey struct{}
+
+// withMedia 标记 GetStream 发出的媒体请求
+func withMedia(ctx context.Context) context.Context {
+	return context.WithValue(ctx, mediaKey{}, true)
+}
+
+func isMedia(ctx context.Context) bool {
+	media, _ := ctx.Value(mediaKey{}).(bool)
+	return media
+}
+
+// Record 把之后经过客户端的请求和响应录制到 cassette 中，结束后用 Cassette.Save 保存。
+// 页面请求（Get）录制完整的响应体，媒体请求（GetStream）只录制状态码和响应头。
+func (c *Client) Record(cassette *Cassette) {
+	c.Client.Transport = &cassetteTransport{cassette: cassette, next: c.transport()}
+}
+
+// Replay 让客户端只从 cassette 回放响应，不再发出任何网络请求
+func (c *Client) Replay(cassette *Cassette) {
+	c.Client.Transport = &cassetteTransport{cassette: cassette}
+}
+
+// transport 返回客户端底层的 uTransport，录制时它被 cassetteTransport 包装
+func (c *Client) transport() http.RoundTripper {
+	if t, ok := c.Client.Transport.(*cassetteTransport); ok {
+		return t.next
+	}
+	return c.Client.Transport
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCassetteRecordReplay(t *testing.T) {
+	var visits int32
+	binary := []byte{0x47, 0x40, 0x00, 0xff, 0xfe}
+	// 录制时媒体响应体必须流式返回，这里 3 个字节后服务器一直等到客户端读到它们
+	firstBytesRead := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "secret"})
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<html>visit "+string(rune('0'+atomic.AddInt32(&visits, 1)))+"</html>")
+		case "/segment.ts":
+			w.Header().Set("Content-Range", "bytes 0-4/5")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(binary[:3])
+			w.(http.Flusher).Flush()
+			<-firstBytesRead
+			w.Write(binary[3:])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	ctx := context.Background()
+	cassette := NewCassette()
+	recorder := NewClient("", 1, 0)
+	recorder.Record(cassette)
+	for _, want := range []string{"<html>visit 1</html>", "<html>visit 2</html>"} {
+		if body, err := recorder.Get(ctx, srv.URL+"/page", nil); err != nil || body != want {
+			t.Fatalf("got %q, %v, want %q", body, err, want)
+		}
+	}
+	resp, err := recorder.GetStream(ctx, "GET", srv.URL+"/segment.ts", nil, map[string]string{"Range": "bytes=0-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(resp.Body, head); err != nil {
+		t.Fatal(err)
+	}
+	close(firstBytesRead)
+	if rest, err := io.ReadAll(resp.Body); err != nil || !bytes.Equal(append(head, rest...), binary) {
+		t.Errorf("got body %x, %v, want %x", append(head, rest...), err, binary)
+	}
+	resp.Body.Close()
+	recorder.Get(ctx, srv.URL+"/missing", nil)
+	srv.Close()
+
+	file := filepath.Join(t.TempDir(), "cassette.json")
+	if err := cassette.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCassette(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Interactions) != 4 {
+		t.Fatalf("recorded %d interactions, want 4", len(loaded.Interactions))
+	}
+	for _, in := range loaded.Interactions {
+		if in.Response.Header.Get("Set-Cookie") != "" {
+			t.Error("Set-Cookie was saved in the cassette")
+		}
+	}
+	if media := loaded.Interactions[2].Response; !media.BodyOmitted || media.Body != "" || media.BodyBase64 != "" {
+		t.Errorf("media body was recorded: %+v", media)
+	}
+
+	// 服务器已关闭，所有响应来自 cassette，同一个请求按录制顺序回放，用完后重复最后一个
+	player := NewClient("", 3, 0)
+	player.Replay(loaded)
+	for _, want := range []string{"<html>visit 1</html>", "<html>visit 2</html>", "<html>visit 2</html>"} {
+		if body, err := player.Get(ctx, srv.URL+"/page", nil); err != nil || body != want {
+			t.Errorf("got %q, %v, want %q", body, err, want)
+		}
+	}
+	// 媒体响应只录制了状态码和响应头
+	resp, err = player.GetStream(ctx, "GET", srv.URL+"/segment.ts", nil, map[string]string{"Range": "bytes=0-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || len(data) != 0 || resp.Header.Get("Content-Range") != "bytes 0-4/5" {
+		t.Errorf("got status %d, body %x, headers %v", resp.StatusCode, data, resp.Header)
+	}
+
+	var statusErr *HTTPStatusError
+	if _, err := player.Get(ctx, srv.URL+"/missing", nil); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v, want the recorded 404", err)
+	}
+	_, err = player.Get(ctx, srv.URL+"/other", nil)
+	if !errors.Is(err, ErrNotRecorded) || strings.Contains(err.Error(), "giving up") {
+		t.Errorf("got %v, want ErrNotRecorded without retries", err)
+	}
+}
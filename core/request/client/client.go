@@ -1,13 +1,17 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log"
+	"MediaNinja/core/request/retry"
 	"MediaNinja/core/request/types"
 	"net/http"
-	"net/url"
+	"strings"
 	"time"
 
+	tls "github.com/refraction-networking/utls"
 	"golang.org/x/net/http2"
 )
 
@@ -21,55 +25,193 @@ type Client struct {
 	DefaultHeaders map[string]string
 	MaxRetries     int
 	RetryDelay     time.Duration
+	DownloadOption DownloadOption
+
+	RequestTimeout time.Duration // 从发出请求到收到响应头的时间上限，0 表示不限制
+	IdleTimeout    time.Duration // 读取响应体时连续没有收到数据的时间上限，0 表示不限制
+
+	Cookies *CookieJar // 所有请求共用的 cookie jar，可以从 cookies.txt 导入和导出
+
+	limiter *rateLimiter // 按主机限制请求频率，见 SetRateLimit
+
+	TLSProfile      *TLSProfile            // HTTPS 握手使用的 TLS 指纹
+	HostTLSProfiles map[string]*TLSProfile // 按站点覆盖 TLSProfile，key 为域名，同时匹配子域名
+
+	SiteHeaders map[string]map[string]string // 按站点叠加在 DefaultHeaders 上的请求头，key 为域名，同时匹配子域名
 }
 
+const (
+	// defaultMaxParallel 默认的分片并发下载数
+	defaultMaxParallel = 8
+
+	defaultRequestTimeout = 30 * time.Second
+	defaultIdleTimeout    = 60 * time.Second
+)
+
+// NewClient 创建客户端，proxyURL 可以是逗号分隔的多个代理，按 round-robin 轮换，见 SetProxyPool
 func NewClient(proxyURL string, maxRetries int, retryDelay int) *Client {
 	transport := &uTransport{
-		tr1: &http.Transport{},
-		tr2: &http2.Transport{},
+		tr1: &http.Transport{
+			MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+			MaxConnsPerHost:     defaultMaxConnsPerHost,
+			IdleConnTimeout:     defaultIdleConnTimeout,
+			DisableCompression:  true, // 压缩由 uTransport.RoundTrip 统一处理
+		},
+		tr2: &http2.Transport{
+			DisableCompression: true,
+			IdleConnTimeout:    defaultIdleConnTimeout,
+			ReadIdleTimeout: 30 * time.Second, // 一段时间没有收到帧时发送 PING 检查连接是否还活着
+			PingTimeout:     15 * time.Second,
+		},
+		pool: newConnPool(),
+		// 预设和自定义指纹的 ALPN 由 ClientHello 决定，这里只影响 go 指纹
+		tlsConfig: &tls.Config{NextProtos: []string{"h2", "http/1.1"}},
 	}
 
+	transport.tr1.Proxy = proxyFromContext
 	if proxyURL != "" {
-		proxyUrl, _ := url.Parse(proxyURL)
-		transport.tr1.Proxy = http.ProxyURL(proxyUrl)
+		proxies, err := NewProxyPool(ProxyOptions{Proxies: strings.Split(proxyURL, ",")})
+		if err != nil {
+			// 代理地址应在启动时用 ParseProxyURL 校验，这里让所有请求失败，而不是绕过代理直接连接
+			proxies = &ProxyPool{err: err}
+		}
+		transport.proxies = proxies
 	}
 
+	cookies := NewCookieJar()
 	return &Client{
-		Client: &http.Client{Transport: transport},
-		Proxy:  proxyURL,
+		Client:  &http.Client{Transport: transport, Jar: cookies},
+		Proxy:   proxyURL,
+		Cookies: cookies,
 		DefaultHeaders: map[string]string{
 			"accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
 			"accept-language": "en,zh-CN;q=0.9,zh;q=0.8",
 			"user-agent":      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/112.0.0.0 Safari/537.36",
 		},
-		MaxRetries: maxRetries,
-		RetryDelay: time.Duration(retryDelay) * time.Second,
+		MaxRetries:     maxRetries,
+		RetryDelay:     time.Duration(retryDelay) * time.Second,
+		RequestTimeout: defaultRequestTimeout,
+		IdleTimeout:    defaultIdleTimeout,
+		TLSProfile:     ChromeProfile,
+		limiter:        newRateLimiter(RateLimit{}),
+		DownloadOption: DownloadOption{
+			MaxRetries:  maxRetries,
+			RetryDelay:  retryDelay,
+			MaxParallel: defaultMaxParallel,
+		},
+	}
+
+}
+
+// SetRateLimit 设置每个主机的请求频率限制，页面请求和下载请求共用。
+// 不设置时也会在收到 429/503 后按 Retry-After 暂停对该主机的请求。
+func (c *Client) SetRateLimit(limit RateLimit) {
+	c.limiter = newRateLimiter(limit)
+}
+
+// SetProxyPool 替换客户端使用的代理池，nil 表示直接连接
+func (c *Client) SetProxyPool(p *ProxyPool) {
+	if transport, ok := c.transport().(*uTransport); ok {
+		transport.proxies = p
+	}
+}
+
+// AddSiteHeaders 为 domain 及其子域名添加请求头，已经设置的请求头不会被覆盖，
+// 因此解析器注册的默认值不会覆盖用户配置的 SiteHeaders
+func (c *Client) AddSiteHeaders(domain string, headers map[string]string) {
+	domain = siteDomain(domain)
+	if c.SiteHeaders == nil {
+		c.SiteHeaders = make(map[string]map[string]string)
 	}
+	site := c.SiteHeaders[domain]
+	if site == nil {
+		site = make(map[string]string)
+		c.SiteHeaders[domain] = site
+	}
+	for k, v := range headers {
+		k = http.CanonicalHeaderKey(k)
+		if _, ok := site[k]; !ok {
+			site[k] = v
+		}
+	}
+}
 
+// ParseSiteHeaders 解析 "域名=名称: 值" 格式的规则，域名同时匹配子域名，可以写成 "*.example.com"
+func ParseSiteHeaders(rules []string) (map[string]map[string]string, error) {
+	headers := make(map[string]map[string]string)
+	for _, rule := range rules {
+		domain, header, found := strings.Cut(rule, "=")
+		domain = siteDomain(domain)
+		name, value, ok := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !found || !ok || domain == "" || name == "" {
+			return nil, fmt.Errorf("invalid site header %q, expected domain=Name: value", rule)
+		}
+		if headers[domain] == nil {
+			headers[domain] = make(map[string]string)
+		}
+		headers[domain][http.CanonicalHeaderKey(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
 }
 
+// setHeaders 按层设置请求头：DefaultHeaders、SiteHeaders（父域名在前）、opts，后面的覆盖前面的，
+// 最后删除 opts.RemoveHeaders 中的请求头
 func (c *Client) setHeaders(req *http.Request, opts *RequestOption) {
-	// 如果有临时请求头，只使用临时请求头
-	if opts != nil && opts.Headers != nil {
-		for k, v := range opts.Headers {
+	for k, v := range c.DefaultHeaders {
+		req.Header.Set(k, v)
+	}
+
+	var domains []string
+	for host := req.URL.Hostname(); host != ""; _, host, _ = strings.Cut(host, ".") {
+		domains = append(domains, host)
+	}
+	for i := len(domains) - 1; i >= 0; i-- {
+		for k, v := range c.SiteHeaders[domains[i]] {
 			req.Header.Set(k, v)
 		}
-		return
 	}
 
-	// 如果没有临时请求头，使用默认请求头
-	for k, v := range c.DefaultHeaders {
+	if opts == nil {
+		return
+	}
+	for k, v := range opts.Headers {
 		req.Header.Set(k, v)
 	}
+	if opts.Referer != "" {
+		req.Header.Set("Referer", opts.Referer)
+	}
+	if opts.Origin != "" {
+		req.Header.Set("Origin", opts.Origin)
+	}
+	for _, cookie := range opts.Cookies {
+		req.AddCookie(cookie)
+	}
+	for _, k := range opts.RemoveHeaders {
+		req.Header.Del(k)
+	}
+}
 
+// GetStream 执行请求并返回响应流，需要调用者负责关闭响应体。
+// ctx 取消时请求和响应体的读取都会中断，超时设置见 RequestTimeout 和 IdleTimeout，频率限制见 SetRateLimit。
+// GetStream 用于下载媒体，没有指定 Accept-Encoding 时要求服务器不压缩，响应体是原始字节。
+func (c *Client) GetStream(ctx context.Context, method, url string, opts *RequestOption, headers map[string]string) (*http.Response, error) {
+	return c.send(ctx, method, url, opts, headers, true)
 }
 
-// GetStream 执行请求并返回响应流，需要调用者负责关闭响应体
-func (c *Client) GetStream(method, url string, opts *RequestOption, headers map[string]string) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, nil)
+// send 发送请求，media 为 false 时由 transport 协商压缩并解压响应
+func (c *Client) send(ctx context.Context, method, url string, opts *RequestOption, headers map[string]string, media bool) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
+		cancel(nil)
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
+	reqCtx := withTLSProfile(ctx, c.tlsProfileFor(req.URL.Hostname()))
+	if media {
+		reqCtx = withMedia(reqCtx)
+	}
+	req = req.WithContext(reqCtx)
 
 	c.setHeaders(req, opts)
 
@@ -77,29 +219,61 @@ func (c *Client) GetStream(method, url string, opts *RequestOption, headers map[
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
+	if media && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", mediaAcceptEncoding)
+	}
 
-	resp, err := c.Client.Do(req)
+	host := req.URL.Hostname()
+	if err := c.limiter.wait(ctx, host); err != nil {
+		cancel(nil)
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	resp, err := c.do(ctx, cancel, req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
+	c.limiter.observe(host, resp)
 
 	return resp, nil
 }
 
-// Get 方法重构
-func (c *Client) Get(url string, opts *RequestOption) (string, error) {
-	resp, err := c.GetStream("GET", url, opts, nil)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
+// Get 获取页面内容，gzip、deflate、br 和 zstd 压缩的响应自动解压。网络错误、5xx 和 429 按 RetryPolicy 重试，重试用完后返回错误。
+// 非 2xx 响应返回 *HTTPStatusError，反爬虫验证页返回 *ChallengeError，opts.AllowErrorStatus 为 true 时不检查。
+func (c *Client) Get(ctx context.Context, url string, opts *RequestOption) (string, error) {
+	var body string
+	err := c.RetryPolicy().Do(ctx, func() error {
+		resp, err := c.send(ctx, "GET", url, opts, nil, false)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if opts == nil || !opts.AllowErrorStatus {
+			if provider := detectChallenge(resp, data); provider != "" {
+				return retry.Stop(&ChallengeError{Provider: provider, StatusCode: resp.StatusCode, URL: url})
+			}
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return newHTTPStatusError(url, resp, data)
+			}
+		}
+		body = string(data)
+		return nil
+	}, func(attempt int, err error, delay time.Duration) {
+		log.Printf("Request to %s failed (%s): %v, retrying in %s", url, retry.Classify(err), err, delay.Round(time.Millisecond))
+	})
 	if err != nil {
 		return "", err
 	}
+	return body, nil
+}
 
-	return string(body), nil
+// RetryPolicy 返回按 MaxRetries 和 RetryDelay 配置的重试策略
+func (c *Client) RetryPolicy() retry.Policy {
+	return retry.NewPolicy(c.MaxRetries, c.RetryDelay)
 }
 
 func (c *Client) GetProxy() string {
@@ -113,3 +287,7 @@ func (c *Client) GetMaxRetries() int {
 func (c *Client) GetRetryDelay() time.Duration {
 	return c.RetryDelay
 }
+
+func (c *Client) GetDownloadOption() DownloadOption {
+	return c.DownloadOption
+}
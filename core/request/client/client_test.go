@@ -1,46 +1,181 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// forwardProxyHandler 是不需要认证的 HTTP 代理：CONNECT 建立隧道，其他请求直接转发
+func forwardProxyHandler(requests *int32) http.Handler {
+	tunnel := authConnectHandler("", "")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.Method == http.MethodConnect {
+			tunnel.ServeHTTP(w, r)
+			return
+		}
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	})
+}
+
 func TestClientProxy(t *testing.T) {
-	proxyURL := "http://127.0.0.1:7890"
-	client := NewClient(proxyURL, 3, 5)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	var requests int32
+	proxy := httptest.NewServer(forwardProxyHandler(&requests))
+	defer proxy.Close()
+
+	client := NewClient(proxy.URL, 3, 0)
+	trustServer(client, secure)
 
 	tests := []struct {
-		name    string
-		url     string
-		wantErr bool
+		name string
+		url  string
 	}{
-		{
-			name:    "HTTP URL",
-			url:     "http://example.com",
-			wantErr: false,
-		},
-		{
-			name:    "HTTPS URL",
-			url:     "https://example.com",
-			wantErr: false,
-		},
-		{
-			name:    "GOOGLE URL",
-			url:     "https://www.google.com",
-			wantErr: false,
-		},
-		{
-			name:    "Baidu URL",
-			url:     "https://baidu.com",
-			wantErr: false,
-		},
+		{"HTTP URL", plain.URL + "/http"},
+		{"HTTPS URL", secure.URL + "/https"},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := client.Get(tt.url, nil)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("GetHTML() error = %v, wantErr %v", err, tt.wantErr)
+			before := atomic.LoadInt32(&requests)
+			body, err := client.Get(context.Background(), tt.url, nil)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if !strings.HasPrefix(body, "hello from /") {
+				t.Errorf("got %q", body)
+			}
+			if atomic.LoadInt32(&requests) == before {
+				t.Error("request did not go through the proxy")
 			}
 		})
 	}
 }
+
+func TestGetStreamTimeouts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			<-r.Context().Done()
+			return
+		}
+		// 发送一部分数据后停止，模拟卡住的 CDN 连接
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	client := NewClient("", 1, 0)
+	client.RequestTimeout = 100 * time.Millisecond
+	client.IdleTimeout = 100 * time.Millisecond
+
+	if _, err := client.GetStream(context.Background(), "GET", srv.URL+"/slow-headers", nil, nil); !errors.Is(err, ErrRequestTimeout) {
+		t.Errorf("slow headers: got error %v, want %v", err, ErrRequestTimeout)
+	}
+
+	resp, err := client.GetStream(context.Background(), "GET", srv.URL+"/stalled", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, ErrIdleTimeout) {
+		t.Errorf("stalled body: got error %v, want %v", err, ErrIdleTimeout)
+	}
+	if string(data) != "partial" {
+		t.Errorf("got body %q, want %q", data, "partial")
+	}
+}
+
+func TestSetHeadersLayers(t *testing.T) {
+	c := NewClient("", 1, 0)
+	c.SiteHeaders = map[string]map[string]string{
+		"example.com":     {"Referer": "https://example.com/", "X-Site": "parent"},
+		"cdn.example.com": {"X-Site": "cdn"},
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		opts *RequestOption
+		want map[string]string // 空字符串表示不应发送
+	}{
+		{"defaults", "https://other.com/", nil, map[string]string{
+			"User-Agent": c.DefaultHeaders["user-agent"], "Referer": "", "X-Site": "",
+		}},
+		{"site profile", "https://video.cdn.example.com/a.m3u8", nil, map[string]string{
+			"User-Agent": c.DefaultHeaders["user-agent"], "Referer": "https://example.com/", "X-Site": "cdn",
+		}},
+		{"request overrides", "https://example.com/", &RequestOption{
+			Headers: map[string]string{"accept": "*/*"},
+			Referer: "https://example.com/watch",
+			Origin:  "https://example.com",
+			Cookies: []*http.Cookie{{Name: "token", Value: "1"}},
+		}, map[string]string{
+			"User-Agent": c.DefaultHeaders["user-agent"], "Accept": "*/*", "Referer": "https://example.com/watch",
+			"Origin": "https://example.com", "Cookie": "token=1", "X-Site": "parent",
+		}},
+		{"removal", "https://example.com/", &RequestOption{
+			Headers:       map[string]string{"X-Extra": "1"},
+			RemoveHeaders: []string{"referer", "User-Agent", "X-Extra"},
+		}, map[string]string{
+			"User-Agent": "", "Referer": "", "X-Extra": "", "X-Site": "parent",
+		}},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		c.setHeaders(req, tt.opts)
+		for k, want := range tt.want {
+			if got := req.Header.Get(k); got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, got, want)
+			}
+		}
+	}
+}
+
+func TestSiteHeaders(t *testing.T) {
+	headers, err := ParseSiteHeaders([]string{"*.Example.com=referer: https://example.com/watch", "example.com=X-Token:abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient("", 1, 0)
+	c.SiteHeaders = headers
+	// 解析器注册的默认值不覆盖用户配置的请求头
+	c.AddSiteHeaders("example.com", map[string]string{"Referer": "https://example.com/", "origin": "https://example.com"})
+
+	req, _ := http.NewRequest("GET", "https://cdn.example.com/a.mp4", nil)
+	c.setHeaders(req, nil)
+	want := map[string]string{"Referer": "https://example.com/watch", "Origin": "https://example.com", "X-Token": "abc"}
+	for k, v := range want {
+		if got := req.Header.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+
+	for _, rule := range []string{"Referer: x", "example.com=Referer", "=Referer: x", "example.com=: x"} {
+		if _, err := ParseSiteHeaders([]string{rule}); err == nil {
+			t.Errorf("expected an error for %q", rule)
+		}
+	}
+}
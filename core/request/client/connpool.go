@@ -0,0 +1,296 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultMaxIdleConnsPerHost = 16
+	defaultMaxConnsPerHost     = 32
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// connPool 缓存 HTTPS 请求的 uTLS 连接，key 由 TLS 指纹、代理地址和目标地址组成。
+// HTTP/2 连接在多个请求之间复用多路流，HTTP/1.1 连接在响应体读完后放回空闲列表。
+type connPool struct {
+	maxIdlePerHost  int           // 每个 key 最多保留的空闲 HTTP/1.1 连接数
+	maxConnsPerHost int           // 每个 key 的连接总数上限，0 表示不限制
+	idleTimeout     time.Duration // 空闲连接超过这个时间后关闭
+
+	mu    sync.Mutex
+	hosts map[string]*hostConns
+}
+
+// hostConns 是同一个 key 下的全部连接
+type hostConns struct {
+	h2      []*persistConn
+	idle    []*persistConn // 空闲的 HTTP/1.1 连接，最近放回的在末尾
+	conns   int            // 存活的连接数，包括正在建立的
+	dialing int
+	h1      bool          // 服务器已知只支持 HTTP/1.1，不需要等待其他协程的握手结果
+	changed chan struct{} // 有连接放回、关闭或建立完成时关闭，唤醒等待的协程
+}
+
+func newConnPool() *connPool {
+	return &connPool{
+		maxIdlePerHost:  defaultMaxIdleConnsPerHost,
+		maxConnsPerHost: defaultMaxConnsPerHost,
+		idleTimeout:     defaultIdleConnTimeout,
+		hosts:           make(map[string]*hostConns),
+	}
+}
+
+// persistConn 是池中的一个连接，h2 不为 nil 时是 HTTP/2 连接
+type persistConn struct {
+	pool      *connPool
+	key       string
+	conn      net.Conn
+	br        *bufio.Reader
+	h2        *http2.ClientConn
+	idleTimer *time.Timer
+}
+
+func (p *connPool) host(key string) *hostConns {
+	h, ok := p.hosts[key]
+	if !ok {
+		h = &hostConns{changed: make(chan struct{})}
+		p.hosts[key] = h
+	}
+	return h
+}
+
+func (h *hostConns) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// get 返回 key 对应的可用连接，没有时调用 dial 建立新连接。reused 表示连接之前处理过请求。
+// 连接数达到上限，或者另一个协程正在建立可能是 HTTP/2 的连接时，等待其结果而不是重复握手。
+func (p *connPool) get(ctx context.Context, key string, dial func(context.Context) (*persistConn, error)) (pc *persistConn, reused bool, err error) {
+	for {
+		p.mu.Lock()
+		h := p.host(key)
+		if pc := p.takeLocked(h); pc != nil {
+			p.mu.Unlock()
+			return pc, true, nil
+		}
+		limited := p.maxConnsPerHost > 0 && h.conns >= p.maxConnsPerHost
+		if !limited && (h.dialing == 0 || h.h1) {
+			h.conns++
+			h.dialing++
+			p.mu.Unlock()
+			break
+		}
+		changed := h.changed
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-changed:
+		}
+	}
+
+	pc, err = dial(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.host(key)
+	h.dialing--
+	switch {
+	case err != nil:
+		h.conns--
+	case pc.h2 != nil:
+		// 新的 HTTP/2 连接同时供其他协程使用，这里先为当前请求预留一个流
+		pc.h2.ReserveNewRequest()
+		h.h2 = append(h.h2, pc)
+	default:
+		h.h1 = true
+	}
+	h.notify()
+	if err != nil {
+		return nil, false, err
+	}
+	pc.pool, pc.key = p, key
+	return pc, false, nil
+}
+
+// takeLocked 取出一个可用的连接：优先复用 HTTP/2 连接，其次是最近放回的 HTTP/1.1 空闲连接
+func (p *connPool) takeLocked(h *hostConns) *persistConn {
+	alive := h.h2[:0]
+	var found *persistConn
+	for _, pc := range h.h2 {
+		if st := pc.h2.State(); st.Closed || st.Closing {
+			h.conns--
+			pc.conn.Close()
+			continue
+		}
+		alive = append(alive, pc)
+		if found == nil && pc.h2.ReserveNewRequest() {
+			found = pc
+		}
+	}
+	h.h2 = alive
+	if found != nil {
+		return found
+	}
+
+	for len(h.idle) > 0 {
+		pc := h.idle[len(h.idle)-1]
+		h.idle = h.idle[:len(h.idle)-1]
+		// Stop 返回 false 说明空闲超时已经触发，连接正在被关闭
+		if pc.idleTimer.Stop() {
+			return pc
+		}
+	}
+	return nil
+}
+
+// put 把读完响应的 HTTP/1.1 连接放回空闲列表，超出上限时直接关闭
+func (p *connPool) put(pc *persistConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.host(pc.key)
+	if len(h.idle) >= p.maxIdlePerHost {
+		h.conns--
+		h.notify()
+		pc.conn.Close()
+		return
+	}
+	pc.idleTimer = time.AfterFunc(p.idleTimeout, func() { p.evict(pc) })
+	h.idle = append(h.idle, pc)
+	h.notify()
+}
+
+// evict 关闭空闲超时的连接
+func (p *connPool) evict(pc *persistConn) {
+	p.mu.Lock()
+	h := p.host(pc.key)
+	for i, idle := range h.idle {
+		if idle == pc {
+			h.idle = append(h.idle[:i], h.idle[i+1:]...)
+			break
+		}
+	}
+	h.conns--
+	h.notify()
+	p.mu.Unlock()
+	pc.conn.Close()
+}
+
+// release 关闭一个不能复用的 HTTP/1.1 连接
+func (p *connPool) release(pc *persistConn) {
+	p.mu.Lock()
+	h := p.host(pc.key)
+	h.conns--
+	h.notify()
+	p.mu.Unlock()
+	pc.conn.Close()
+}
+
+// closeIdle 关闭全部空闲连接，HTTP/2 连接在当前的流结束后关闭
+func (p *connPool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, h := range p.hosts {
+		for _, pc := range h.idle {
+			if pc.idleTimer.Stop() {
+				h.conns--
+				pc.conn.Close()
+			}
+		}
+		h.idle = nil
+		for _, pc := range h.h2 {
+			// Shutdown 会等待正在进行的流结束，不能在持有锁时等待
+			go pc.h2.Shutdown(context.Background())
+		}
+		h.notify()
+	}
+}
+
+// roundTrip 在连接上发送请求
+func (pc *persistConn) roundTrip(req *http.Request) (*http.Response, error) {
+	if pc.h2 != nil {
+		return pc.h2.RoundTrip(req)
+	}
+
+	// 请求被取消时关闭连接，中断写入和响应的读取
+	stop := context.AfterFunc(req.Context(), func() { pc.conn.Close() })
+	if err := req.Write(pc.conn); err != nil {
+		stop()
+		pc.pool.release(pc)
+		return nil, err
+	}
+	resp, err := http.ReadResponse(pc.br, req)
+	if err != nil {
+		stop()
+		pc.pool.release(pc)
+		return nil, err
+	}
+
+	keepAlive := !resp.Close && !req.Close
+	if resp.Body == http.NoBody {
+		pc.done(stop, keepAlive)
+		return resp, nil
+	}
+	resp.Body = &pooledBody{ReadCloser: resp.Body, pc: pc, stop: stop, keepAlive: keepAlive}
+	return resp, nil
+}
+
+// done 在响应结束后放回或关闭连接。stop 返回 false 时请求已被取消，连接已经关闭。
+func (pc *persistConn) done(stop func() bool, keepAlive bool) {
+	if stop() && keepAlive {
+		pc.pool.put(pc)
+		return
+	}
+	pc.pool.release(pc)
+}
+
+// pooledBody 在响应体读到 EOF 后关闭时把连接放回连接池，未读完就关闭时丢弃连接
+type pooledBody struct {
+	io.ReadCloser
+	pc        *persistConn
+	stop      func() bool
+	keepAlive bool
+
+	mu     sync.Mutex
+	eof    bool
+	closed bool
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.mu.Lock()
+		b.eof = true
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+func (b *pooledBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	if !b.eof {
+		// 先关闭连接，否则关闭响应体会把剩余的数据全部读完
+		b.pc.done(b.stop, false)
+		b.ReadCloser.Close()
+		return nil
+	}
+	err := b.ReadCloser.Close()
+	b.pc.done(b.stop, b.keepAlive)
+	return err
+}
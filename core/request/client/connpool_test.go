@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// connectProxy 是只支持 CONNECT 的 HTTP 代理，记录建立的隧道数
+func connectProxy(tunnels *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		atomic.AddInt32(tunnels, 1)
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+}
+
+func TestProxiedConnectionReuse(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	var tunnels int32
+	proxy := connectProxy(&tunnels)
+	defer proxy.Close()
+
+	client := NewClient(proxy.URL, 1, 0)
+	transport := client.Client.Transport.(*uTransport)
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	transport.tlsConfig.RootCAs = roots
+
+	for i := 0; i < 5; i++ {
+		body, err := client.Get(context.Background(), srv.URL, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if body != "hello" {
+			t.Fatalf("request %d: got %q", i, body)
+		}
+	}
+	if n := atomic.LoadInt32(&tunnels); n != 1 {
+		t.Errorf("got %d CONNECT tunnels, want 1", n)
+	}
+
+	// 空闲连接被关闭后重新建立隧道
+	client.Client.CloseIdleConnections()
+	if _, err := client.Get(context.Background(), srv.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&tunnels); n != 2 {
+		t.Errorf("got %d CONNECT tunnels after closing idle connections, want 2", n)
+	}
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// CookieJar 是所有请求共用的 cookie jar。cookie 的匹配交给 cookiejar.Jar，
+// 这里另外记录每个 cookie 的属性，以便导出为 Netscape cookies.txt。
+type CookieJar struct {
+	jar *cookiejar.Jar
+
+	mu      sync.Mutex
+	entries map[string]*cookieEntry // key 为 domain;path;name
+}
+
+// cookieEntry 对应 cookies.txt 中的一行
+type cookieEntry struct {
+	domain   string // 不带前导点
+	hostOnly bool   // 只发送给 domain 本身，不包括子域名
+	path     string
+	secure   bool
+	httpOnly bool
+	expires  time.Time // 零值表示会话 cookie
+	name     string
+	value    string
+}
+
+func (e *cookieEntry) key() string {
+	return e.domain + ";" + e.path + ";" + e.name
+}
+
+func NewCookieJar() *CookieJar {
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return &CookieJar{jar: jar, entries: make(map[string]*cookieEntry)}
+}
+
+// Cookies 实现 http.CookieJar
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// SetCookies 实现 http.CookieJar，同时记录 cookie 的属性
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		e := &cookieEntry{
+			domain:   strings.TrimPrefix(strings.ToLower(c.Domain), "."),
+			path:     c.Path,
+			secure:   c.Secure,
+			httpOnly: c.HttpOnly,
+			name:     c.Name,
+			value:    c.Value,
+		}
+		if e.domain == "" {
+			e.domain, e.hostOnly = strings.ToLower(u.Hostname()), true
+		}
+		if !strings.HasPrefix(e.path, "/") {
+			e.path = defaultCookiePath(u.Path)
+		}
+		switch {
+		case c.MaxAge < 0:
+			e.expires = now
+		case c.MaxAge > 0:
+			e.expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			e.expires = c.Expires
+		}
+
+		if !e.expires.IsZero() && !e.expires.After(now) {
+			delete(j.entries, e.key())
+		} else {
+			j.entries[e.key()] = e
+		}
+	}
+}
+
+// defaultCookiePath 是 RFC 6265 5.1.4 中的默认路径
+func defaultCookiePath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.Count(p, "/") == 1 {
+		return "/"
+	}
+	return p[:strings.LastIndex(p, "/")]
+}
+
+// Load 从 Netscape 格式的 cookies.txt 导入 cookie，跳过已过期的，返回导入的数量
+func (j *CookieJar) Load(name string) (int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open cookie file: %w", err)
+	}
+	defer file.Close()
+
+	now := time.Now()
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			line, httpOnly = rest, true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return count, fmt.Errorf("%s:%d: expected 7 tab separated fields, got %d", name, lineNo, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return count, fmt.Errorf("%s:%d: invalid expiry %q", name, lineNo, fields[4])
+		}
+		domain := strings.TrimPrefix(strings.ToLower(fields[0]), ".")
+		if domain == "" {
+			return count, fmt.Errorf("%s:%d: missing domain", name, lineNo)
+		}
+
+		c := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			c.Domain = domain
+		}
+		if expires > 0 {
+			if c.Expires = time.Unix(expires, 0); !c.Expires.After(now) {
+				continue
+			}
+		}
+		j.SetCookies(&url.URL{Scheme: "https", Host: domain, Path: c.Path}, []*http.Cookie{c})
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("failed to read cookie file: %w", err)
+	}
+	return count, nil
+}
+
+// Save 把当前的 cookie 写入 Netscape 格式的文件，包括会话 cookie
+func (j *CookieJar) Save(name string) error {
+	now := time.Now()
+	j.mu.Lock()
+	entries := make([]*cookieEntry, 0, len(j.entries))
+	for _, e := range j.entries {
+		if (e.expires.IsZero() || e.expires.After(now)) && j.accepted(e) {
+			entries = append(entries, e)
+		}
+	}
+	j.mu.Unlock()
+	sort.Slice(entries, func(a, b int) bool { return entries[a].key() < entries[b].key() })
+
+	var sb strings.Builder
+	sb.WriteString("# Netscape HTTP Cookie File\n\n")
+	for _, e := range entries {
+		domain := e.domain
+		if e.httpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		var expires int64
+		if !e.expires.IsZero() {
+			expires = e.expires.Unix()
+		}
+		fmt.Fprintf(&sb, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, netscapeBool(!e.hostOnly), e.path, netscapeBool(e.secure), expires, e.name, e.value)
+	}
+
+	// 先写临时文件再重命名，写入中断时不会破坏原来的文件
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0600); err != nil {
+		return fmt.Errorf("failed to save cookies: %w", err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save cookies: %w", err)
+	}
+	return nil
+}
+
+// accepted 判断 cookie 是否确实保存在 jar 中，被 jar 拒绝的 cookie（例如域名不匹配）不导出
+func (j *CookieJar) accepted(e *cookieEntry) bool {
+	u := &url.URL{Scheme: "https", Host: e.domain, Path: path.Join(e.path, "x")}
+	for _, c := range j.jar.Cookies(u) {
+		if c.Name == e.name && c.Value == e.value {
+			return true
+		}
+	}
+	return false
+}
+
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
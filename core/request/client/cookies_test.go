@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieJarLoadSave(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+	file := filepath.Join(t.TempDir(), "cookies.txt")
+	content := fmt.Sprintf("# Netscape HTTP Cookie File\n"+
+		".example.com\tTRUE\t/\tTRUE\t%d\tsession\tabc\n"+
+		"#HttpOnly_www.example.com\tFALSE\t/videos\tFALSE\t0\tage_verified\t1\n"+
+		".example.com\tTRUE\t/\tFALSE\t1\texpired\tx\n", future)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jar := NewCookieJar()
+	n, err := jar.Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("loaded %d cookies, want 2", n)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://m.example.com/", "session=abc"},
+		{"http://m.example.com/", ""}, // secure cookie
+		{"http://www.example.com/videos/1", "age_verified=1"},
+		{"https://www.example.com/videos/1", "age_verified=1; session=abc"},
+		{"https://sub.www.example.com/videos/1", "session=abc"}, // host-only cookie
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		for _, c := range jar.Cookies(req.URL) {
+			req.AddCookie(c)
+		}
+		if got := req.Header.Get("Cookie"); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	if err := jar.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewCookieJar()
+	if n, err := reloaded.Load(file); err != nil || n != 2 {
+		t.Fatalf("reload: %d cookies, %v", n, err)
+	}
+	data, _ := os.ReadFile(file)
+	if !strings.Contains(string(data), "#HttpOnly_www.example.com\tFALSE\t/videos\tFALSE\t0\tage_verified\t1\n") {
+		t.Errorf("host-only HttpOnly session cookie not preserved:\n%s", data)
+	}
+
+	os.WriteFile(file, []byte("example.com\tTRUE\t/\n"), 0644)
+	if _, err := NewCookieJar().Load(file); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+}
+
+func TestClientKeepsSessionCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("sid"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "42", Path: "/", MaxAge: 3600})
+			io.WriteString(w, "new")
+			return
+		}
+		io.WriteString(w, "returning")
+	}))
+	defer srv.Close()
+
+	client := NewClient("", 1, 0)
+	for _, want := range []string{"new", "returning"} {
+		body, err := client.Get(context.Background(), srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != want {
+			t.Errorf("got %q, want %q", body, want)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := client.Cookies.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(file)
+	if !strings.Contains(string(data), "127.0.0.1\tFALSE\t/\tFALSE\t") || !strings.Contains(string(data), "\tsid\t42\n") {
+		t.Errorf("saved cookies missing sid:\n%s", data)
+	}
+}
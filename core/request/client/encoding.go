@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding 是页面请求发送的 Accept-Encoding，与 Chrome 一致
+const acceptEncoding = "gzip, deflate, br, zstd"
+
+// mediaAcceptEncoding 是下载媒体时默认发送的 Accept-Encoding，保证写入文件的是原始字节，
+// 并且 Range 续传的偏移量与文件大小一致
+const mediaAcceptEncoding = "identity"
+
+// decoders 按 Content-Encoding 创建解压 reader，返回的 reader 实现 io.Closer 时在关闭响应体时关闭
+var decoders = map[string]func(r io.Reader) (io.Reader, error){
+	"gzip":   func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"x-gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		// 规范要求 zlib 格式，但有些服务器直接发送 raw deflate
+		br := bufio.NewReader(r)
+		header, err := br.Peek(2)
+		if err != nil {
+			return nil, err
+		}
+		if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	},
+	"br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	"zstd": func(r io.Reader) (io.Reader, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader{d}, nil
+	},
+}
+
+// zstdReader 让 zstd.Decoder 的 Close 满足 io.Closer
+type zstdReader struct{ *zstd.Decoder }
+
+func (r zstdReader) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// decodeResponse 按 Content-Encoding 替换响应体为解压后的内容，不认识的编码保持原样
+func decodeResponse(resp *http.Response) *http.Response {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	newReader, ok := decoders[encoding]
+	if !ok {
+		return resp
+	}
+	resp.Body = &decodedBody{body: resp.Body, newReader: newReader}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp
+}
+
+// decodedBody 在第一次读取时才创建解压 reader，避免 RoundTrip 阻塞在读取压缩头上
+type decodedBody struct {
+	body      io.ReadCloser
+	newReader func(io.Reader) (io.Reader, error)
+	r         io.Reader
+	err       error
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.r == nil && b.err == nil {
+		b.r, b.err = b.newReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.r.Read(p)
+}
+
+func (b *decodedBody) Close() error {
+	if c, ok := b.r.(io.Closer); ok {
+		c.Close()
+	}
+	return b.body.Close()
+}
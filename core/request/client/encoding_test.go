@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const testPage = "<html><body>hello, 世界</body></html>"
+
+var testEncoders = map[string]func(w io.Writer) io.WriteCloser{
+	"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+	"raw-deflate": func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	},
+	"br": func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+	"zstd": func(w io.Writer) io.WriteCloser {
+		zw, _ := zstd.NewWriter(w)
+		return zw
+	},
+}
+
+// encodingHandler 在 Accept-Encoding 包含 ?enc= 指定的编码时压缩 testPage，并在响应头中回显 Accept-Encoding
+func encodingHandler(w http.ResponseWriter, r *http.Request) {
+	enc := r.URL.Query().Get("enc")
+	contentEncoding := strings.TrimPrefix(enc, "raw-")
+	w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), contentEncoding) {
+		io.WriteString(w, testPage)
+		return
+	}
+
+	var buf bytes.Buffer
+	ew := testEncoders[enc](&buf)
+	io.WriteString(ew, testPage)
+	ew.Close()
+	w.Header().Set("Content-Encoding", contentEncoding)
+	w.Write(buf.Bytes())
+}
+
+func TestTransportDecodesPages(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(encodingHandler))
+	defer plain.Close()
+	tlsSrv := httptest.NewUnstartedServer(http.HandlerFunc(encodingHandler))
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		profile *TLSProfile
+	}{
+		{"http", plain.URL, ChromeProfile},
+		{"https http/1.1", tlsSrv.URL, ChromeProfile},
+		{"https h2", tlsSrv.URL, GoProfile},
+	}
+	for _, tt := range tests {
+		client := NewClient("", 1, 0)
+		client.TLSProfile = tt.profile
+		trustServer(client, tlsSrv)
+		ctx := context.Background()
+
+		for enc := range testEncoders {
+			body, err := client.Get(ctx, tt.url+"/?enc="+enc, nil)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tt.name, enc, err)
+			}
+			if body != testPage {
+				t.Errorf("%s %s: page not decoded: %q", tt.name, enc, body)
+			}
+		}
+
+		// 下载媒体时不压缩，拿到的是原始字节
+		resp, err := client.GetStream(ctx, "GET", tt.url+"/?enc=gzip", nil, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Accept-Encoding"); got != mediaAcceptEncoding || string(data) != testPage {
+			t.Errorf("%s: media request sent Accept-Encoding %q and got %q", tt.name, got, data)
+		}
+
+		// 调用者指定了 Accept-Encoding 时不解压
+		opts := &RequestOption{Headers: map[string]string{"Accept-Encoding": "gzip"}}
+		resp, err = client.GetStream(ctx, "GET", tt.url+"/?enc=gzip", opts, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("%s: response with an explicit Accept-Encoding was decoded", tt.name)
+		}
+	}
+}
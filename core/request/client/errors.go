@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"MediaNinja/core/request/retry"
+)
+
+// maxErrorSnippet 是 HTTPStatusError 中保留的响应内容长度
+const maxErrorSnippet = 200
+
+// HTTPStatusError 表示 Get 收到了非 2xx 响应
+type HTTPStatusError struct {
+	StatusCode int
+	URL        string
+	Snippet    string        // 响应内容的开头，空白已合并，便于判断是错误页还是验证页
+	RetryAfter time.Duration // 响应中的 Retry-After，0 表示没有
+}
+
+func newHTTPStatusError(url string, resp *http.Response, body []byte) *HTTPStatusError {
+	retryAfter, _ := retry.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return &HTTPStatusError{
+		StatusCode: resp.StatusCode,
+		URL:        url,
+		Snippet:    snippet(body),
+		RetryAfter: retryAfter,
+	}
+}
+
+func (e *HTTPStatusError) Error() string {
+	msg := fmt.Sprintf("unexpected status code %d from %s", e.StatusCode, e.URL)
+	if e.Snippet != "" {
+		msg += ": " + e.Snippet
+	}
+	return msg
+}
+
+// HTTPStatus 和 RetryAfterDelay 供 retry.Classify 判断是否重试
+func (e *HTTPStatusError) HTTPStatus() int {
+	return e.StatusCode
+}
+
+func (e *HTTPStatusError) RetryAfterDelay() time.Duration {
+	return e.RetryAfter
+}
+
+// ChallengeError 表示页面被反爬虫验证页（例如 Cloudflare 的 "Just a moment..."）拦截，
+// 重试没有意义，需要换用浏览器导出的 cookie、其他 TLS 指纹或代理
+type ChallengeError struct {
+	Provider   string // 验证页的提供方，例如 Cloudflare
+	StatusCode int
+	URL        string
+}
+
+func (e *ChallengeError) Error() string {
+	return fmt.Sprintf("%s anti-bot challenge at %s (status code %d)", e.Provider, e.URL, e.StatusCode)
+}
+
+// challengeMarkers 是各家验证页特有的内容，只在体积较小的 HTML 响应中查找
+var challengeMarkers = []struct {
+	provider string
+	markers  []string
+}{
+	{"Cloudflare", []string{"cf-browser-verification", "/cdn-cgi/challenge-platform/", "window._cf_chl_opt", "<title>Just a moment...</title>", "<title>Attention Required! | Cloudflare</title>"}},
+	{"DDoS-Guard", []string{"<title>DDoS-Guard</title>", "check.ddos-guard.net"}},
+	{"Sucuri", []string{"<title>Sucuri WebSite Firewall - Access Denied</title>", "sucuri.net/privacy-policy"}},
+}
+
+// maxChallengePage 以上大小的页面不再检查，验证页通常只有几十 KB
+const maxChallengePage = 512 << 10
+
+// detectChallenge 返回拦截了本次请求的反爬虫验证页提供方，不是验证页时返回空字符串
+func detectChallenge(resp *http.Response, body []byte) string {
+	if resp.Header.Get("Cf-Mitigated") == "challenge" {
+		return "Cloudflare"
+	}
+	if len(body) > maxChallengePage || !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return ""
+	}
+	for _, c := range challengeMarkers {
+		for _, marker := range c.markers {
+			if bytes.Contains(body, []byte(marker)) {
+				return c.provider
+			}
+		}
+	}
+	return ""
+}
+
+// snippet 返回 body 开头的 maxErrorSnippet 个字节，合并空白并去掉被截断的 UTF-8 字符
+func snippet(body []byte) string {
+	s := strings.Join(strings.Fields(string(body[:min(len(body), maxErrorSnippet*2)])), " ")
+	s = strings.ToValidUTF8(s, "")
+	if len(s) <= maxErrorSnippet {
+		return s
+	}
+	s = s[:maxErrorSnippet]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + "..."
+}
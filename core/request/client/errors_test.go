@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"MediaNinja/core/request/retry"
+)
+
+const testChallengePage = `<!DOCTYPE html><html><head><title>Just a moment...</title></head>
+<body><script>window._cf_chl_opt={cType: 'managed'};</script></body></html>`
+
+func TestGetStatusErrors(t *testing.T) {
+	var flaky, challenges int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<html>\n  <h1>Not   Found</h1>\n</html>")
+		case "/flaky":
+			if atomic.AddInt32(&flaky, 1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			io.WriteString(w, "ok")
+		case "/challenge":
+			atomic.AddInt32(&challenges, 1)
+			w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, testChallengePage)
+		case "/mitigated":
+			w.Header().Set("Cf-Mitigated", "challenge")
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	client := NewClient("", 3, 0)
+	ctx := context.Background()
+
+	_, err := client.Get(ctx, srv.URL+"/missing", nil)
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("got %v, want *HTTPStatusError", err)
+	}
+	if statusErr.StatusCode != http.StatusNotFound || statusErr.URL != srv.URL+"/missing" || statusErr.Snippet != "<html> <h1>Not Found</h1> </html>" {
+		t.Errorf("unexpected error fields: %+v", statusErr)
+	}
+	if retry.Classify(err) != retry.ClientError {
+		t.Errorf("404 classified as %s", retry.Classify(err))
+	}
+
+	if body, err := client.Get(ctx, srv.URL+"/flaky", nil); err != nil || body != "ok" {
+		t.Errorf("got %q, %v, want the 502 to be retried", body, err)
+	}
+
+	// 验证页不重试
+	_, err = client.Get(ctx, srv.URL+"/challenge", nil)
+	var challenge *ChallengeError
+	if !errors.As(err, &challenge) || challenge.Provider != "Cloudflare" || challenge.StatusCode != http.StatusForbidden {
+		t.Errorf("got %v, want a Cloudflare challenge error", err)
+	}
+	if n := atomic.LoadInt32(&challenges); n != 1 {
+		t.Errorf("challenge page requested %d times, want 1", n)
+	}
+	if _, err := client.Get(ctx, srv.URL+"/mitigated", nil); !errors.As(err, &challenge) {
+		t.Errorf("got %v, want a challenge error from the Cf-Mitigated header", err)
+	}
+
+	body, err := client.Get(ctx, srv.URL+"/challenge", &RequestOption{AllowErrorStatus: true})
+	if err != nil || body != testChallengePage {
+		t.Errorf("got %q, %v, want the page when status checks are disabled", body, err)
+	}
+}
+
+func TestErrorSnippet(t *testing.T) {
+	if got := snippet([]byte(strings.Repeat("页", 100))); len(got) != 198+len("...") || !strings.HasSuffix(got, "...") {
+		t.Errorf("got %d bytes %q, want the snippet cut at a rune boundary", len(got), got)
+	}
+	if got := snippet([]byte("short\n\tbody")); got != "short body" {
+		t.Errorf("got %q", got)
+	}
+}
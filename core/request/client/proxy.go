@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
+)
+
+// proxyDefaultPorts 是各代理协议的默认端口
+var proxyDefaultPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+// ParseProxyURL 解析并校验代理地址，支持 http、https、socks5 和 socks5h，可以带 user:pass@ 认证信息，
+// 省略端口时使用协议的默认端口
+func ParseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %w", raw, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	port, ok := proxyDefaultPorts[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("invalid proxy URL %q: scheme must be http, https, socks5 or socks5h", raw)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", raw)
+	}
+	if p := u.Port(); p != "" {
+		if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid proxy URL %q: bad port %q", raw, p)
+		}
+	} else {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// dialProxy 经过代理建立到 dest 的 TCP 隧道。
+// HTTP/HTTPS 代理使用 CONNECT；socks5 在本地解析域名，socks5h 把域名交给代理解析。
+func (u *uTransport) dialProxy(ctx context.Context, proxyURL *url.URL, dest string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, dialer)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL.Scheme == "socks5" {
+			if dest, err = resolveAddr(ctx, dest); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := socks.(proxy.ContextDialer).DialContext(ctx, "tcp", dest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect through SOCKS proxy: %v", err)
+		}
+		return conn, nil
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy: %v", err)
+	}
+	// 请求被取消或超时时关闭连接，中断和代理之间的握手
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if proxyURL.Scheme == "https" {
+		// 到代理的 TLS 连接只用于加密代理流量，使用普通的 ClientHello
+		config := &tls.Config{ServerName: proxyURL.Hostname(), RootCAs: u.tlsConfig.RootCAs, NextProtos: []string{"http/1.1"}}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy failed: %v", err)
+		}
+		conn = tlsConn
+	}
+
+	if err := connectTunnel(conn, dest, proxyURL.User); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// resolveAddr 在本地把 host:port 中的域名解析为 IP 地址，优先使用 IPv4
+func resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	ip := ips[0].IP
+	for _, addr := range ips {
+		if addr.IP.To4() != nil {
+			ip = addr.IP
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// connectTunnel 通过 HTTP 代理的 CONNECT 请求建立到 dest 的隧道，user 不为 nil 时发送 Basic 认证
+func connectTunnel(conn net.Conn, dest string, user *url.Userinfo) error {
+	// 发送 CONNECT 请求
+	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", dest, dest)
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		connectReq += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := conn.Write([]byte(connectReq + "\r\n")); err != nil {
+		return fmt.Errorf("failed to send CONNECT request: %v", err)
+	}
+
+	// 读取代理响应
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return fmt.Errorf("failed to read proxy response: %v", err)
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return fmt.Errorf("proxy CONNECT failed with status: %s (check the proxy credentials)", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy CONNECT failed with status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyRotation 是代理池选择代理的方式
+type ProxyRotation int
+
+const (
+	// RoundRobin 依次使用每个可用的代理
+	RoundRobin ProxyRotation = iota
+	// LeastFailures 使用累计失败次数最少的代理，次数相同时依次使用
+	LeastFailures
+)
+
+const (
+	defaultMaxProxyFailures = 3
+	defaultProbeDelay       = 30 * time.Second
+	maxProbeDelay           = 10 * time.Minute
+	probeTimeout            = 10 * time.Second
+)
+
+// ErrNoProxyAvailable 表示代理池中的代理都因连续失败被移出了轮换
+var ErrNoProxyAvailable = errors.New("no proxy available, all proxies are down")
+
+// ParseProxyRotation 解析 round-robin 或 least-failures，空字符串表示 round-robin
+func ParseProxyRotation(s string) (ProxyRotation, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "round-robin":
+		return RoundRobin, nil
+	case "least-failures":
+		return LeastFailures, nil
+	}
+	return 0, fmt.Errorf("unknown proxy rotation %q, expected round-robin or least-failures", s)
+}
+
+// ProxyOptions 描述代理池的配置，通常来自命令行
+type ProxyOptions struct {
+	Proxies  []string // 代理地址，格式见 ParseProxyURL
+	File     string   // 每行一个代理地址的文件，# 开头的行是注释
+	Rotation string   // round-robin 或 least-failures
+	Rules    []string // 按站点选择代理的规则，格式为 "域名模式=代理地址" 或 "域名模式=direct"
+}
+
+// ProxyPool 为每个请求选择代理。命中路由规则的请求使用规则指定的代理或直连，其余请求在代理池中轮换；
+// 代理池为空时直接连接。连续失败 maxFailures 次的代理移出轮换，之后定期探测，恢复后重新加入。
+type ProxyPool struct {
+	rotation    ProxyRotation
+	maxFailures int
+	probeDelay  time.Duration                               // 第一次重新探测前的等待时间，探测失败后加倍
+	probe       func(ctx context.Context, u *url.URL) error // 检查代理是否恢复，默认尝试建立 TCP 连接
+	err         error                                       // 配置错误，所有请求都返回这个错误而不是绕过代理
+
+	mu      sync.Mutex
+	proxies []*proxyState // 参与轮换的代理
+	rules   []proxyRule
+	next    int
+}
+
+// proxyState 记录一个代理的健康状况
+type proxyState struct {
+	url      *url.URL
+	failures int // 连续失败次数
+	total    int // 累计失败次数
+	dead     bool
+	delay    time.Duration // 下一次探测前的等待时间
+}
+
+// proxyRule 把匹配 pattern 的主机名路由到 proxy，proxy 为 nil 表示直连
+type proxyRule struct {
+	pattern string
+	proxy   *proxyState
+}
+
+// NewProxyPool 按配置创建代理池，代理地址、规则或轮换方式有误时返回错误
+func NewProxyPool(opts ProxyOptions) (*ProxyPool, error) {
+	rotation, err := ParseProxyRotation(opts.Rotation)
+	if err != nil {
+		return nil, err
+	}
+	p := &ProxyPool{
+		rotation:    rotation,
+		maxFailures: defaultMaxProxyFailures,
+		probeDelay:  defaultProbeDelay,
+		probe:       dialProbe,
+	}
+
+	proxies := opts.Proxies
+	if opts.File != "" {
+		list, err := readProxyFile(opts.File)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, list...)
+	}
+	seen := make(map[string]bool)
+	for _, raw := range proxies {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		s, err := p.state(raw)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[s.url.String()] {
+			seen[s.url.String()] = true
+			p.proxies = append(p.proxies, s)
+		}
+	}
+
+	for _, rule := range opts.Rules {
+		pattern, target, ok := strings.Cut(rule, "=")
+		pattern, target = strings.ToLower(strings.TrimSpace(pattern)), strings.TrimSpace(target)
+		if !ok || pattern == "" || target == "" {
+			return nil, fmt.Errorf("invalid proxy rule %q, expected pattern=proxy-url or pattern=direct", rule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid proxy rule %q: %w", rule, err)
+		}
+		r := proxyRule{pattern: pattern}
+		if !strings.EqualFold(target, "direct") {
+			if r.proxy, err = p.state(target); err != nil {
+				return nil, fmt.Errorf("invalid proxy rule %q: %w", rule, err)
+			}
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// state 返回 raw 对应的代理状态，同一个代理在轮换列表和规则中共享健康状况
+func (p *ProxyPool) state(raw string) (*proxyState, error) {
+	u, err := ParseProxyURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range p.proxies {
+		if s.url.String() == u.String() {
+			return s, nil
+		}
+	}
+	for _, r := range p.rules {
+		if r.proxy != nil && r.proxy.url.String() == u.String() {
+			return r.proxy, nil
+		}
+	}
+	return &proxyState{url: u}, nil
+}
+
+// readProxyFile 读取每行一个代理地址的文件
+func readProxyFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open proxy file: %w", err)
+	}
+	defer file.Close()
+
+	var proxies []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			proxies = append(proxies, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read proxy file: %w", err)
+	}
+	return proxies, nil
+}
+
+// matchHost 判断主机名是否匹配规则：支持 path.Match 的通配符，不带通配符的域名同时匹配子域名
+func matchHost(pattern, host string) bool {
+	if ok, _ := path.Match(pattern, host); ok {
+		return true
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// pick 为访问 host 的请求选择代理，返回 nil 表示直连
+func (p *ProxyPool) pick(host string) (*proxyState, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	host = strings.ToLower(host)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, r := range p.rules {
+		if !matchHost(r.pattern, host) {
+			continue
+		}
+		if r.proxy != nil && r.proxy.dead {
+			return nil, fmt.Errorf("proxy %s for %s is down", r.proxy.url.Redacted(), host)
+		}
+		return r.proxy, nil
+	}
+	if len(p.proxies) == 0 {
+		return nil, nil
+	}
+
+	var found *proxyState
+	for i := range p.proxies {
+		s := p.proxies[(p.next+i)%len(p.proxies)]
+		if s.dead {
+			continue
+		}
+		if found == nil || (p.rotation == LeastFailures && s.total < found.total) {
+			found = s
+		}
+		if p.rotation == RoundRobin {
+			break
+		}
+	}
+	if found == nil {
+		return nil, ErrNoProxyAvailable
+	}
+	for i, s := range p.proxies {
+		if s == found {
+			p.next = i + 1
+		}
+	}
+	return found, nil
+}
+
+// report 记录一次经过代理的连接结果，连续失败达到上限时把代理移出轮换并安排探测
+func (p *ProxyPool) report(s *proxyState, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	s.total++
+	if s.dead || s.failures < p.maxFailures {
+		return
+	}
+	s.dead = true
+	s.delay = p.probeDelay
+	log.Printf("Proxy %s removed from rotation after %d consecutive failures: %v", s.url.Redacted(), s.failures, err)
+	time.AfterFunc(s.delay, func() { p.reprobe(s) })
+}
+
+// reprobe 探测移出轮换的代理，成功时重新加入，失败时延长等待时间后再次探测
+func (p *ProxyPool) reprobe(s *proxyState) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	err := p.probe(ctx, s.url)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		s.dead = false
+		s.failures = 0
+		log.Printf("Proxy %s is back in rotation", s.url.Redacted())
+		return
+	}
+	s.delay = min(s.delay*2, maxProbeDelay)
+	time.AfterFunc(s.delay, func() { p.reprobe(s) })
+}
+
+// dialProbe 通过建立 TCP 连接检查代理是否可达
+func dialProbe(ctx context.Context, u *url.URL) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+type proxyKey struct{}
+
+// withProxy 把 RoundTrip 选择的代理交给 http.Transport 的 Proxy 回调
+func withProxy(ctx context.Context, s *proxyState) context.Context {
+	return context.WithValue(ctx, proxyKey{}, s)
+}
+
+// proxyFromContext 作为 http.Transport 的 Proxy 回调，返回 withProxy 设置的代理
+func proxyFromContext(req *http.Request) (*url.URL, error) {
+	if s, ok := req.Context().Value(proxyKey{}).(*proxyState); ok && s != nil {
+		return s.url, nil
+	}
+	return nil, nil
+}
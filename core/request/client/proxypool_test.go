@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func pickHosts(t *testing.T, p *ProxyPool, host string, n int) []string {
+	t.Helper()
+	var got []string
+	for i := 0; i < n; i++ {
+		s, err := p.pick(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s == nil {
+			got = append(got, "direct")
+		} else {
+			got = append(got, s.url.Hostname())
+		}
+	}
+	return got
+}
+
+func TestProxyRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "proxies.txt")
+	os.WriteFile(file, []byte("# backup\nsocks5://c.local\n\nhttp://a.local:8080\n"), 0644)
+
+	p, err := NewProxyPool(ProxyOptions{Proxies: []string{"http://a.local:8080", "http://b.local:8080"}, File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pickHosts(t, p, "example.com", 4); !slices.Equal(got, []string{"a.local", "b.local", "c.local", "a.local"}) {
+		t.Errorf("round-robin got %v", got)
+	}
+
+	p, err = NewProxyPool(ProxyOptions{Proxies: []string{"http://a.local", "http://b.local", "http://c.local"}, Rotation: "least-failures"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.report(p.proxies[0], errors.New("refused"))
+	p.report(p.proxies[1], errors.New("refused"))
+	p.report(p.proxies[1], nil)
+	if got := pickHosts(t, p, "example.com", 2); !slices.Equal(got, []string{"c.local", "c.local"}) {
+		t.Errorf("least-failures got %v", got)
+	}
+}
+
+func TestProxyRules(t *testing.T) {
+	p, err := NewProxyPool(ProxyOptions{
+		Proxies: []string{"http://pool.local"},
+		Rules:   []string{"*ddys*=http://a.local", "yhdm.tv=direct"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"ddys.pro":     "a.local",
+		"www.ddys.art": "a.local",
+		"yhdm.tv":      "direct",
+		"m.yhdm.tv":    "direct",
+		"example.com":  "pool.local",
+	} {
+		if got := pickHosts(t, p, host, 1)[0]; got != want {
+			t.Errorf("%s: got %s, want %s", host, got, want)
+		}
+	}
+
+	for _, rule := range []string{"ddys.pro", "=direct", "ddys.pro=ftp://a.local", "[=direct"} {
+		if _, err := NewProxyPool(ProxyOptions{Rules: []string{rule}}); err == nil {
+			t.Errorf("expected an error for rule %q", rule)
+		}
+	}
+}
+
+func TestProxyHealth(t *testing.T) {
+	p, err := NewProxyPool(ProxyOptions{Proxies: []string{"http://a.local", "http://b.local"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var healthy atomic.Bool
+	probed := make(chan struct{}, 10)
+	p.maxFailures = 2
+	p.probeDelay = time.Millisecond
+	p.probe = func(ctx context.Context, u *url.URL) error {
+		defer func() { probed <- struct{}{} }()
+		if healthy.Load() {
+			return nil
+		}
+		return errors.New("still down")
+	}
+
+	a, b := p.proxies[0], p.proxies[1]
+	p.report(a, errors.New("refused"))
+	p.report(a, errors.New("refused"))
+	if got := pickHosts(t, p, "example.com", 2); !slices.Equal(got, []string{"b.local", "b.local"}) {
+		t.Errorf("dead proxy still in rotation: %v", got)
+	}
+	p.report(b, errors.New("refused"))
+	p.report(b, errors.New("refused"))
+	if _, err := p.pick("example.com"); !errors.Is(err, ErrNoProxyAvailable) {
+		t.Errorf("got %v, want ErrNoProxyAvailable", err)
+	}
+
+	// 第一次探测失败，之后恢复
+	<-probed
+	healthy.Store(true)
+	deadline := time.After(5 * time.Second)
+	for {
+		if s, err := p.pick("example.com"); err == nil && s != nil {
+			break
+		}
+		select {
+		case <-probed:
+		case <-deadline:
+			t.Fatal("proxies never came back into rotation")
+		}
+	}
+}
+
+func TestProxyPoolRequests(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	var tunnelsA, tunnelsB int32
+	proxyA, proxyB := connectProxy(&tunnelsA), connectProxy(&tunnelsB)
+	defer proxyA.Close()
+	defer proxyB.Close()
+
+	client := NewClient(proxyA.URL+","+proxyB.URL, 1, 0)
+	trustServer(client, srv)
+	for i := 0; i < 4; i++ {
+		if _, err := client.Get(context.Background(), srv.URL, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a, b := atomic.LoadInt32(&tunnelsA), atomic.LoadInt32(&tunnelsB); a != 1 || b != 1 {
+		t.Errorf("got %d and %d tunnels, want one through each proxy", a, b)
+	}
+
+	// 直连规则绕过代理池
+	pool, err := NewProxyPool(ProxyOptions{Proxies: []string{proxyA.URL}, Rules: []string{"127.0.0.1=direct"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetProxyPool(pool)
+	if _, err := client.Get(context.Background(), srv.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if a := atomic.LoadInt32(&tunnelsA); a != 1 {
+		t.Errorf("direct rule still used the proxy: %d tunnels", a)
+	}
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"MediaNinja/core/request/retry"
+)
+
+const (
+	// 服务器返回 429/503 但没有 Retry-After 时的暂停时间，连续被限流时加倍
+	defaultThrottleBackoff = 2 * time.Second
+	maxThrottleBackoff     = 5 * time.Minute
+)
+
+// RateLimit 是每个主机的请求频率限制，零值表示不限制
+type RateLimit struct {
+	RPS      float64       // 每秒请求数，0 表示不限制
+	Burst    int           // 令牌桶容量，允许短时间内连续发出的请求数，小于 1 时按 1 处理
+	MinDelay time.Duration // 同一主机相邻两个请求之间的最小间隔
+}
+
+// rateLimiter 按主机名限制请求频率：令牌桶控制平均速率，MinDelay 控制相邻请求的间隔，
+// 收到 429/503 后暂停该主机的全部请求
+type rateLimiter struct {
+	limit RateLimit
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+type hostLimit struct {
+	tokens      float64
+	refilled    time.Time // 上次计算令牌的时间
+	last        time.Time // 上一个请求发出的时间
+	pausedUntil time.Time // 被限流后恢复请求的时间
+	throttled   int       // 连续被限流的次数
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	limit.Burst = max(limit.Burst, 1)
+	return &rateLimiter{limit: limit, hosts: make(map[string]*hostLimit)}
+}
+
+func (l *rateLimiter) host(name string) *hostLimit {
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &hostLimit{tokens: float64(l.limit.Burst), refilled: time.Now()}
+		l.hosts[name] = h
+	}
+	return h
+}
+
+// wait 等待直到可以向 host 发出请求，ctx 取消时返回 ctx 的原因
+func (l *rateLimiter) wait(ctx context.Context, host string) error {
+	for {
+		l.mu.Lock()
+		delay := l.reserveLocked(l.host(host), time.Now())
+		l.mu.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return context.Cause(ctx)
+		case <-timer.C:
+		}
+	}
+}
+
+// reserveLocked 在可以立即发出请求时消耗一个令牌并返回 0，否则返回需要等待的时间
+func (l *rateLimiter) reserveLocked(h *hostLimit, now time.Time) time.Duration {
+	if l.limit.RPS > 0 {
+		h.tokens = min(h.tokens+now.Sub(h.refilled).Seconds()*l.limit.RPS, float64(l.limit.Burst))
+		h.refilled = now
+	}
+
+	ready := h.pausedUntil
+	if l.limit.MinDelay > 0 && !h.last.IsZero() {
+		ready = later(ready, h.last.Add(l.limit.MinDelay))
+	}
+	if l.limit.RPS > 0 && h.tokens < 1 {
+		ready = later(ready, now.Add(time.Duration((1-h.tokens)/l.limit.RPS*float64(time.Second))))
+	}
+	if ready.After(now) {
+		return ready.Sub(now)
+	}
+
+	if l.limit.RPS > 0 {
+		h.tokens--
+	}
+	h.last = now
+	return 0
+}
+
+// observe 根据响应调整 host 的状态：429/503 时按 Retry-After 暂停，其他响应清除连续限流的计数
+func (l *rateLimiter) observe(host string, resp *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.host(host)
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		h.throttled = 0
+		return
+	}
+
+	now := time.Now()
+	backoff, ok := retry.ParseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		backoff = defaultThrottleBackoff << min(h.throttled, 10)
+	}
+	h.throttled++
+	h.pausedUntil = later(h.pausedUntil, now.Add(min(backoff, maxThrottleBackoff)))
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"MediaNinja/core/request/retry"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	l := newRateLimiter(RateLimit{RPS: 10, Burst: 2})
+	now := time.Now()
+	h := l.host("example.com")
+	h.refilled = now
+
+	// 令牌桶中的两个请求立即发出，第三个需要等待一个令牌
+	for i := 0; i < 2; i++ {
+		if d := l.reserveLocked(h, now); d != 0 {
+			t.Fatalf("request %d delayed by %s", i, d)
+		}
+	}
+	if d := l.reserveLocked(h, now); d < 90*time.Millisecond || d > 110*time.Millisecond {
+		t.Errorf("third request delayed by %s, want 100ms", d)
+	}
+	if d := l.reserveLocked(h, now.Add(100*time.Millisecond)); d != 0 {
+		t.Errorf("request after refill delayed by %s", d)
+	}
+
+	// 不同主机互不影响
+	if d := l.reserveLocked(l.host("other.com"), now); d != 0 {
+		t.Errorf("other host delayed by %s", d)
+	}
+}
+
+func TestRateLimiterMinDelay(t *testing.T) {
+	l := newRateLimiter(RateLimit{MinDelay: time.Second})
+	now := time.Now()
+	h := l.host("example.com")
+	if d := l.reserveLocked(h, now); d != 0 {
+		t.Fatalf("first request delayed by %s", d)
+	}
+	if d := l.reserveLocked(h, now.Add(300*time.Millisecond)); d != 700*time.Millisecond {
+		t.Errorf("got delay %s, want 700ms", d)
+	}
+}
+
+func TestClientBacksOffOnRetryAfter(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	// 只尝试一次，429 直接返回给调用方，暂停由 rateLimiter 负责
+	client := NewClient("", 1, 0)
+	if _, err := client.Get(context.Background(), srv.URL, nil); retry.Classify(err) != retry.Throttled {
+		t.Fatalf("got %v, want a throttled error", err)
+	}
+
+	// 暂停期间的请求在 ctx 超时后放弃，不会发到服务器
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.Get(ctx, srv.URL, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the request to wait for Retry-After", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("server received %d requests during the pause, want 1", n)
+	}
+
+	start := time.Now()
+	if _, err := client.Get(context.Background(), srv.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("request sent after %s, want it to wait for Retry-After", elapsed)
+	}
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrRequestTimeout 表示在 RequestTimeout 内没有收到响应头
+	ErrRequestTimeout error = &timeoutError{"request timed out"}
+	// ErrIdleTimeout 表示读取响应体时超过 IdleTimeout 没有收到数据
+	ErrIdleTimeout error = &timeoutError{"connection idle timeout"}
+)
+
+// timeoutError 实现 Timeout()，重试策略据此把它归为超时
+type timeoutError struct{ msg string }
+
+func (e *timeoutError) Error() string { return e.msg }
+func (e *timeoutError) Timeout() bool { return true }
+
+// do 发送请求。RequestTimeout 只限制等待响应头的时间，下载大文件不受影响；
+// 响应体由 idleTimeoutBody 包装，关闭响应体时释放 ctx。
+func (c *Client) do(ctx context.Context, cancel context.CancelCauseFunc, req *http.Request) (*http.Response, error) {
+	var timer *time.Timer
+	if c.RequestTimeout > 0 {
+		timer = time.AfterFunc(c.RequestTimeout, func() {
+			cancel(fmt.Errorf("%w: no response within %s", ErrRequestTimeout, c.RequestTimeout))
+		})
+	}
+
+	resp, err := c.Client.Do(req)
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, ErrRequestTimeout) {
+			err = cause
+		}
+		cancel(nil)
+		return nil, err
+	}
+
+	resp.Body = newIdleTimeoutBody(ctx, cancel, resp.Body, c.IdleTimeout)
+	return resp, nil
+}
+
+// idleTimeoutBody 在连续 timeout 时间没有读到数据时取消请求，避免卡住的连接永远占用下载协程
+type idleTimeoutBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutBody(ctx context.Context, cancel context.CancelCauseFunc, body io.ReadCloser, timeout time.Duration) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, ctx: ctx, cancel: cancel, timeout: timeout}
+	if timeout > 0 {
+		b.timer = time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("%w: no data received for %s", ErrIdleTimeout, timeout))
+		})
+	}
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.timer != nil {
+		if err == nil {
+			b.timer.Reset(b.timeout)
+		} else {
+			b.timer.Stop()
+		}
+	}
+	if err != nil && err != io.EOF {
+		// 超时取消后底层返回的是 context canceled，换成更明确的原因
+		if cause := context.Cause(b.ctx); errors.Is(cause, ErrIdleTimeout) || errors.Is(cause, ErrRequestTimeout) {
+			err = cause
+		}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// TLSProfile 决定 HTTPS 握手时发送的 ClientHello，也就是服务器看到的 TLS 指纹。
+// 预设的浏览器指纹由 uTLS 维护，自定义指纹从 JSON 文件读取。
+type TLSProfile struct {
+	Name  string
+	hello tls.ClientHelloID
+	spec  func() (*tls.ClientHelloSpec, error) // 不为 nil 时使用 HelloCustom，每个连接生成一份新的 spec
+}
+
+var (
+	// ChromeProfile 是默认的指纹，只声明 HTTP/1.1
+	ChromeProfile  = &TLSProfile{Name: "chrome", hello: tls.HelloCustom, spec: chromeSpec}
+	FirefoxProfile = &TLSProfile{Name: "firefox", hello: tls.HelloFirefox_Auto}
+	SafariProfile  = &TLSProfile{Name: "safari", hello: tls.HelloSafari_Auto}
+	// GoProfile 使用 Go 标准库的 ClientHello
+	GoProfile = &TLSProfile{Name: "go", hello: tls.HelloGolang}
+)
+
+var tlsProfiles = map[string]*TLSProfile{
+	ChromeProfile.Name:  ChromeProfile,
+	FirefoxProfile.Name: FirefoxProfile,
+	SafariProfile.Name:  SafariProfile,
+	GoProfile.Name:      GoProfile,
+}
+
+// LoadTLSProfile 按名称返回预设指纹（chrome、firefox、safari、go），
+// 其他值当作 uTLS 格式的 ClientHello JSON 文件路径
+func LoadTLSProfile(name string) (*TLSProfile, error) {
+	if p, ok := tlsProfiles[strings.ToLower(name)]; ok {
+		return p, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown TLS profile %q: not a preset (chrome, firefox, safari, go) or a readable JSON file", name)
+	}
+	spec := func() (*tls.ClientHelloSpec, error) {
+		var u tls.ClientHelloSpecJSONUnmarshaler
+		if err := json.Unmarshal(data, &u); err != nil {
+			return nil, fmt.Errorf("invalid ClientHello spec %s: %w", name, err)
+		}
+		spec := u.ClientHelloSpec()
+		return &spec, nil
+	}
+	// 启动时先解析一次，格式错误时立即报错而不是等到第一个 HTTPS 请求
+	if _, err := spec(); err != nil {
+		return nil, err
+	}
+	return &TLSProfile{Name: name, hello: tls.HelloCustom, spec: spec}, nil
+}
+
+// handshake 在 conn 上按指纹完成 TLS 握手
+func (p *TLSProfile) handshake(ctx context.Context, conn net.Conn, config *tls.Config) (*tls.UConn, error) {
+	tlsConn := tls.UClient(conn, config, p.hello)
+	if p.spec != nil {
+		spec, err := p.spec()
+		if err != nil {
+			return nil, err
+		}
+		if err := tlsConn.ApplyPreset(spec); err != nil {
+			return nil, fmt.Errorf("uConn.ApplyPreset() error: %+v", err)
+		}
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %+v", err)
+	}
+	return tlsConn, nil
+}
+
+type tlsProfileKey struct{}
+
+// withTLSProfile 把请求使用的指纹交给 transport
+func withTLSProfile(ctx context.Context, p *TLSProfile) context.Context {
+	return context.WithValue(ctx, tlsProfileKey{}, p)
+}
+
+func tlsProfileFrom(ctx context.Context) *TLSProfile {
+	if p, ok := ctx.Value(tlsProfileKey{}).(*TLSProfile); ok && p != nil {
+		return p
+	}
+	return ChromeProfile
+}
+
+// tlsProfileFor 返回访问 host 时使用的指纹：HostTLSProfiles 中匹配的站点（包括子域名）优先，其次是 TLSProfile
+func (c *Client) tlsProfileFor(host string) *TLSProfile {
+	for host != "" {
+		if p, ok := c.HostTLSProfiles[host]; ok {
+			return p
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return c.TLSProfile
+}
+
+func chromeSpec() (*tls.ClientHelloSpec, error) {
+	return &tls.ClientHelloSpec{
+		TLSVersMax:         tls.VersionTLS13,
+		TLSVersMin:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.GREASE_PLACEHOLDER, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		CompressionMethods: []uint8{0x0},
+		Extensions: []tls.TLSExtension{
+			&tls.UtlsGREASEExtension{},
+			&tls.SNIExtension{},
+			&tls.ExtendedMasterSecretExtension{},
+			&tls.RenegotiationInfoExtension{},
+			&tls.SupportedCurvesExtension{Curves: []tls.CurveID{tls.GREASE_PLACEHOLDER, tls.X25519, tls.CurveP256, tls.CurveP384}},
+			&tls.SupportedPointsExtension{SupportedPoints: []byte{0x0}},
+			&tls.SessionTicketExtension{},
+			&tls.ALPNExtension{AlpnProtocols: []string{"http/1.1"}},
+			&tls.StatusRequestExtension{},
+			&tls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []tls.SignatureScheme{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601}},
+			&tls.SCTExtension{},
+			&tls.KeyShareExtension{KeyShares: []tls.KeyShare{
+				{Group: tls.CurveID(tls.GREASE_PLACEHOLDER), Data: []byte{0}},
+				{Group: tls.X25519},
+			}},
+			&tls.PSKKeyExchangeModesExtension{Modes: []uint8{tls.PskModeDHE}},
+			&tls.SupportedVersionsExtension{Versions: []uint16{tls.GREASE_PLACEHOLDER, tls.VersionTLS13, tls.VersionTLS12}},
+			&tls.UtlsCompressCertExtension{Algorithms: []tls.CertCompressionAlgo{tls.CertCompressionBrotli}},
+			&tls.ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}},
+			&tls.UtlsGREASEExtension{},
+			&tls.UtlsPaddingExtension{GetPaddingLen: tls.BoringPaddingStyle},
+		},
+		GetSessionID: nil,
+	}, nil
+}
+
+// ParseHostTLSProfiles 解析 "域名=指纹" 格式的规则，指纹的取值与 LoadTLSProfile 相同，
+// 域名同时匹配子域名，可以写成 "*.example.com"
+func ParseHostTLSProfiles(rules []string) (map[string]*TLSProfile, error) {
+	profiles := make(map[string]*TLSProfile)
+	for _, rule := range rules {
+		domain, name, found := strings.Cut(rule, "=")
+		domain = siteDomain(domain)
+		if !found || domain == "" {
+			return nil, fmt.Errorf("invalid TLS profile rule %q, expected domain=profile", rule)
+		}
+		p, err := LoadTLSProfile(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("TLS profile rule %q: %w", rule, err)
+		}
+		profiles[domain] = p
+	}
+	return profiles, nil
+}
+
+// siteDomain 把规则中的站点规范化为 HostTLSProfiles、SiteHeaders 使用的 key
+func siteDomain(s string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), "*."))
+}
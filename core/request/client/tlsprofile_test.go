@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// newTLSServer 启动同时支持 HTTP/2 和 HTTP/1.1 的 HTTPS 服务器，响应体是请求的协议版本，conns 记录建立的连接数
+func newTLSServer(conns *int32) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	srv.StartTLS()
+	return srv
+}
+
+func trustServer(c *Client, srv *httptest.Server) {
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	c.Client.Transport.(*uTransport).tlsConfig.RootCAs = roots
+}
+
+func TestDirectTLSProfiles(t *testing.T) {
+	tests := []struct {
+		profile *TLSProfile
+		proto   string
+	}{
+		{ChromeProfile, "HTTP/1.1"},
+		{FirefoxProfile, "HTTP/2.0"},
+		{SafariProfile, "HTTP/2.0"},
+		{GoProfile, "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile.Name, func(t *testing.T) {
+			var conns int32
+			srv := newTLSServer(&conns)
+			defer srv.Close()
+
+			client := NewClient("", 1, 0)
+			client.TLSProfile = tt.profile
+			trustServer(client, srv)
+
+			for i := 0; i < 3; i++ {
+				body, err := client.Get(context.Background(), srv.URL, nil)
+				if err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+				if body != tt.proto {
+					t.Fatalf("request %d: got %s, want %s", i, body, tt.proto)
+				}
+			}
+			if n := atomic.LoadInt32(&conns); n != 1 {
+				t.Errorf("got %d connections, want 1", n)
+			}
+		})
+	}
+}
+
+func TestHostTLSProfileOverride(t *testing.T) {
+	var conns int32
+	srv := newTLSServer(&conns)
+	defer srv.Close()
+
+	client := NewClient("", 1, 0)
+	client.HostTLSProfiles = map[string]*TLSProfile{"127.0.0.1": FirefoxProfile}
+	trustServer(client, srv)
+
+	body, err := client.Get(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "HTTP/2.0" {
+		t.Errorf("got %s, want the firefox profile to negotiate HTTP/2.0", body)
+	}
+}
+
+func TestLoadTLSProfile(t *testing.T) {
+	if p, err := LoadTLSProfile("Firefox"); err != nil || p != FirefoxProfile {
+		t.Errorf("LoadTLSProfile(Firefox) = %v, %v", p, err)
+	}
+	if _, err := LoadTLSProfile("netscape"); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalid, []byte(`{"cipher_suites": ["NOT_A_CIPHER"]}`), 0644)
+	if _, err := LoadTLSProfile(invalid); err == nil {
+		t.Error("expected an error for an invalid spec")
+	}
+
+	file := filepath.Join(dir, "custom.json")
+	spec := `{
+		"cipher_suites": ["TLS_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"],
+		"compression_methods": ["NULL"],
+		"extensions": [
+			{"name": "server_name"},
+			{"name": "supported_groups", "named_group_list": ["x25519", "secp256r1"]},
+			{"name": "ec_point_formats", "ec_point_format_list": ["uncompressed"]},
+			{"name": "application_layer_protocol_negotiation", "protocol_name_list": ["h2", "http/1.1"]},
+			{"name": "key_share", "client_shares": [{"group": "x25519"}]},
+			{"name": "supported_versions", "versions": ["TLS 1.3", "TLS 1.2"]},
+			{"name": "signature_algorithms", "supported_signature_algorithms": ["ecdsa_secp256r1_sha256", "rsa_pss_rsae_sha256", "rsa_pkcs1_sha256"]}
+		]
+	}`
+	if err := os.WriteFile(file, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profile, err := LoadTLSProfile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns int32
+	srv := newTLSServer(&conns)
+	defer srv.Close()
+	client := NewClient("", 1, 0)
+	client.TLSProfile = profile
+	trustServer(client, srv)
+	body, err := client.Get(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "HTTP/2.0" {
+		t.Errorf("got %s, want HTTP/2.0", body)
+	}
+}
+
+func TestParseHostTLSProfiles(t *testing.T) {
+	profiles, err := ParseHostTLSProfiles([]string{"*.DDYS.pro=firefox", "example.com = safari"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{TLSProfile: ChromeProfile, HostTLSProfiles: profiles}
+	tests := []struct {
+		host string
+		want *TLSProfile
+	}{
+		{"ddys.pro", FirefoxProfile},
+		{"v.ddys.pro", FirefoxProfile},
+		{"example.com", SafariProfile},
+		{"example.org", ChromeProfile},
+	}
+	for _, tt := range tests {
+		if got := client.tlsProfileFor(tt.host); got != tt.want {
+			t.Errorf("tlsProfileFor(%s) = %s, want %s", tt.host, got.Name, tt.want.Name)
+		}
+	}
+
+	for _, rule := range []string{"firefox", "=firefox", "ddys.pro=netscape"} {
+		if _, err := ParseHostTLSProfiles([]string{rule}); err == nil {
+			t.Errorf("expected an error for %q", rule)
+		}
+	}
+}
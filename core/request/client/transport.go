@@ -2,6 +2,7 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -14,128 +15,136 @@ import (
 type uTransport struct {
 	tr1 *http.Transport
 	tr2 *http2.Transport
+
+	pool      *connPool   // HTTPS 请求的 uTLS 连接池，直连和经代理的连接都在这里
+	tlsConfig *tls.Config // uTLS 连接的基础配置，ServerName 按请求设置
+	proxies   *ProxyPool  // 为每个请求选择代理，nil 表示直连
 }
 
 // ... 移动所有 transport 相关代码到这里 ...
 
-func (*uTransport) newSpec() *tls.ClientHelloSpec {
-	return &tls.ClientHelloSpec{
-		TLSVersMax:         tls.VersionTLS13,
-		TLSVersMin:         tls.VersionTLS12,
-		CipherSuites:       []uint16{tls.GREASE_PLACEHOLDER, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
-		CompressionMethods: []uint8{0x0},
-		Extensions: []tls.TLSExtension{
-			&tls.UtlsGREASEExtension{},
-			&tls.SNIExtension{},
-			&tls.ExtendedMasterSecretExtension{},
-			&tls.RenegotiationInfoExtension{},
-			&tls.SupportedCurvesExtension{Curves: []tls.CurveID{tls.GREASE_PLACEHOLDER, tls.X25519, tls.CurveP256, tls.CurveP384}},
-			&tls.SupportedPointsExtension{SupportedPoints: []byte{0x0}},
-			&tls.SessionTicketExtension{},
-			&tls.ALPNExtension{AlpnProtocols: []string{"http/1.1"}},
-			&tls.StatusRequestExtension{},
-			&tls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []tls.SignatureScheme{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601}},
-			&tls.SCTExtension{},
-			&tls.KeyShareExtension{KeyShares: []tls.KeyShare{
-				{Group: tls.CurveID(tls.GREASE_PLACEHOLDER), Data: []byte{0}},
-				{Group: tls.X25519},
-			}},
-			&tls.PSKKeyExchangeModesExtension{Modes: []uint8{tls.PskModeDHE}},
-			&tls.SupportedVersionsExtension{Versions: []uint16{tls.GREASE_PLACEHOLDER, tls.VersionTLS13, tls.VersionTLS12}},
-			&tls.UtlsCompressCertExtension{Algorithms: []tls.CertCompressionAlgo{tls.CertCompressionBrotli}},
-			&tls.ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}},
-			&tls.UtlsGREASEExtension{},
-			&tls.UtlsPaddingExtension{GetPaddingLen: tls.BoringPaddingStyle},
-		},
-		GetSessionID: nil,
-	}
-}
-
+// RoundTrip 发送请求。请求没有设置 Accept-Encoding 时发送 acceptEncoding 并解压响应，
+// 三条路径（http、HTTP/2、uTLS 上的 HTTP/1.1）的行为一致；tr1 和 tr2 自己不处理压缩。
 func (u *uTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if req.URL.Scheme == "http" {
-		// 对于 http 请求，直接使用普通 RoundTrip 处理
-		return u.tr1.RoundTrip(req)
-	} else if req.URL.Scheme != "https" {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
 		return nil, fmt.Errorf("unsupported scheme: %s", req.URL.Scheme)
 	}
 
-	// 从 transport 配置中获取代理地址
-	proxyURL, err := u.tr1.Proxy(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get proxy URL: %v", err)
+	// Range 请求的偏移量针对的是编码后的内容，不能替调用者解压
+	decode := req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" && req.Method != http.MethodHead
+	if decode {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", acceptEncoding)
 	}
-	if proxyURL == nil {
-		// 没有配置代理，直接使用普通 transport 处理
-		return u.tr1.RoundTrip(req)
+	resp, err := u.roundTrip(req)
+	if err != nil || !decode {
+		return resp, err
 	}
+	return decodeResponse(resp), nil
+}
 
-	// 连接到 HTTP 代理
-	conn, err := net.DialTimeout("tcp", proxyURL.Host, 10*time.Second)
+func (u *uTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	proxy, err := u.proxies.pick(req.URL.Hostname())
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to proxy: %v", err)
+		return nil, err
+	}
+
+	if req.URL.Scheme == "http" {
+		// 对于 http 请求，直接使用普通 RoundTrip 处理，tr1 的 Proxy 回调从 context 中取出选择的代理
+		if proxy == nil {
+			return u.tr1.RoundTrip(req)
+		}
+		req = req.WithContext(withProxy(req.Context(), proxy))
+		resp, err := u.tr1.RoundTrip(req)
+		// 这里无法区分代理和源站的错误，都记在代理上，连续多次失败才会移出轮换
+		if req.Context().Err() == nil {
+			u.proxies.report(proxy, err)
+		}
+		return resp, err
 	}
 
-	// 发送 CONNECT 请求
 	dest := req.URL.Host
 	if req.URL.Port() == "" {
 		dest += ":443"
 	}
-	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, req.URL.Host)
-	_, err = conn.Write([]byte(connectReq))
-	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to send CONNECT request: %v", err)
+	// 指纹不同的连接不能互相复用
+	profile := tlsProfileFrom(req.Context())
+	key := profile.Name + "|direct|" + dest
+	if proxy != nil {
+		key = profile.Name + "|" + proxy.url.String() + "|" + dest
 	}
-
-	// 读取代理响应
-	respReader := bufio.NewReader(conn)
-	resp, err := http.ReadResponse(respReader, req)
-	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to read proxy response: %v", err)
+	dial := func(ctx context.Context) (*persistConn, error) {
+		return u.dialTLS(ctx, proxy, dest, req.URL.Hostname(), profile)
 	}
-	if resp.StatusCode != http.StatusOK {
-		conn.Close()
-		return nil, fmt.Errorf("proxy CONNECT failed with status: %s", resp.Status)
+
+	for {
+		pc, reused, err := u.pool.get(req.Context(), key, dial)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := pc.roundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+		// 复用的连接可能已被服务器关闭，没有请求体的请求可以换一个连接重试
+		if !reused || req.Context().Err() != nil || (req.Body != nil && req.Body != http.NoBody) {
+			return nil, err
+		}
 	}
+}
 
-	// 代理建立了隧道，创建 TLS 连接
-	tlsConn := tls.UClient(conn, &tls.Config{ServerName: req.URL.Hostname()}, tls.HelloCustom)
-	if err = tlsConn.ApplyPreset(u.newSpec()); err != nil {
-		tlsConn.Close()
-		return nil, fmt.Errorf("uConn.ApplyPreset() error: %+v", err)
+// CloseIdleConnections 关闭两个 transport 和连接池中的空闲连接，由 http.Client.CloseIdleConnections 调用
+func (u *uTransport) CloseIdleConnections() {
+	u.tr1.CloseIdleConnections()
+	u.pool.closeIdle()
+}
+
+// dialTLS 建立到 dest 的 uTLS 连接，proxy 不为 nil 时经过代理（见 dialProxy），
+// 并按 ALPN 的结果准备 HTTP/2 或 HTTP/1.1
+func (u *uTransport) dialTLS(ctx context.Context, proxy *proxyState, dest string, serverName string, profile *TLSProfile) (*persistConn, error) {
+	var conn net.Conn
+	var err error
+	if proxy == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		conn, err = dialer.DialContext(ctx, "tcp", dest)
+	} else {
+		conn, err = u.dialProxy(ctx, proxy.url, dest)
+		// 只有连接代理和建立隧道的结果反映代理的健康状况
+		if ctx.Err() == nil {
+			u.proxies.report(proxy, err)
+		}
 	}
-	if err = tlsConn.Handshake(); err != nil {
-		tlsConn.Close()
-		return nil, fmt.Errorf("TLS handshake failed: %+v", err)
+	if err != nil {
+		return nil, err
+	}
+	// 请求被取消或超时时关闭连接，中断握手
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	config := u.tlsConfig.Clone()
+	config.ServerName = serverName
+	tlsConn, err := profile.handshake(ctx, conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
 	// 处理 ALPN (HTTP/2 或 HTTP/1.1)
 	alpn := tlsConn.ConnectionState().NegotiatedProtocol
 	switch alpn {
 	case "h2":
-		req.Proto = "HTTP/2.0"
-		req.ProtoMajor = 2
-		req.ProtoMinor = 0
-
-		if c, err := u.tr2.NewClientConn(tlsConn); err == nil {
-			return c.RoundTrip(req)
-		} else {
+		c, err := u.tr2.NewClientConn(tlsConn)
+		if err != nil {
+			tlsConn.Close()
 			return nil, fmt.Errorf("http2.Transport.NewClientConn() error: %+v", err)
 		}
+		return &persistConn{conn: tlsConn, h2: c}, nil
 
 	case "http/1.1", "":
-		req.Proto = "HTTP/1.1"
-		req.ProtoMajor = 1
-		req.ProtoMinor = 1
-
-		if err := req.Write(tlsConn); err == nil {
-			return http.ReadResponse(bufio.NewReader(tlsConn), req)
-		} else {
-			return nil, fmt.Errorf("http.Request.Write() error: %+v", err)
-		}
+		return &persistConn{conn: tlsConn, br: bufio.NewReader(tlsConn)}, nil
 
 	default:
+		tlsConn.Close()
 		return nil, fmt.Errorf("unsupported ALPN: %v", alpn)
 	}
 }
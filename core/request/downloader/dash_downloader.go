@@ -0,0 +1,468 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// DASHDownloader 下载 MPEG-DASH 点播流：分别下载视频和音频轨道，再合并为 mp4
+type DASHDownloader struct {
+	client       ClientInterface
+	output       string
+	opts         *RequestOption
+	showProgress bool
+	urlPrefix    string // 不为空时代替 MPD 地址作为解析分片相对路径的基准
+	maxParallel  int
+	fragmented   bool
+
+	variantPolicy   VariantPolicy
+	renditionPolicy RenditionPolicy
+}
+
+// dashTrack 是一个选中的 Representation 及其展开后的分片
+type dashTrack struct {
+	set      *mpdAdaptationSet
+	rep      *mpdRepresentation
+	init     *dashSegment
+	segments []dashSegment
+	baseURL  string     // Representation 的基准地址
+	file     string     // 轨道临时文件路径
+	audio    *rendition // 音频轨道对应的音轨信息，视频轨道为 nil
+}
+
+func NewDASHDownloader(client ClientInterface, output string, opts *RequestOption, showProgress bool) *DASHDownloader {
+	return NewDASHDownloaderWithPrefix(client, output, opts, showProgress, "")
+}
+
+// NewDASHDownloaderWithPrefix 创建带前缀的 DASH 下载器
+func NewDASHDownloaderWithPrefix(client ClientInterface, output string, opts *RequestOption, showProgress bool, urlPrefix string) *DASHDownloader {
+	return &DASHDownloader{
+		client:          client,
+		output:          output,
+		opts:            opts,
+		showProgress:    showProgress,
+		urlPrefix:       urlPrefix,
+		maxParallel:     client.GetDownloadOption().MaxParallel,
+		fragmented:      client.GetDownloadOption().FragmentedMP4,
+		variantPolicy:   newVariantPolicy(client.GetDownloadOption().VariantPolicy),
+		renditionPolicy: newRenditionPolicy(client.GetDownloadOption()),
+	}
+}
+
+// DownloadFromURL 下载 DASH 点播流并合并为 mp4，ctx 取消时保留各轨道的临时文件和断点续传状态
+func (d *DASHDownloader) DownloadFromURL(ctx context.Context, mpdURL string) (*Result, error) {
+	log.Printf("Starting download from URL: %s", mpdURL)
+
+	manifest, err := d.fetchManifest(ctx, mpdURL)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Type == "dynamic" {
+		return nil, fmt.Errorf("live DASH streams are not supported")
+	}
+	if len(manifest.Periods) > 1 {
+		return nil, fmt.Errorf("multi-period mpd is not supported (%d periods)", len(manifest.Periods))
+	}
+	period := &manifest.Periods[0]
+
+	periodDuration, err := d.periodDuration(manifest, period)
+	if err != nil {
+		return nil, err
+	}
+
+	base := mpdURL
+	if d.urlPrefix != "" {
+		base = strings.TrimSuffix(d.urlPrefix, "/") + "/"
+	}
+	periodBase, err := resolveBaseURL(base, manifest.BaseURL, period.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve base URL: %w", err)
+	}
+
+	video, selection, err := d.selectVideo(period)
+	if err != nil {
+		return nil, err
+	}
+	audios := d.selectAudio(period)
+	if len(audios) > 0 {
+		// DASH 的轨道都是 fMP4，内置转封装器不能混流，在下载前确认 ffmpeg 可用
+		if err := checkFFmpeg("mux DASH audio tracks"); err != nil {
+			return nil, err
+		}
+	}
+
+	tracks := append([]*dashTrack{video}, audios...)
+	for i, track := range tracks {
+		if err := d.expandTrack(ctx, track, periodBase, periodDuration); err != nil {
+			return nil, fmt.Errorf("failed to expand representation %s: %w", track.rep.ID, err)
+		}
+		if track.audio == nil {
+			track.file = d.output + ".video.mp4"
+		} else {
+			track.file = fmt.Sprintf("%s.audio%d.mp4", d.output, i-1)
+			track.audio.url = track.baseURL
+			track.audio.path = track.file
+		}
+	}
+
+	defer func() {
+		if ctx.Err() != nil {
+			log.Printf("Download interrupted, keeping partial data for resume: %s", d.output)
+			return
+		}
+		for _, track := range tracks {
+			os.Remove(track.file)
+		}
+	}()
+
+	for _, track := range tracks {
+		log.Printf("Downloading representation %s (%d segments)", track.rep.ID, len(track.segments))
+		if err := d.downloadTrack(ctx, track); err != nil {
+			return nil, fmt.Errorf("failed to download representation %s: %w", track.rep.ID, err)
+		}
+	}
+
+	var renditions []*rendition
+	var infos []RenditionInfo
+	for _, track := range audios {
+		renditions = append(renditions, track.audio)
+		infos = append(infos, track.audio.info(false))
+	}
+
+	log.Printf("Starting conversion to mp4...")
+	if err := convertToMP4(video.file, d.output, renditions, d.fragmented); err != nil {
+		return nil, fmt.Errorf("failed to convert dash tracks to mp4: %w", err)
+	}
+	log.Printf("Conversion to MP4 completed successfully")
+
+	return &Result{
+		Path:       mp4Path(d.output),
+		Variant:    selection,
+		Renditions: infos,
+	}, nil
+}
+
+func (d *DASHDownloader) fetchManifest(ctx context.Context, mpdURL string) (*mpdManifest, error) {
+	resp, err := d.client.GetStream(ctx, "GET", mpdURL, d.opts, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mpd: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get mpd: unexpected status code %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mpd: %w", err)
+	}
+	return parseMPD(data)
+}
+
+// periodDuration 返回 Period 的时长（秒），未指定时使用整个节目的时长
+func (d *DASHDownloader) periodDuration(manifest *mpdManifest, period *mpdPeriod) (float64, error) {
+	duration := period.Duration
+	if duration == "" {
+		duration = manifest.MediaPresentationDuration
+	}
+	if duration == "" {
+		return 0, nil
+	}
+	return parseISODuration(duration)
+}
+
+// selectVideo 按变体选择策略从所有视频 Representation 中选择一个
+func (d *DASHDownloader) selectVideo(period *mpdPeriod) (*dashTrack, *VariantSelection, error) {
+	var sets []*mpdAdaptationSet
+	var reps []*mpdRepresentation
+	var variants []*m3u8.Variant
+	for i := range period.AdaptationSets {
+		set := &period.AdaptationSets[i]
+		if set.kind() != "video" {
+			continue
+		}
+		for j := range set.Representations {
+			rep := &set.Representations[j]
+			variant := &m3u8.Variant{URI: rep.ID}
+			variant.Bandwidth = rep.Bandwidth
+			variant.Codecs = firstNonEmpty(rep.Codecs, set.Codecs)
+			if rep.Width > 0 && rep.Height > 0 {
+				variant.Resolution = fmt.Sprintf("%dx%d", rep.Width, rep.Height)
+			}
+			sets = append(sets, set)
+			reps = append(reps, rep)
+			variants = append(variants, variant)
+		}
+	}
+	if len(variants) == 0 {
+		return nil, nil, fmt.Errorf("no video representation found in mpd")
+	}
+
+	selected, selection, err := d.variantPolicy.Select(variants)
+	if err != nil {
+		return nil, nil, err
+	}
+	index := selection.Selected.Position
+	if err := checkProtection(sets[index], reps[index]); err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Selected video representation %s (policy %s): bandwidth %d, resolution %s",
+		selected.URI, selection.Policy, selected.Bandwidth, selected.Resolution)
+	return &dashTrack{set: sets[index], rep: reps[index]}, selection, nil
+}
+
+// selectAudio 按音轨选择条件选择音频 AdaptationSet，每个 AdaptationSet 使用码率最高的 Representation
+func (d *DASHDownloader) selectAudio(period *mpdPeriod) []*dashTrack {
+	variant := &m3u8.Variant{}
+	candidates := make(map[*m3u8.Alternative]*mpdAdaptationSet)
+	for i := range period.AdaptationSets {
+		set := &period.AdaptationSets[i]
+		if set.kind() != "audio" || len(set.Representations) == 0 {
+			continue
+		}
+		alt := &m3u8.Alternative{
+			Type:     renditionAudio,
+			Language: set.Lang,
+			Name:     firstNonEmpty(set.Label, set.ID),
+			Default:  set.isMain(),
+			URI:      set.ID,
+		}
+		if alt.URI == "" {
+			alt.URI = strconv.Itoa(i)
+		}
+		variant.Alternatives = append(variant.Alternatives, alt)
+		candidates[alt] = set
+	}
+
+	var tracks []*dashTrack
+	for _, alt := range d.renditionPolicy.Select(variant) {
+		set := candidates[alt]
+		best := &set.Representations[0]
+		for j := range set.Representations {
+			if set.Representations[j].Bandwidth > best.Bandwidth {
+				best = &set.Representations[j]
+			}
+		}
+		if err := checkProtection(set, best); err != nil {
+			log.Printf("Warning: skipping audio adaptation set %q: %v", alt.Name, err)
+			continue
+		}
+		log.Printf("Selected audio representation %s (%s), bandwidth %d", best.ID, alt.Language, best.Bandwidth)
+		tracks = append(tracks, &dashTrack{set: set, rep: best, audio: &rendition{alt: alt}})
+	}
+	return tracks
+}
+
+// checkProtection 拒绝带 DRM 保护的轨道
+func checkProtection(set *mpdAdaptationSet, rep *mpdRepresentation) error {
+	if len(set.ContentProtection) > 0 || len(rep.ContentProtection) > 0 {
+		return fmt.Errorf("representation %s is DRM-protected", rep.ID)
+	}
+	return nil
+}
+
+// expandTrack 展开轨道的分片地址，寻址方式的优先级为 SegmentTemplate、SegmentList、SegmentBase
+func (d *DASHDownloader) expandTrack(ctx context.Context, track *dashTrack, periodBase string, periodDuration float64) error {
+	set := track.set
+	baseURL, err := resolveBaseURL(periodBase, set.BaseURL, track.rep.BaseURL)
+	if err != nil {
+		return err
+	}
+	track.baseURL = baseURL
+
+	switch {
+	case track.rep.SegmentTemplate != nil || set.SegmentTemplate != nil:
+		tmpl := mergeSegmentTemplate(set.SegmentTemplate, track.rep.SegmentTemplate)
+		track.init, track.segments, err = templateSegments(tmpl, track.rep, baseURL, periodDuration)
+	case track.rep.SegmentList != nil || set.SegmentList != nil:
+		list := track.rep.SegmentList
+		if list == nil {
+			list = set.SegmentList
+		}
+		track.init, track.segments, err = listSegments(list, baseURL)
+	case track.rep.SegmentBase != nil || set.SegmentBase != nil:
+		segBase := track.rep.SegmentBase
+		if segBase == nil {
+			segBase = set.SegmentBase
+		}
+		track.init, track.segments, err = d.baseSegments(ctx, segBase, baseURL)
+	default:
+		// 只有 BaseURL，整个文件就是一个分片
+		track.segments = []dashSegment{{url: baseURL}}
+	}
+	if err != nil {
+		return err
+	}
+	if len(track.segments) == 0 {
+		return fmt.Errorf("no segments found")
+	}
+	return nil
+}
+
+// mergeSegmentTemplate 用 Representation 上的 SegmentTemplate 覆盖 AdaptationSet 上的同名属性
+func mergeSegmentTemplate(parent, child *mpdSegmentTemplate) *mpdSegmentTemplate {
+	if parent == nil {
+		return child
+	}
+	if child == nil {
+		return parent
+	}
+	merged := *parent
+	if child.Media != "" {
+		merged.Media = child.Media
+	}
+	if child.Initialization != "" {
+		merged.Initialization = child.Initialization
+	}
+	if child.StartNumber != nil {
+		merged.StartNumber = child.StartNumber
+	}
+	if child.Timescale != nil {
+		merged.Timescale = child.Timescale
+	}
+	if child.Duration > 0 {
+		merged.Duration = child.Duration
+	}
+	if child.PresentationTimeOffset > 0 {
+		merged.PresentationTimeOffset = child.PresentationTimeOffset
+	}
+	if child.Timeline != nil {
+		merged.Timeline = child.Timeline
+	}
+	return &merged
+}
+
+// baseSegments 处理 SegmentBase：下载 indexRange 指向的 sidx，按其中的引用拆分为字节范围分片
+func (d *DASHDownloader) baseSegments(ctx context.Context, segBase *mpdSegmentBase, baseURL string) (*dashSegment, []dashSegment, error) {
+	var init *dashSegment
+	if segBase.Initialization != nil {
+		seg, err := rangedSegment(baseURL, segBase.Initialization.SourceURL, segBase.Initialization.Range)
+		if err != nil {
+			return nil, nil, err
+		}
+		init = &seg
+	}
+
+	indexRange, err := parseMPDRange(segBase.IndexRange)
+	if err != nil {
+		return nil, nil, err
+	}
+	if indexRange == nil {
+		// 没有索引时整个文件作为一个分片，其中已包含初始化段
+		return nil, []dashSegment{{url: baseURL}}, nil
+	}
+
+	index, err := d.fetchRange(ctx, baseURL, indexRange)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch segment index: %w", err)
+	}
+	ranges, err := parseSidx(index, indexRange.end)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	segments := make([]dashSegment, 0, len(ranges))
+	for i := range ranges {
+		segments = append(segments, dashSegment{url: baseURL, byteRange: &ranges[i]})
+	}
+
+	// 未指定 Initialization 时，文件开头到索引结束的部分就是初始化段
+	if init == nil {
+		init = &dashSegment{url: baseURL, byteRange: &byteRange{start: 0, end: indexRange.end}}
+	}
+	return init, segments, nil
+}
+
+// fetchRange 下载文件的一个字节范围
+func (d *DASHDownloader) fetchRange(ctx context.Context, url string, r *byteRange) ([]byte, error) {
+	resp, err := d.client.GetStream(ctx, "GET", url, d.opts, map[string]string{"Range": r.header()})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return io.ReadAll(io.LimitReader(resp.Body, r.end-r.start+1))
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, r.start); err != nil {
+			return nil, err
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, r.end-r.start+1))
+	default:
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
+
+// downloadTrack 下载一个轨道的初始化段和全部分片，断点续传状态保存在轨道文件旁边
+func (d *DASHDownloader) downloadTrack(ctx context.Context, track *dashTrack) error {
+	stateFile := track.file + ".state.json"
+	segmentDir := track.file + ".segments"
+	defer func() {
+		if ctx.Err() == nil {
+			os.Remove(stateFile)
+			os.RemoveAll(segmentDir)
+		}
+	}()
+
+	segments := track.segments
+	if track.init != nil {
+		segments = append([]dashSegment{*track.init}, segments...)
+	}
+
+	jobs := make([]segmentJob, 0, len(segments))
+	for _, seg := range segments {
+		key := seg.url
+		if seg.byteRange != nil {
+			key += "@" + seg.byteRange.String()
+		}
+		jobs = appendJob(jobs, segmentJob{
+			key:       key,
+			url:       seg.url,
+			byteRange: seg.byteRange,
+		})
+	}
+
+	var flags int
+	if _, err := os.Stat(track.file); err == nil {
+		flags = os.O_WRONLY | os.O_APPEND
+		log.Printf("Resuming download to existing temp file: %s", track.file)
+	} else {
+		flags = os.O_CREATE | os.O_WRONLY
+	}
+	outFile, err := os.OpenFile(track.file, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create/open temp file: %w", err)
+	}
+	defer outFile.Close()
+
+	if err := os.MkdirAll(segmentDir, 0755); err != nil {
+		return fmt.Errorf("failed to create segment directory: %w", err)
+	}
+	pool := newSegmentPool(d.client, d.opts, segmentDir, d.maxParallel)
+
+	var progressName string
+	if d.showProgress {
+		progressName = path.Base(track.file)
+	}
+	return pool.download(ctx, jobs, outFile, stateFile, progressName)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
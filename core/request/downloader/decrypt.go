@@ -0,0 +1,170 @@
+package downloader
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	encryptionAES128    = "AES-128"
+	encryptionSampleAES = "SAMPLE-AES"
+)
+
+// segmentEncryption 描述分片的加密方式，由 EXT-X-KEY 得到
+type segmentEncryption struct {
+	method string // AES-128 或 SAMPLE-AES
+	uri    string // 密钥的完整 URL
+	iv     []byte
+}
+
+// newSegmentEncryption 根据 EXT-X-KEY 构造加密信息，未指定 IV 时使用媒体序列号作为 IV
+func newSegmentEncryption(key *m3u8.Key, keyURL string, seqID uint64) (*segmentEncryption, error) {
+	method := strings.ToUpper(key.Method)
+	if method != encryptionAES128 && method != encryptionSampleAES {
+		return nil, fmt.Errorf("unsupported encryption method: %s", key.Method)
+	}
+	if key.Keyformat != "" && key.Keyformat != "identity" {
+		return nil, fmt.Errorf("unsupported key format: %s", key.Keyformat)
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if key.IV != "" {
+		raw := strings.TrimPrefix(strings.TrimPrefix(key.IV, "0x"), "0X")
+		if len(raw)%2 != 0 {
+			raw = "0" + raw
+		}
+		decoded, err := hex.DecodeString(raw)
+		if err != nil || len(decoded) > aes.BlockSize {
+			return nil, fmt.Errorf("invalid IV: %s", key.IV)
+		}
+		copy(iv[aes.BlockSize-len(decoded):], decoded)
+	} else {
+		binary.BigEndian.PutUint64(iv[8:], seqID)
+	}
+
+	return &segmentEncryption{
+		method: method,
+		uri:    keyURL,
+		iv:     iv,
+	}, nil
+}
+
+// keyCache 缓存已下载的密钥，密钥轮换时每个 URI 只请求一次。
+// 请求密钥时不持有锁，等待同一个密钥的分片不会阻塞使用其他密钥的分片。
+type keyCache struct {
+	client ClientInterface
+	opts   *RequestOption
+	mu     sync.Mutex
+	keys   map[string]*keyFetch
+}
+
+// keyFetch 是一次密钥请求，done 关闭后 key 和 err 可用
+type keyFetch struct {
+	done chan struct{}
+	key  []byte
+	err  error
+}
+
+func newKeyCache(client ClientInterface, opts *RequestOption) *keyCache {
+	return &keyCache{
+		client: client,
+		opts:   opts,
+		keys:   make(map[string]*keyFetch),
+	}
+}
+
+func (c *keyCache) get(ctx context.Context, uri string) ([]byte, error) {
+	c.mu.Lock()
+	if f, ok := c.keys[uri]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.key, f.err
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+	f := &keyFetch{done: make(chan struct{})}
+	c.keys[uri] = f
+	c.mu.Unlock()
+
+	f.key, f.err = c.fetch(ctx, uri)
+	if f.err != nil {
+		// 失败不缓存，分片重试时重新请求
+		c.mu.Lock()
+		delete(c.keys, uri)
+		c.mu.Unlock()
+	}
+	close(f.done)
+	return f.key, f.err
+}
+
+// fetch 下载一个 16 字节的 AES 密钥
+func (c *keyCache) fetch(ctx context.Context, uri string) ([]byte, error) {
+	resp, err := c.client.GetStream(ctx, "GET", uri, c.opts, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key %s: %w", uri, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch key %s: unexpected status code %d", uri, resp.StatusCode)
+	}
+
+	key, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %w", uri, err)
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid key length %d from %s", len(key), uri)
+	}
+	return key, nil
+}
+
+// decrypt 解密一个完整的分片
+func (e *segmentEncryption) decrypt(data, key []byte) ([]byte, error) {
+	switch e.method {
+	case encryptionAES128:
+		return decryptAES128(data, key, e.iv)
+	case encryptionSampleAES:
+		return decryptSampleAES(data, key, e.iv)
+	default:
+		return nil, fmt.Errorf("unsupported encryption method: %s", e.method)
+	}
+}
+
+// decryptAES128 使用 AES-128-CBC 解密整个分片并去除 PKCS7 填充
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted segment size %d is not a multiple of the block size", len(data))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding < 1 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("invalid padding")
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
@@ -0,0 +1,251 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// NIST SP 800-38A F.2.1 CBC-AES128 的密钥和 IV
+var (
+	nistKey = mustHex("2b7e151628aed2a6abf7158809cf4f3c")
+	nistIV  = mustHex("000102030405060708090a0b0c0d0e0f")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestNewSegmentEncryption(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     m3u8.Key
+		seq     uint64
+		wantIV  string
+		wantErr bool
+	}{
+		{"iv from media sequence", m3u8.Key{Method: "AES-128"}, 5, "00000000000000000000000000000005", false},
+		{"explicit iv", m3u8.Key{Method: "AES-128", IV: "0x000102030405060708090A0B0C0D0E0F"}, 5, "000102030405060708090a0b0c0d0e0f", false},
+		{"short explicit iv", m3u8.Key{Method: "aes-128", IV: "0x1"}, 5, "00000000000000000000000000000001", false},
+		{"sample-aes", m3u8.Key{Method: "SAMPLE-AES", Keyformat: "identity"}, 1, "00000000000000000000000000000001", false},
+		{"invalid iv", m3u8.Key{Method: "AES-128", IV: "0xZZ"}, 0, "", true},
+		{"iv too long", m3u8.Key{Method: "AES-128", IV: "0x" + strings.Repeat("00", 17)}, 0, "", true},
+		{"unsupported method", m3u8.Key{Method: "AES-256"}, 0, "", true},
+		{"unsupported key format", m3u8.Key{Method: "SAMPLE-AES", Keyformat: "com.apple.streamingkeydelivery"}, 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newSegmentEncryption(&tt.key, "https://example.com/key", tt.seq)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got IV %x, want an error", e.iv)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := hex.EncodeToString(e.iv); got != tt.wantIV {
+				t.Errorf("IV = %s, want %s", got, tt.wantIV)
+			}
+		})
+	}
+}
+
+func TestDecryptAES128(t *testing.T) {
+	seqIV := mustHex("00000000000000000000000000000005")
+	tests := []struct {
+		name       string
+		ciphertext string
+		iv         []byte
+		want       string
+		wantErr    bool
+	}{
+		// 第一个块是 NIST 的测试向量，第二个块是完整的 PKCS7 填充块
+		{"nist block with full padding", "7649abac8119b246cee98e9b12e9197d8964e0b149c10b7b682e6e39aaeb731c", nistIV, "6bc1bee22e409f96e93d7e117393172a", false},
+		{"iv from media sequence", "0bea3bab875a44472d53da0f5621e7eb", seqIV, hex.EncodeToString([]byte("segment 5")), false},
+		{"wrong iv", "0bea3bab875a44472d53da0f5621e7eb", nistIV, "", true},
+		{"zero padding", "5027419bd2a55c2af4cc2fb31fd2a385", nistIV, "", true},
+		{"padding longer than a block", "5c05f3b463ca965a75d2c0dba814f67a", nistIV, "", true},
+		{"inconsistent padding bytes", "f66092353093c259e17080ed6c0e20a0", nistIV, "", true},
+		{"partial block", "7649abac8119b246cee98e9b12e919", nistIV, "", true},
+		{"empty", "", nistIV, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptAES128(mustHex(tt.ciphertext), nistKey, tt.iv)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %x, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("got %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// encryptAES128 按 HLS AES-128 的方式加密分片：CBC 加 PKCS7 填充
+func encryptAES128(t *testing.T, plaintext, key, iv []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	data := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+func TestSegmentKeyRotation(t *testing.T) {
+	keys := map[string][]byte{
+		"/k1.key": nistKey,
+		"/k2.key": mustHex("000102030405060708090a0b0c0d0e0f"),
+	}
+	seq := func(n byte) []byte { return append(make([]byte, 15), n) }
+	// 第一个密钥没有 IV，使用媒体序号；轮换后的密钥使用显式 IV
+	segments := map[string][]byte{
+		"/0.ts": encryptAES128(t, []byte("first"), keys["/k1.key"], seq(10)),
+		"/1.ts": encryptAES128(t, []byte("second"), keys["/k1.key"], seq(11)),
+		"/2.ts": encryptAES128(t, []byte("third"), keys["/k2.key"], nistIV),
+		"/3.ts": encryptAES128(t, []byte("fourth"), keys["/k2.key"], nistIV),
+	}
+	var keyRequests sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := keys[r.URL.Path]; ok {
+			n, _ := keyRequests.LoadOrStore(r.URL.Path, new(int32))
+			atomic.AddInt32(n.(*int32), 1)
+			w.Write(key)
+			return
+		}
+		w.Write(segments[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	const playlist = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-KEY:METHOD=AES-128,URI="k1.key"
+#EXTINF:10,
+0.ts
+#EXTINF:10,
+1.ts
+#EXT-X-KEY:METHOD=AES-128,URI="k2.key",IV=0x000102030405060708090a0b0c0d0e0f
+#EXTINF:10,
+2.ts
+#EXTINF:10,
+3.ts
+#EXT-X-ENDLIST
+`
+	p, _, err := m3u8.DecodeFrom(strings.NewReader(playlist), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &M3U8Downloader{playlistURL: srv.URL + "/index.m3u8"}
+	jobs, err := m.segmentJobs(p.(*m3u8.MediaPlaylist))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	pool := newSegmentPool(&testClient{retries: 1}, nil, t.TempDir(), 4)
+	if err := pool.download(context.Background(), jobs, out, out.Name()+".state", ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out.Name()); string(data) != "firstsecondthirdfourth" {
+		t.Errorf("got %q", data)
+	}
+	for uri := range keys {
+		if n, _ := keyRequests.Load(uri); n == nil || atomic.LoadInt32(n.(*int32)) != 1 {
+			t.Errorf("key %s was not requested exactly once", uri)
+		}
+	}
+}
+
+func TestKeyCacheDoesNotBlockOtherKeys(t *testing.T) {
+	release := make(chan struct{})
+	var slowRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.key" {
+			atomic.AddInt32(&slowRequests, 1)
+			<-release
+		}
+		w.Write(nistKey)
+	}))
+	defer srv.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	ctx := context.Background()
+	cache := newKeyCache(&testClient{}, nil)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.get(ctx, srv.URL+"/slow.key")
+			errs <- err
+		}()
+	}
+
+	// 慢密钥还在请求中时，其他密钥可以正常获取
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.get(ctx, srv.URL+"/fast.key")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetching another key blocked behind the slow key")
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := atomic.LoadInt32(&slowRequests); n != 1 {
+		t.Errorf("slow key requested %d times, want 1", n)
+	}
+}
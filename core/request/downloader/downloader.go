@@ -1,6 +1,7 @@
 package downloader
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,17 +10,22 @@ import (
 	"strings"
 	"time"
 
+	"MediaNinja/core/request/retry"
 	"MediaNinja/core/request/types"
 )
 
 type RequestOption = types.RequestOption
 type ClientInterface = types.ClientInterface
+type DownloadOption = types.DownloadOption
+type Result = types.DownloadResult
 
 type Downloader struct {
 	client ClientInterface
 
-	maxRetries int
-	retryDelay time.Duration
+	maxRetries  int
+	retryDelay  time.Duration
+	connections int           // 普通文件的并发连接数
+	fileTimeout time.Duration // 单个文件下载的总时长上限
 
 	showProgress bool
 }
@@ -29,119 +35,224 @@ func NewDownloader(client ClientInterface, showProgress bool) *Downloader {
 		client:       client,
 		maxRetries:   client.GetMaxRetries(),
 		retryDelay:   client.GetRetryDelay(),
+		connections:  client.GetDownloadOption().Connections,
+		fileTimeout:  time.Duration(client.GetDownloadOption().FileTimeout) * time.Second,
 		showProgress: showProgress,
 	}
 }
 
-// DownloadFile downloads a file from URL to the specified filepath
-func (d *Downloader) DownloadFile(url string, filepath string, opts *RequestOption) error {
+// DownloadFile downloads a file from URL to the specified filepath.
+// When ctx is cancelled or the file deadline passes, partial data and resume state are kept for the next run.
+func (d *Downloader) DownloadFile(ctx context.Context, url string, filepath string, opts *RequestOption) (*Result, error) {
 	if err := os.MkdirAll(path.Dir(filepath), 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
 
-	fmt.Println("DownloadFile", url)
 	// 检查是否是 M3U8 文件
 	if strings.Contains(strings.ToLower(url), ".m3u8") {
-		fmt.Println("DownloadFile is M3U8")
 		// 使用新的 M3U8 下载器，传入 showProgress 参数
 		m3u8Downloader := NewM3U8Downloader(d.client, filepath, opts, d.showProgress)
-		return m3u8Downloader.DownloadFromURL(url)
+		return m3u8Downloader.DownloadFromURL(ctx, url)
 	}
 
-	return d.downloadRegularFile(url, filepath, opts)
+	// 检查是否是 DASH 清单
+	if strings.Contains(strings.ToLower(url), ".mpd") {
+		dashDownloader := NewDASHDownloader(d.client, filepath, opts, d.showProgress)
+		return dashDownloader.DownloadFromURL(ctx, url)
+	}
+
+	finalPath, err := d.downloadRegularFile(ctx, url, filepath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Path: finalPath}, nil
 }
 
 // DownloadFileWithPrefix downloads a file from URL to the specified filepath with URL prefix support
-func (d *Downloader) DownloadFileWithPrefix(url string, filepath string, opts *RequestOption, urlPrefix string) error {
+func (d *Downloader) DownloadFileWithPrefix(ctx context.Context, url string, filepath string, opts *RequestOption, urlPrefix string) (*Result, error) {
 	if err := os.MkdirAll(path.Dir(filepath), 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
 
-	fmt.Println("DownloadFileWithPrefix", url, "prefix:", urlPrefix)
 	// 检查是否是 M3U8 文件
 	if strings.Contains(strings.ToLower(url), ".m3u8") {
-		fmt.Println("DownloadFileWithPrefix is M3U8")
 		// 使用带前缀的 M3U8 下载器
 		m3u8Downloader := NewM3U8DownloaderWithPrefix(d.client, filepath, opts, d.showProgress, urlPrefix)
-		return m3u8Downloader.DownloadFromURL(url)
+		return m3u8Downloader.DownloadFromURL(ctx, url)
 	}
 
-	return d.downloadRegularFile(url, filepath, opts)
+	// 检查是否是 DASH 清单
+	if strings.Contains(strings.ToLower(url), ".mpd") {
+		dashDownloader := NewDASHDownloaderWithPrefix(d.client, filepath, opts, d.showProgress, urlPrefix)
+		return dashDownloader.DownloadFromURL(ctx, url)
+	}
+
+	finalPath, err := d.downloadRegularFile(ctx, url, filepath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Path: finalPath}, nil
 }
 
-func (d *Downloader) downloadRegularFile(url string, filepath string, opts *RequestOption) error {
-	var attempt int
-	for attempt = 0; attempt < d.maxRetries; attempt++ {
-		if attempt > 0 {
-			time.Sleep(d.retryDelay)
-		}
+// withDeadline applies the overall per-file deadline, if one is configured
+func (d *Downloader) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.fileTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, d.fileTimeout, fmt.Errorf("download did not finish within %s", d.fileTimeout))
+}
+
+// sleepContext waits for delay, returning early with the cause when ctx is done
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
+
+// downloadRegularFile downloads url next to filepath and returns the final path,
+// which may differ from filepath when the server supplies a name or the extension is corrected
+func (d *Downloader) downloadRegularFile(ctx context.Context, url string, filepath string, opts *RequestOption) (string, error) {
+	// Downloads are written to a .part file and only moved into place once verified,
+	// so an existing file at the final path is a finished download
+	if existing, ok := existingDownload(filepath); ok {
+		fmt.Printf("File %s already exists, skipping download\n", existing)
+		return existing, nil
+	}
 
-		// Get file info for resume download
-		var startPos int64 = 0
-		fi, err := os.Stat(filepath)
-		if err == nil {
-			startPos = fi.Size()
+	// 服务器支持 Range 时分块并发下载，否则回退到单连接
+	if d.connections > 1 {
+		if handled, finalPath, err := d.downloadParallel(ctx, url, filepath, opts); handled {
+			return finalPath, err
 		}
+	}
 
-		// Prepare headers for resume
-		var headers map[string]string
-		if startPos > 0 {
-			headers = map[string]string{
-				"Range": fmt.Sprintf("bytes=%d-", startPos),
+	// Each attempt resumes from the .part file, so retries only fetch what is still missing
+	var finalPath string
+	err := d.retryPolicy().Do(ctx, func() (err error) {
+		finalPath, err = d.downloadOnce(ctx, url, filepath, opts)
+		return err
+	}, func(attempt int, err error, delay time.Duration) {
+		fmt.Printf("Download attempt %d failed (%s): %v, retrying in %s\n", attempt, retry.Classify(err), err, delay.Round(time.Millisecond))
+	})
+	if err == nil {
+		return finalPath, nil
+	}
+	if ctx.Err() != nil {
+		// The .part file and its manifest stay on disk so the next run resumes from here
+		return "", fmt.Errorf("download interrupted, progress saved in %s: %w", partPath(filepath), context.Cause(ctx))
+	}
+	return "", fmt.Errorf("download failed: %w", err)
+}
+
+// retryPolicy returns the shared retry policy built from the client's retry settings
+func (d *Downloader) retryPolicy() retry.Policy {
+	return retry.NewPolicy(d.maxRetries, d.retryDelay)
+}
+
+// downloadOnce makes a single attempt into the .part file. It resumes from the size of the
+// .part file when its manifest exists, using If-Range so that a changed remote file restarts the download.
+func (d *Downloader) downloadOnce(ctx context.Context, url string, filepath string, opts *RequestOption) (string, error) {
+	manifestFile := manifestPath(filepath)
+	manifest := loadPartManifest(manifestFile)
+
+	// Get file info for resume download, a .part file without a manifest can't be trusted
+	var startPos int64 = 0
+	if fi, err := os.Stat(partPath(filepath)); err == nil && manifest != nil && manifest.URL == url {
+		startPos = fi.Size()
+		if manifest.Chunks != nil {
+			// A multi-connection download preallocated the whole file, only the chunks written
+			// without gaps from the start can be resumed over a single connection
+			startPos = manifest.contiguousSize()
+			if err := os.Truncate(partPath(filepath), startPos); err != nil {
+				return "", fmt.Errorf("failed to truncate partial download: %w", err)
+			}
+			manifest.Chunks = nil
+			if err := savePartManifest(manifestFile, manifest); err != nil {
+				return "", fmt.Errorf("failed to save download manifest: %w", err)
 			}
 		}
+	}
 
-		// Get response stream
-		resp, err := d.client.GetStream("GET", url, opts, headers)
-		if err != nil {
-			if attempt < d.maxRetries-1 {
-				fmt.Printf("Download attempt %d failed: %v, retrying...\n", attempt+1, err)
-				continue
-			}
-			return fmt.Errorf("failed to send request after %d attempts: %w", d.maxRetries, err)
+	// Prepare headers for resume
+	var headers map[string]string
+	if startPos > 0 {
+		headers = manifest.rangeHeaders(startPos, -1)
+	}
+
+	// Get response stream
+	resp, err := d.client.GetStream(ctx, "GET", url, opts, headers)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status. The total size is -1 until the server tells us,
+	// chunked responses may only reveal it later through Content-Range on a resumed request.
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if startPos > 0 {
+			fmt.Printf("Remote file %s changed or resume is not supported, restarting download\n", url)
 		}
-		defer resp.Body.Close()
-
-		// Check response status
-		switch resp.StatusCode {
-		case http.StatusOK:
-			startPos = 0
-		case http.StatusPartialContent:
-			// Server supports resume
-		case http.StatusRequestedRangeNotSatisfiable:
-			return nil
-		default:
-			if attempt < d.maxRetries-1 {
-				fmt.Printf("Download attempt %d failed with status code %d, retrying...\n", attempt+1, resp.StatusCode)
-				continue
+		startPos = 0
+		size := int64(-1)
+		if resp.ContentLength >= 0 {
+			size = resp.ContentLength
+		}
+		manifest = newPartManifest(url, resp, size)
+	case http.StatusPartialContent:
+		// Server supports resume
+		start, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if ok && start != startPos {
+			return "", fmt.Errorf("server resumed at byte %d instead of %d", start, startPos)
+		}
+		if ok && total >= 0 {
+			if manifest.Size >= 0 && manifest.Size != total {
+				removePartFile(filepath)
+				return "", errRemoteChanged
 			}
-			return fmt.Errorf("unexpected status code after %d attempts: %d", d.maxRetries, resp.StatusCode)
+			manifest.Size = total
 		}
-
-		if success := d.processDownload(resp, filepath, startPos); success {
-			return nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The .part file already covers the whole resource, verification decides whether it is intact
+		if manifest == nil {
+			return "", retry.NewStatusError(resp)
 		}
+		return finishPartFile(filepath, manifest)
+	default:
+		return "", retry.NewStatusError(resp)
 	}
 
-	return fmt.Errorf("download failed after %d attempts", d.maxRetries)
-}
-
-func (d *Downloader) processDownload(resp *http.Response, filepath string, startPos int64) bool {
-	// Get file total size
-	contentLength := resp.ContentLength
-	if contentLength <= 0 {
-		return false
+	if err := savePartManifest(manifestFile, manifest); err != nil {
+		return "", fmt.Errorf("failed to save download manifest: %w", err)
+	}
+	if err := d.processDownload(resp, filepath, startPos, manifest.Size); err != nil {
+		return "", err
 	}
-	totalSize := startPos + contentLength
+	return finishPartFile(filepath, manifest)
+}
 
-	// Open or create file
+// processDownload writes the response body to the .part file of filepath starting at startPos.
+// totalSize is -1 when unknown; the download is then complete when the body ends with a clean EOF.
+func (d *Downloader) processDownload(resp *http.Response, filepath string, startPos, totalSize int64) error {
+	// Open or create file, a full response replaces whatever was there
 	flags := os.O_CREATE | os.O_WRONLY
 	if startPos > 0 {
 		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
 	}
-	file, err := os.OpenFile(filepath, flags, 0644)
+	file, err := os.OpenFile(partPath(filepath), flags, 0644)
 	if err != nil {
-		return false
+		return fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
@@ -150,35 +261,41 @@ func (d *Downloader) processDownload(resp *http.Response, filepath string, start
 	if d.showProgress {
 		progress = NewDownloadProgress(path.Base(filepath), totalSize, startPos)
 	}
+	fail := func(err error) error {
+		if progress != nil {
+			progress.Fail(err)
+		}
+		return err
+	}
 
 	// Use buffered reading for better performance
 	bufSize := 32 * 1024 // 32KB buffer
 	buf := make([]byte, bufSize)
 
+	written := startPos
 	for {
 		n, err := resp.Body.Read(buf)
 		if n > 0 {
 			if _, werr := file.Write(buf[:n]); werr != nil {
-				if progress != nil {
-					progress.Fail(werr)
-				}
-				return false
+				return fail(fmt.Errorf("failed to write file: %w", werr))
 			}
+			written += int64(n)
 			if progress != nil {
 				progress.Update(int64(n))
 			}
 		}
 		if err == io.EOF {
+			// A truncated chunked body ends with io.ErrUnexpectedEOF, so a clean EOF means the body is complete
+			if totalSize >= 0 && written != totalSize {
+				return fail(fmt.Errorf("connection closed after %d of %d bytes", written, totalSize))
+			}
 			if progress != nil {
 				progress.Success()
 			}
-			return true
+			return nil
 		}
 		if err != nil {
-			if progress != nil {
-				progress.Fail(err)
-			}
-			return false
+			return fail(fmt.Errorf("failed to read response body: %w", err))
 		}
 	}
 }
@@ -0,0 +1,184 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClient 直接使用 http.DefaultClient 发送请求
+type testClient struct {
+	option  DownloadOption
+	retries int
+}
+
+func (c *testClient) GetStream(ctx context.Context, method, url string, opts *RequestOption, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (c *testClient) Get(ctx context.Context, url string, opts *RequestOption) (string, error) {
+	return "", nil
+}
+func (c *testClient) GetProxy() string                  { return "" }
+func (c *testClient) GetMaxRetries() int                { return c.retries }
+func (c *testClient) GetRetryDelay() time.Duration      { return 0 }
+func (c *testClient) GetDownloadOption() DownloadOption { return c.option }
+
+func TestDownloadUnknownLength(t *testing.T) {
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(2)).Read(content)
+
+	// 第一次以 chunked 方式发送一半后断开连接，续传请求才返回带总大小的 206
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if first {
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(&testClient{retries: 2}, false)
+	target := filepath.Join(t.TempDir(), "video.mp4")
+	if _, err := d.DownloadFile(context.Background(), srv.URL+"/video.mp4", target, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, want %d bytes of source content", len(got), len(content))
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+}
+
+func TestDownloadIfRangeRestart(t *testing.T) {
+	content := []byte("new content of the remote file")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	// 上次运行下载的是旧版本文件的前半部分
+	url := srv.URL + "/video.mp4"
+	target := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(partPath(target), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePartManifest(manifestPath(target), &partManifest{URL: url, ETag: `"v1"`, Size: 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDownloader(&testClient{retries: 1}, false)
+	if _, err := d.DownloadFile(context.Background(), url, target, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %q, want %q", got, content)
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 摘要对应的是另一个文件
+		w.Header().Set("Repr-Digest", "sha-256=:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=:")
+		w.Write([]byte("corrupted"))
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(&testClient{retries: 1}, false)
+	target := filepath.Join(t.TempDir(), "video.mp4")
+	if _, err := d.DownloadFile(context.Background(), srv.URL+"/video.mp4", target, nil); err == nil {
+		t.Fatal("expected checksum error")
+	}
+	for _, leftover := range []string{target, partPath(target), manifestPath(target)} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist after a failed verification", leftover)
+		}
+	}
+}
+
+func TestDownloadCancelKeepsPartFile(t *testing.T) {
+	content := make([]byte, 128*1024)
+	rand.New(rand.NewSource(3)).Read(content)
+
+	// 第一次请求发送一半后卡住，直到客户端取消
+	sent := make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := false
+		once.Do(func() { first = true })
+		if first {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			close(sent)
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(&testClient{retries: 3}, false)
+	url := srv.URL + "/video.mp4"
+	target := filepath.Join(t.TempDir(), "video.mp4")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-sent
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := d.DownloadFile(ctx, url, target, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	for _, kept := range []string{partPath(target), manifestPath(target)} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("%s should be kept for resume: %v", kept, err)
+		}
+	}
+
+	if _, err := d.DownloadFile(context.Background(), url, target, nil); err != nil {
+		t.Fatalf("unexpected error on resume: %v", err)
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, want %d bytes of source content", len(got), len(content))
+	}
+}
@@ -0,0 +1,232 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"MediaNinja/utils/format"
+)
+
+const (
+	sniffLength  = 512 // 识别文件类型时读取的字节数，与 http.DetectContentType 一致
+	tsSyncOffset = 188 // 第二个 TS 包的同步字节位置
+)
+
+// mediaExtensions 列出每种类型可以接受的扩展名，第一个是默认扩展名
+var mediaExtensions = map[string][]string{
+	"image/jpeg":       {".jpg", ".jpeg", ".jpe", ".jfif"},
+	"image/png":        {".png"},
+	"image/gif":        {".gif"},
+	"image/webp":       {".webp"},
+	"image/avif":       {".avif"},
+	"image/heic":       {".heic", ".heif"},
+	"image/bmp":        {".bmp"},
+	"image/svg+xml":    {".svg"},
+	"video/mp4":        {".mp4", ".m4v"},
+	"video/quicktime":  {".mov"},
+	"video/webm":       {".webm"},
+	"video/x-matroska": {".mkv"},
+	"video/mp2t":       {".ts"},
+	"video/x-flv":      {".flv"},
+	"video/avi":        {".avi"},
+	"audio/mp4":        {".m4a"},
+	"audio/mpeg":       {".mp3"},
+	"audio/aac":        {".aac"},
+	"audio/wave":       {".wav"},
+	"application/ogg":  {".ogg"},
+	"application/pdf":  {".pdf"},
+	"application/zip":  {".zip"},
+}
+
+// typeAliases 把服务器常用的非标准类型映射到 mediaExtensions 中的类型
+var typeAliases = map[string]string{
+	"image/jpg":       "image/jpeg",
+	"image/pjpeg":     "image/jpeg",
+	"image/heif":      "image/heic",
+	"video/x-m4v":     "video/mp4",
+	"video/x-msvideo": "video/avi",
+	"audio/x-m4a":     "audio/mp4",
+	"audio/mp3":       "audio/mpeg",
+	"audio/wav":       "audio/wave",
+	"audio/x-wav":     "audio/wave",
+	"audio/ogg":       "application/ogg",
+	"video/ogg":       "application/ogg",
+}
+
+// scriptExtensions 是动态页面的扩展名，出现在下载的媒体文件上时应当替换掉
+var scriptExtensions = map[string]bool{
+	".php": true, ".asp": true, ".aspx": true, ".jsp": true, ".cgi": true, ".do": true, ".action": true,
+	".html": true, ".htm": true, ".bin": true,
+}
+
+// dispositionFilename 从 Content-Disposition 中取出文件名，RFC 5987 的 filename* 优先于 filename
+func dispositionFilename(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	// 去掉服务器给出的目录部分，只保留文件名
+	name := path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return format.SanitizeWindowsPath(name)
+}
+
+// normalizeContentType 返回 mediaExtensions 中的类型，未知类型返回空字符串
+func normalizeContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if alias, ok := typeAliases[mediaType]; ok {
+		mediaType = alias
+	}
+	if _, ok := mediaExtensions[mediaType]; !ok {
+		return ""
+	}
+	return mediaType
+}
+
+// sniffContentType 根据文件头识别类型，补充 http.DetectContentType 不认识的容器格式
+func sniffContentType(data []byte) string {
+	switch {
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		brands := string(data[8:min(len(data), 64)])
+		switch {
+		case strings.HasPrefix(brands, "avif"), strings.HasPrefix(brands, "avis"):
+			return "image/avif"
+		case strings.HasPrefix(brands, "heic"), strings.HasPrefix(brands, "heix"), strings.HasPrefix(brands, "mif1"):
+			return "image/heic"
+		case strings.HasPrefix(brands, "qt  "):
+			return "video/quicktime"
+		case strings.HasPrefix(brands, "M4A "):
+			return "audio/mp4"
+		}
+		return "video/mp4"
+	case bytes.HasPrefix(data, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		// EBML 头中的 DocType 区分 Matroska 和 WebM
+		if bytes.Contains(data[:min(len(data), 64)], []byte("matroska")) {
+			return "video/x-matroska"
+		}
+		return "video/webm"
+	case bytes.HasPrefix(data, []byte("FLV\x01")):
+		return "video/x-flv"
+	case len(data) > tsSyncOffset && data[0] == 0x47 && data[tsSyncOffset] == 0x47:
+		return "video/mp2t"
+	}
+	return normalizeContentType(http.DetectContentType(data))
+}
+
+// detectExtension 返回文件内容对应的扩展名，内容无法识别时参考 Content-Type
+func detectExtension(file string, contentType string) (string, []string) {
+	mediaType := ""
+	if f, err := os.Open(file); err == nil {
+		buf := make([]byte, sniffLength)
+		n, _ := f.Read(buf)
+		f.Close()
+		mediaType = sniffContentType(buf[:n])
+	}
+	if mediaType == "" {
+		mediaType = normalizeContentType(contentType)
+	}
+	if mediaType == "" {
+		return "", nil
+	}
+	exts := mediaExtensions[mediaType]
+	return exts[0], exts
+}
+
+// isKnownExtension 判断扩展名是否是已知的文件类型，而不是文件名中普通的点
+func isKnownExtension(ext string) bool {
+	ext = strings.ToLower(ext)
+	if scriptExtensions[ext] {
+		return true
+	}
+	for _, exts := range mediaExtensions {
+		for _, e := range exts {
+			if e == ext {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nameFromURL 判断文件名是否只是从 URL 路径中取出的，这种文件名可以被 Content-Disposition 替换
+func nameFromURL(rawURL string, name string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	base := path.Base(u.Path)
+	if unescaped, err := url.PathUnescape(base); err == nil {
+		base = unescaped
+	}
+	return name == format.SanitizeWindowsPath(base) || name == format.GetFileNameFromURL(u.Path)
+}
+
+// finalPath 根据 Content-Disposition、文件内容和 Content-Type 确定下载文件的最终路径：
+// 从 URL 得到的文件名换成服务器给出的文件名，缺失或不匹配的扩展名换成实际类型的扩展名
+func finalPath(target string, part string, m *partManifest) string {
+	dir, name := filepath.Split(target)
+	if m.Filename != "" && nameFromURL(m.URL, name) {
+		name = m.Filename
+	}
+
+	if defaultExt, exts := detectExtension(part, m.ContentType); defaultExt != "" {
+		ext := filepath.Ext(name)
+		matched := false
+		for _, e := range exts {
+			if strings.EqualFold(ext, e) {
+				matched = true
+			}
+		}
+		if !matched {
+			if isKnownExtension(ext) {
+				name = strings.TrimSuffix(name, ext)
+			}
+			name += defaultExt
+		}
+	}
+
+	result := filepath.Join(dir, name)
+	if result == target {
+		return result
+	}
+	// 不覆盖已经存在的其他文件
+	stem, ext := strings.TrimSuffix(result, filepath.Ext(result)), filepath.Ext(result)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(result); os.IsNotExist(err) {
+			return result
+		}
+		result = fmt.Sprintf("%s-%d%s", stem, i, ext)
+	}
+}
+
+// existingDownload 查找之前已经完成的下载：target 本身，或者下载完成时改名后记录在清单中的路径。
+// 同一目录下主文件名相同的其他文件可能来自别的 URL，不算已完成。
+func existingDownload(target string) (string, bool) {
+	if _, err := os.Stat(target); err == nil {
+		return target, true
+	}
+
+	m := loadPartManifest(manifestPath(target))
+	if m == nil || m.Final == "" {
+		return "", false
+	}
+	if _, err := os.Stat(m.Final); err != nil {
+		return "", false
+	}
+	return m.Final, true
+}
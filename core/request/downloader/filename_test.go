@@ -0,0 +1,105 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDispositionFilename(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{`attachment; filename="video.mp4"`, "video.mp4"},
+		{`attachment; filename="fallback.mp4"; filename*=UTF-8''%E8%A7%86%E9%A2%91.mp4`, "视频.mp4"},
+		{`attachment; filename="../../etc/passwd"`, "passwd"},
+		{`attachment; filename="a:b.jpg"`, "a_b.jpg"},
+		{`inline`, ""},
+		{``, ""},
+	}
+	for _, tt := range tests {
+		if got := dispositionFilename(tt.header); got != tt.want {
+			t.Errorf("dispositionFilename(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+// pngHeader 是 PNG 文件的签名和 IHDR 开头
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestDownloadFinalPath(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download.php" {
+			w.Header().Set("Content-Disposition", `attachment; filename="picture.jpg"`)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(pngHeader)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	tests := []struct {
+		url    string
+		target string
+		want   string
+	}{
+		// 从 URL 得到的文件名换成服务器给出的文件名，扩展名按内容修正
+		{srv.URL + "/download.php?id=1", "download.php", "picture.png"},
+		// 解析器指定的文件名保留主文件名，只补上扩展名
+		{srv.URL + "/image", "001", "001.png"},
+	}
+	d := NewDownloader(&testClient{retries: 1}, false)
+	for _, tt := range tests {
+		result, err := d.DownloadFile(context.Background(), tt.url, filepath.Join(dir, tt.target), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := filepath.Join(dir, tt.want); result.Path != want {
+			t.Errorf("DownloadFile(%s) path = %s, want %s", tt.url, result.Path, want)
+		}
+		if _, err := os.Stat(result.Path); err != nil {
+			t.Errorf("downloaded file missing: %v", err)
+		}
+	}
+
+	// 再次下载时找到已经改名的文件
+	result, err := d.DownloadFile(context.Background(), srv.URL+"/image", filepath.Join(dir, "001"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := filepath.Join(dir, "001.png"); result.Path != want {
+		t.Errorf("second download path = %s, want %s", result.Path, want)
+	}
+}
+
+func TestExistingDownloadOtherExtension(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jpeg)
+	}))
+	defer srv.Close()
+
+	// 同名但扩展名不同的文件来自别的下载，不能让 photo.jpg 被跳过
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "photo.png"), pngHeader, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDownloader(&testClient{retries: 1}, false)
+	result, err := d.DownloadFile(context.Background(), srv.URL+"/photo.jpg", filepath.Join(dir, "photo.jpg"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := filepath.Join(dir, "photo.jpg"); result.Path != want {
+		t.Errorf("path = %s, want %s", result.Path, want)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "photo.jpg")); string(data) != string(jpeg) {
+		t.Errorf("photo.jpg was not downloaded")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "photo.png")); string(data) != string(pngHeader) {
+		t.Errorf("photo.png was modified")
+	}
+}
@@ -0,0 +1,222 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// maxRefreshFailures 连续多少次刷新播放列表失败后结束录制
+const maxRefreshFailures = 3
+
+// refreshInterval 返回下次刷新播放列表前等待的时间，播放列表没有变化时按一半的目标时长重新加载
+var refreshInterval = func(playlist *m3u8.MediaPlaylist, changed bool) time.Duration {
+	wait := time.Duration(playlist.TargetDuration * float64(time.Second))
+	if !changed {
+		wait /= 2
+	}
+	return max(wait, time.Second)
+}
+
+// liveState 是录制直播的断点续传状态。直播源会复用分片的文件名，而且录制时间不限，
+// 所以只记录最后写入的媒体序号，不记录每个分片。
+type liveState struct {
+	LastSeq          uint64        `json:"last_seq"`          // 最后一个已写入输出文件的分片的媒体序号
+	WrittenSize      int64         `json:"written_size"`      // 输出文件中已确认写入的字节数
+	RecordedDuration time.Duration `json:"recorded_duration"` // 已写入分片的媒体时长，续传后继续计入时长上限
+}
+
+func loadLiveState(stateFile string) *liveState {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return nil
+	}
+
+	var state liveState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+	return &state
+}
+
+func saveLiveState(stateFile string, state *liveState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(stateFile, data, 0644)
+}
+
+// liveOptions 控制直播（没有 EXT-X-ENDLIST 的播放列表）的录制
+type liveOptions struct {
+	enabled     bool
+	maxDuration time.Duration // 录制的媒体时长上限，0 表示不限制
+	maxSize     int64         // 录制的字节数上限，0 表示不限制
+}
+
+func newLiveOptions(opt DownloadOption) liveOptions {
+	return liveOptions{
+		enabled:     opt.LiveRecord,
+		maxDuration: time.Duration(opt.RecordDuration) * time.Second,
+		maxSize:     opt.RecordMaxSize,
+	}
+}
+
+// recordToFile 按 EXT-X-TARGETDURATION 反复刷新播放列表，只下载媒体序号比上次更新的分片并追加到 tempFile。
+// 遇到 EXT-X-ENDLIST、达到时长或大小上限、或 ctx 取消（Ctrl-C）时停止，已录制的内容保留用于转换。
+// 再次运行时从状态文件中记录的媒体序号之后继续录制。
+func (m *M3U8Downloader) recordToFile(ctx context.Context, playlist *m3u8.MediaPlaylist, tempFile string) error {
+	outFile, err := openTempFile(tempFile)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	// 丢弃上次运行中写入了一半、尚未记录到状态文件的数据
+	stateFile := m.getStateFilePath()
+	state := loadLiveState(stateFile)
+	started := state != nil
+	if state == nil {
+		state = &liveState{}
+	}
+	if err := outFile.Truncate(state.WrittenSize); err != nil {
+		return fmt.Errorf("failed to truncate temp file: %w", err)
+	}
+
+	// 分片临时文件按批次内的序号命名，上次运行留下的文件不能复用
+	if err := os.RemoveAll(m.getSegmentDir()); err != nil {
+		return fmt.Errorf("failed to clean segment directory: %w", err)
+	}
+	if err := os.MkdirAll(m.getSegmentDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create segment directory: %w", err)
+	}
+	pool := newSegmentPool(m.client, m.opts, m.getSegmentDir(), m.maxParallel)
+
+	// 取消时正在下载的分片作废，已按顺序写入的分片保留
+	stopped := func() bool {
+		if ctx.Err() == nil {
+			return false
+		}
+		log.Printf("Live recording stopped: %v", context.Cause(ctx))
+		return true
+	}
+
+	builder := m.newJobBuilder(playlist)
+	builder.live = true
+	lastSeq := state.LastSeq
+	recorded := state.RecordedDuration
+	failures := 0
+	limitReached := func() bool { return m.live.maxDuration > 0 && recorded >= m.live.maxDuration }
+	for {
+		// 只处理上次刷新之后新出现的分片，旧分片只用于延续密钥等状态
+		newSegments := 0
+		for _, segment := range playlist.Segments {
+			if segment == nil {
+				continue
+			}
+			isNew := !started || segment.SeqId > lastSeq
+			if isNew && limitReached() {
+				break
+			}
+			if isNew && started && segment.SeqId > lastSeq+1 {
+				log.Printf("Warning: missed %d segments that left the live playlist before they were downloaded", segment.SeqId-lastSeq-1)
+			}
+			if err := builder.add(segment, isNew); err != nil {
+				return err
+			}
+			if isNew {
+				lastSeq, started = segment.SeqId, true
+				recorded += time.Duration(segment.Duration * float64(time.Second))
+				newSegments++
+			}
+		}
+
+		if jobs := builder.take(); len(jobs) > 0 {
+			err := pool.writeInOrder(ctx, jobs, outFile, nil, func(job segmentJob, size int64) {
+				// 初始化段之后的分片写入前中断时，续传会重新写入初始化段，所以只在分片之后保存
+				if job.init {
+					return
+				}
+				state.LastSeq, state.WrittenSize = job.seq, size
+				state.RecordedDuration += job.duration
+				saveLiveState(stateFile, state)
+			})
+			if err != nil {
+				if stopped() {
+					return nil
+				}
+				return err
+			}
+		}
+
+		size, err := outFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fmt.Errorf("failed to seek file: %w", err)
+		}
+		if newSegments > 0 {
+			log.Printf("Recorded %d new segments (%s, %.1f MB in total)", newSegments, recorded.Round(time.Second), float64(size)/(1<<20))
+		}
+
+		switch {
+		case playlist.Closed:
+			log.Printf("Live playlist ended, stopping recording")
+			return nil
+		case limitReached():
+			log.Printf("Reached recording duration limit %s, stopping recording", m.live.maxDuration)
+			return nil
+		case m.live.maxSize > 0 && size >= m.live.maxSize:
+			log.Printf("Reached recording size limit %d bytes, stopping recording", m.live.maxSize)
+			return nil
+		}
+
+		if err := sleepContext(ctx, refreshInterval(playlist, newSegments > 0)); err != nil {
+			stopped()
+			return nil
+		}
+
+		next, err := m.fetchMediaPlaylist(ctx, m.playlistURL)
+		if err != nil {
+			if stopped() {
+				return nil
+			}
+			failures++
+			if failures >= maxRefreshFailures {
+				log.Printf("Warning: failed to refresh live playlist %d times, stopping recording: %v", failures, err)
+				return nil
+			}
+			log.Printf("Warning: failed to refresh live playlist: %v", err)
+			continue
+		}
+		failures = 0
+		playlist = next
+	}
+}
+
+// fetchMediaPlaylist 获取并解析媒体播放列表，用于刷新直播播放列表
+func (m *M3U8Downloader) fetchMediaPlaylist(ctx context.Context, playlistURL string) (*m3u8.MediaPlaylist, error) {
+	resp, err := m.client.GetStream(ctx, "GET", playlistURL, m.opts, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get m3u8: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get m3u8: unexpected status code %d", resp.StatusCode)
+	}
+
+	playlist, listType, err := decodePlaylist(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode m3u8: %w", err)
+	}
+	if listType != m3u8.MEDIA {
+		return nil, fmt.Errorf("expected a media playlist")
+	}
+	return playlist.(*m3u8.MediaPlaylist), nil
+}
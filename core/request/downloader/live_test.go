@@ -0,0 +1,222 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// livePlaylist 是直播源某一时刻的播放列表，fail 为 true 时返回 500
+type livePlaylist struct {
+	first int      // 第一个分片的媒体序号
+	names []string // 分片文件名，直播源可能复用
+	ended bool
+	fail  bool
+}
+
+// liveServer 每次请求播放列表时返回下一个 livePlaylist，用完后重复最后一个。
+// 分片的内容是它的媒体序号，取决于最近一次返回的播放列表。
+type liveServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	playlists []livePlaylist
+	fetches   int
+	content   map[string]string
+}
+
+func newLiveServer(playlists ...livePlaylist) *liveServer {
+	s := &liveServer{playlists: playlists, content: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *liveServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path != "/live.m3u8" {
+		body, ok := s.content[path.Base(r.URL.Path)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+		return
+	}
+
+	p := s.playlists[min(s.fetches, len(s.playlists)-1)]
+	s.fetches++
+	if p.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", p.first)
+	for i, name := range p.names {
+		fmt.Fprintf(&b, "#EXTINF:1,\n%s\n", name)
+		s.content[name] = fmt.Sprintf("[%d]", p.first+i)
+	}
+	if p.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	fmt.Fprint(w, b.String())
+}
+
+// record 录制 srv 上的直播，返回录制的内容、日志和使用的下载器
+func (s *liveServer) record(t *testing.T, live liveOptions) (string, string, *M3U8Downloader) {
+	t.Helper()
+	return s.recordTo(t, filepath.Join(t.TempDir(), "live"), live)
+}
+
+// recordTo 录制到 output，output 旁边已有的临时文件和状态文件用于续传
+func (s *liveServer) recordTo(t *testing.T, output string, live liveOptions) (string, string, *M3U8Downloader) {
+	t.Helper()
+	defer func(f func(*m3u8.MediaPlaylist, bool) time.Duration) { refreshInterval = f }(refreshInterval)
+	refreshInterval = func(*m3u8.MediaPlaylist, bool) time.Duration { return time.Millisecond }
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	ctx := context.Background()
+	m := NewM3U8Downloader(&testClient{}, output, nil, false)
+	live.enabled = true
+	m.live = live
+	playlist, err := m.loadMediaPlaylist(ctx, s.URL+"/live.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempFile := m.tempFilePath(playlist)
+	if err := m.recordToFile(ctx, playlist, tempFile); err != nil {
+		t.Fatalf("recordToFile() error = %v\n%s", err, logs.String())
+	}
+	data, err := os.ReadFile(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), logs.String(), m
+}
+
+func TestRecordLiveUntilEndList(t *testing.T) {
+	// 直播源循环使用 a.ts 和 b.ts 两个文件名
+	srv := newLiveServer(
+		livePlaylist{first: 0, names: []string{"a.ts", "b.ts"}},
+		livePlaylist{first: 1, names: []string{"b.ts", "a.ts"}},
+		livePlaylist{first: 1, names: []string{"b.ts", "a.ts"}},
+		livePlaylist{first: 2, names: []string{"a.ts", "b.ts"}, ended: true},
+	)
+	defer srv.Close()
+
+	got, _, m := srv.record(t, liveOptions{})
+	if got != "[0][1][2][3]" {
+		t.Errorf("got %q, want every segment once in order", got)
+	}
+
+	// 状态文件只记录最后的媒体序号、已写入的大小和时长
+	if state, _ := os.ReadFile(m.getStateFilePath()); string(state) != `{"last_seq":3,"written_size":12,"recorded_duration":4000000000}` {
+		t.Errorf("got state %s", state)
+	}
+	if srv.fetches != 4 {
+		t.Errorf("playlist fetched %d times, want 4", srv.fetches)
+	}
+}
+
+func TestRecordLiveLimits(t *testing.T) {
+	growing := []livePlaylist{
+		{first: 0, names: []string{"0.ts"}},
+		{first: 0, names: []string{"0.ts", "1.ts"}},
+		{first: 0, names: []string{"0.ts", "1.ts", "2.ts", "3.ts"}},
+	}
+	tests := []struct {
+		name string
+		live liveOptions
+		want string
+		log  string
+	}{
+		{"duration", liveOptions{maxDuration: 3 * time.Second}, "[0][1][2]", "duration limit"},
+		{"size", liveOptions{maxSize: 5}, "[0][1]", "size limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newLiveServer(growing...)
+			defer srv.Close()
+			got, logs, _ := srv.record(t, tt.live)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !strings.Contains(logs, tt.log) {
+				t.Errorf("log does not mention %q:\n%s", tt.log, logs)
+			}
+		})
+	}
+}
+
+func TestRecordLiveResumeDuration(t *testing.T) {
+	srv := newLiveServer(
+		livePlaylist{first: 0, names: []string{"0.ts", "1.ts", "2.ts", "3.ts"}},
+	)
+	defer srv.Close()
+
+	// 上次运行已经录制了 2 秒，续传后总时长仍然不能超过上限
+	output := filepath.Join(t.TempDir(), "live")
+	if err := os.WriteFile(output+".ts", []byte("[0][1]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saveLiveState(output+".state.json", &liveState{LastSeq: 1, WrittenSize: 6, RecordedDuration: 2 * time.Second})
+
+	got, _, m := srv.recordTo(t, output, liveOptions{maxDuration: 3 * time.Second})
+	if got != "[0][1][2]" {
+		t.Errorf("got %q, want one more second recorded", got)
+	}
+	if state := loadLiveState(m.getStateFilePath()); state == nil || state.RecordedDuration != 3*time.Second {
+		t.Errorf("got state %+v, want 3s recorded", state)
+	}
+}
+
+func TestRecordLiveGap(t *testing.T) {
+	srv := newLiveServer(
+		livePlaylist{first: 0, names: []string{"0.ts", "1.ts"}},
+		livePlaylist{first: 5, names: []string{"5.ts", "6.ts"}, ended: true},
+	)
+	defer srv.Close()
+
+	got, logs, _ := srv.record(t, liveOptions{})
+	if got != "[0][1][5][6]" {
+		t.Errorf("got %q", got)
+	}
+	if !strings.Contains(logs, "missed 3 segments") {
+		t.Errorf("log does not warn about the gap:\n%s", logs)
+	}
+}
+
+func TestRecordLiveRefreshFailure(t *testing.T) {
+	srv := newLiveServer(
+		livePlaylist{first: 0, names: []string{"0.ts", "1.ts"}},
+		livePlaylist{fail: true},
+	)
+	defer srv.Close()
+
+	got, logs, _ := srv.record(t, liveOptions{})
+	if got != "[0][1]" {
+		t.Errorf("got %q, want the segments recorded before the failures", got)
+	}
+	if srv.fetches != 1+maxRefreshFailures {
+		t.Errorf("playlist fetched %d times, want %d", srv.fetches, 1+maxRefreshFailures)
+	}
+	if !strings.Contains(logs, "stopping recording") {
+		t.Errorf("log does not mention stopping:\n%s", logs)
+	}
+}
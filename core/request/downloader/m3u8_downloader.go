@@ -1,14 +1,21 @@
 package downloader
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
+	"time"
+
+	"MediaNinja/core/remux"
 
 	"github.com/grafov/m3u8"
 )
@@ -19,100 +26,178 @@ type M3U8Downloader struct {
 	opts         *RequestOption
 	showProgress bool
 	urlPrefix    string // 添加 URL 前缀字段
-}
+	maxParallel  int    // 分片并发下载数
+	fragmented   bool   // 输出 fragmented MP4
+	playlistURL  string // 当前媒体播放列表的 URL，用于解析相对路径
+	live         liveOptions
+
+	variantPolicy VariantPolicy
+	variant       *VariantSelection // master 播放列表的变体选择结果
+
+	master          *m3u8.Variant // master 播放列表中选中的变体，用于下载备用音轨和字幕
+	masterURL       string
+	renditionPrefix string
 
-// 用于保存下载进度的结构
-type downloadState struct {
-	DownloadedSegments map[string]bool `json:"downloaded_segments"`
-	TotalSegments      int             `json:"total_segments"`
+	renditionPolicy RenditionPolicy
+	renditions      []*rendition // 已下载的备用音轨和字幕
 }
 
 func NewM3U8Downloader(client ClientInterface, output string, opts *RequestOption, showProgress bool) *M3U8Downloader {
 	return &M3U8Downloader{
-		client:       client,
-		output:       output,
-		opts:         opts,
-		showProgress: showProgress,
-		urlPrefix:    "", // 默认为空
+		client:        client,
+		output:        output,
+		opts:          opts,
+		showProgress:  showProgress,
+		urlPrefix:     "", // 默认为空
+		maxParallel:   client.GetDownloadOption().MaxParallel,
+		fragmented:    client.GetDownloadOption().FragmentedMP4,
+		live:          newLiveOptions(client.GetDownloadOption()),
+		variantPolicy: newVariantPolicy(client.GetDownloadOption().VariantPolicy),
+
+		renditionPolicy: newRenditionPolicy(client.GetDownloadOption()),
 	}
 }
 
 // NewM3U8DownloaderWithPrefix 创建带前缀的 M3U8 下载器
 func NewM3U8DownloaderWithPrefix(client ClientInterface, output string, opts *RequestOption, showProgress bool, urlPrefix string) *M3U8Downloader {
 	return &M3U8Downloader{
-		client:       client,
-		output:       output,
-		opts:         opts,
-		showProgress: showProgress,
-		urlPrefix:    urlPrefix,
+		client:        client,
+		output:        output,
+		opts:          opts,
+		showProgress:  showProgress,
+		urlPrefix:     urlPrefix,
+		maxParallel:   client.GetDownloadOption().MaxParallel,
+		fragmented:    client.GetDownloadOption().FragmentedMP4,
+		live:          newLiveOptions(client.GetDownloadOption()),
+		variantPolicy: newVariantPolicy(client.GetDownloadOption().VariantPolicy),
+
+		renditionPolicy: newRenditionPolicy(client.GetDownloadOption()),
 	}
 }
 
-func (m *M3U8Downloader) DownloadFromURL(m3u8URL string) error {
-	// 创建临时文件用于存储 ts 文件
-	tempFile := m.output + ".ts"
-	stateFile := m.getStateFilePath()
-	defer os.Remove(stateFile) // 下载完成后删除状态文件
+// newVariantPolicy 解析配置中的变体选择策略，无效时使用默认策略
+func newVariantPolicy(s string) VariantPolicy {
+	policy, err := ParseVariantPolicy(s)
+	if err != nil {
+		log.Printf("Warning: %v, falling back to default variant policy", err)
+		return DefaultVariantPolicy()
+	}
+	return policy
+}
+
+// newRenditionPolicy 解析配置中的音轨和字幕选择条件，无效时使用默认条件
+func newRenditionPolicy(opt DownloadOption) RenditionPolicy {
+	policy, err := ParseRenditionPolicy(opt.AudioLanguages, opt.SubtitleLanguages, opt.SubtitleMode)
+	if err != nil {
+		log.Printf("Warning: %v, falling back to default rendition policy", err)
+		policy, _ = ParseRenditionPolicy("", "", "")
+	}
+	return policy
+}
+
+// DownloadFromURL 下载 m3u8 并转换为 mp4。ctx 取消时保留临时文件和断点续传状态，下次运行时继续下载；
+// 录制直播时 ctx 取消只结束录制，已录制的内容照常转换。
+func (m *M3U8Downloader) DownloadFromURL(ctx context.Context, m3u8URL string) (result *Result, err error) {
+	interrupted := func() bool { return err != nil && ctx.Err() != nil }
+	defer func() {
+		if interrupted() {
+			log.Printf("Download interrupted, keeping partial data for resume: %s", m.output)
+			return
+		}
+		os.Remove(m.getStateFilePath()) // 下载完成后删除状态文件
+		os.RemoveAll(m.getSegmentDir())
+		m.cleanupRenditions()
+	}()
+
+	// 获取媒体播放列表，master 播放列表会先按策略选择变体
+	playlist, err := m.loadMediaPlaylist(ctx, m3u8URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download m3u8 content: %w", err)
+	}
+
+	// 下载完成后才发现缺少 ffmpeg 会浪费整个下载，需要时先检查
+	recording := !playlist.Closed && m.live.enabled
+	if m.needsFFmpeg(playlist, recording) {
+		if err := checkFFmpeg("mux fragmented MP4 or subtitle renditions"); err != nil {
+			return nil, err
+		}
+	}
+
+	// 临时文件的扩展名取决于分片格式（MPEG-TS 或 fMP4）
+	tempFile := m.tempFilePath(playlist)
 
 	// 确保在函数退出时清理临时文件（如果存在）
 	defer func() {
+		if interrupted() {
+			return
+		}
 		if _, err := os.Stat(tempFile); err == nil {
 			if removeErr := os.Remove(tempFile); removeErr != nil {
 				log.Printf("Warning: Failed to remove temp file %s: %v", tempFile, removeErr)
 			} else {
-				log.Printf("Cleaned up temporary ts file: %s", tempFile)
+				log.Printf("Cleaned up temporary file: %s", tempFile)
 			}
 		}
 	}()
 
-	// 检查是否存在未完成的下载
-	var flags int
-	if _, err := os.Stat(tempFile); err == nil {
-		flags = os.O_WRONLY | os.O_APPEND
-		log.Printf("Resuming download to existing temp file: %s", tempFile)
+	// 下载内容，没有 EXT-X-ENDLIST 的播放列表在录制模式下持续刷新
+	if recording {
+		log.Printf("Playlist has no EXT-X-ENDLIST, starting live recording...")
+		if err := m.recordToFile(ctx, playlist, tempFile); err != nil {
+			return nil, fmt.Errorf("failed to record live stream: %w", err)
+		}
+		if info, err := os.Stat(tempFile); err != nil || info.Size() == 0 {
+			return nil, fmt.Errorf("failed to record live stream: no segments were recorded")
+		}
 	} else {
-		flags = os.O_CREATE | os.O_WRONLY
-		log.Printf("Creating new temp file for download: %s", tempFile)
-	}
-
-	// 打开或创建输出文件
-	outFile, err := os.OpenFile(tempFile, flags, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to create/open temp file: %w", err)
+		if !playlist.Closed {
+			log.Printf("Warning: playlist has no EXT-X-ENDLIST, downloading only the segments listed now (use live recording to follow it)")
+		}
+		log.Printf("Starting m3u8 content download...")
+		if err := m.downloadToFile(ctx, playlist, tempFile); err != nil {
+			return nil, fmt.Errorf("failed to download m3u8 content: %w", err)
+		}
 	}
-	defer outFile.Close()
 
-	// 下载内容
-	log.Printf("Starting m3u8 content download...")
-	if err := m.downloadM3U8Content(m3u8URL, outFile); err != nil {
-		return fmt.Errorf("failed to download m3u8 content: %w", err)
+	// 下载 EXT-X-MEDIA 中的备用音轨和字幕，录制直播时无法和主视频对齐，跳过
+	if m.master != nil && recording {
+		log.Printf("Warning: alternate audio and subtitle renditions are not recorded in live mode")
+	} else if m.master != nil {
+		if err := m.downloadRenditions(ctx, m.master, m.masterURL, m.renditionPrefix, tsStartPTS(tempFile)); err != nil {
+			return nil, fmt.Errorf("failed to download m3u8 content: %w", err)
+		}
 	}
 	log.Printf("M3U8 content download completed successfully")
 
 	// 转换为 MP4
-	log.Printf("Starting conversion from ts to mp4...")
-	if err := m.convertToMP4(tempFile, m.output); err != nil {
-		return fmt.Errorf("failed to convert ts to mp4: %w", err)
+	log.Printf("Starting conversion to mp4...")
+	if err := convertToMP4(tempFile, m.output, m.muxedRenditions(), m.fragmented); err != nil {
+		return nil, fmt.Errorf("failed to convert %s to mp4: %w", path.Base(tempFile), err)
 	}
 	log.Printf("Conversion to MP4 completed successfully")
 
-	return nil
+	return &Result{
+		Path:       mp4Path(m.output),
+		Variant:    m.variant,
+		Renditions: m.renditionInfos(),
+	}, nil
 }
 
-func (m *M3U8Downloader) downloadM3U8Content(m3u8URL string, outFile *os.File) error {
+// loadMediaPlaylist 获取并解析媒体播放列表，遇到 master 播放列表时选择变体后继续获取
+func (m *M3U8Downloader) loadMediaPlaylist(ctx context.Context, m3u8URL string) (*m3u8.MediaPlaylist, error) {
 	log.Printf("Starting download from URL: %s", m3u8URL)
 
 	// 获取 m3u8 内容
-	resp, err := m.client.GetStream("GET", m3u8URL, m.opts, nil)
+	resp, err := m.client.GetStream(ctx, "GET", m3u8URL, m.opts, nil)
 	if err != nil {
-		return fmt.Errorf("failed to get m3u8: %w", err)
+		return nil, fmt.Errorf("failed to get m3u8: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// 解析 m3u8 文件
-	playlist, listType, err := m3u8.DecodeFrom(resp.Body, true)
+	playlist, listType, err := decodePlaylist(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to decode m3u8: %w", err)
+		return nil, fmt.Errorf("failed to decode m3u8: %w", err)
 	}
 
 	log.Printf("listType: %+v", listType)
@@ -120,124 +205,296 @@ func (m *M3U8Downloader) downloadM3U8Content(m3u8URL string, outFile *os.File) e
 	// 处理不同类型的播放列表
 	switch listType {
 	case m3u8.MEDIA:
-		mediapl := playlist.(*m3u8.MediaPlaylist)
-		return m.downloadSegments(mediapl, outFile)
+		m.playlistURL = m3u8URL
+		return playlist.(*m3u8.MediaPlaylist), nil
 	case m3u8.MASTER:
 		masterpl := playlist.(*m3u8.MasterPlaylist)
-		return m.handleMasterPlaylist(masterpl, m3u8URL, outFile)
+		return m.handleMasterPlaylist(ctx, masterpl, m3u8URL)
 	default:
-		return fmt.Errorf("unknown playlist type")
+		return nil, fmt.Errorf("unknown playlist type")
 	}
 }
 
-func (m *M3U8Downloader) downloadSegments(playlist *m3u8.MediaPlaylist, outFile *os.File) error {
-	// 计算总片段数
-	var totalSegments int
-	for _, segment := range playlist.Segments {
-		if segment != nil {
-			totalSegments++
+// decodePlaylist 解析 m3u8 播放列表。m3u8 库把省略的 EXT-X-BYTERANGE 偏移解析为 0，
+// 与显式的 @0 无法区分，所以先按上一个分片补全省略的偏移再解析。
+func decodePlaylist(r io.Reader) (m3u8.Playlist, m3u8.ListType, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return m3u8.Decode(*bytes.NewBuffer(resolveByteRanges(data)), true)
+}
+
+// resolveByteRanges 给没有 @o 的 EXT-X-BYTERANGE 补上偏移：紧接在同一 URI 的上一个分片之后，
+// 上一个分片不是同一 URI 的字节范围时从 0 开始
+func resolveByteRanges(data []byte) []byte {
+	lines := strings.Split(string(data), "\n")
+	rangeLine := -1 // 当前分片的 EXT-X-BYTERANGE 所在行
+	lastURI, lastEnd := "", int64(0)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			rangeLine = i
+		case line == "" || strings.HasPrefix(line, "#"):
+			// 其他标签和空行
+		case rangeLine < 0:
+			lastURI = ""
+		default:
+			spec := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[rangeLine]), "#EXT-X-BYTERANGE:"))
+			lengthStr, offsetStr, explicit := strings.Cut(spec, "@")
+			length, err := strconv.ParseInt(lengthStr, 10, 64)
+			if err != nil {
+				// 交给 m3u8 库报告格式错误
+				rangeLine, lastURI = -1, ""
+				continue
+			}
+			offset := int64(0)
+			if explicit {
+				offset, _ = strconv.ParseInt(offsetStr, 10, 64)
+			} else if line == lastURI {
+				offset = lastEnd
+			}
+			lines[rangeLine] = fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d", length, offset)
+			lastURI, lastEnd = line, offset+length
+			rangeLine = -1
 		}
 	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// tempFilePath 返回分片拼接后的临时文件路径
+func (m *M3U8Downloader) tempFilePath(playlist *m3u8.MediaPlaylist) string {
+	if isFragmentedMP4(playlist) {
+		return m.output + ".m4s"
+	}
+	return m.output + ".ts"
+}
+
+// downloadToFile 下载播放列表中的全部分片并按顺序写入 tempFile，已存在的临时文件视为未完成的下载
+func (m *M3U8Downloader) downloadToFile(ctx context.Context, playlist *m3u8.MediaPlaylist, tempFile string) error {
+	outFile, err := openTempFile(tempFile)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	return m.downloadSegments(ctx, playlist, outFile)
+}
+
+// openTempFile 打开或创建分片拼接的临时文件
+func openTempFile(tempFile string) (*os.File, error) {
+	// 检查是否存在未完成的下载
+	var flags int
+	if _, err := os.Stat(tempFile); err == nil {
+		flags = os.O_WRONLY | os.O_APPEND
+		log.Printf("Resuming download to existing temp file: %s", tempFile)
+	} else {
+		flags = os.O_CREATE | os.O_WRONLY
+		log.Printf("Creating new temp file for download: %s", tempFile)
+	}
 
-	// 获取或创建下载状态
-	state := m.loadDownloadState()
-	if state == nil {
-		state = &downloadState{
-			DownloadedSegments: make(map[string]bool),
-			TotalSegments:      totalSegments,
+	// 打开或创建输出文件
+	outFile, err := os.OpenFile(tempFile, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create/open temp file: %w", err)
+	}
+	return outFile, nil
+}
+
+// isFragmentedMP4 根据 EXT-X-MAP 判断分片是否为 fMP4（CMAF）
+func isFragmentedMP4(playlist *m3u8.MediaPlaylist) bool {
+	if playlist.Map != nil {
+		return !isTSURI(playlist.Map.URI)
+	}
+	for _, segment := range playlist.Segments {
+		if segment != nil && segment.Map != nil {
+			return !isTSURI(segment.Map.URI)
 		}
 	}
+	return false
+}
+
+func isTSURI(uri string) bool {
+	if u, err := url.Parse(uri); err == nil {
+		uri = u.Path
+	}
+	return strings.EqualFold(path.Ext(uri), ".ts")
+}
 
-	// 创建进度显示器
-	var progress *DownloadProgress
+func (m *M3U8Downloader) downloadSegments(ctx context.Context, playlist *m3u8.MediaPlaylist, outFile *os.File) error {
+	jobs, err := m.segmentJobs(playlist)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.getSegmentDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create segment directory: %w", err)
+	}
+	pool := newSegmentPool(m.client, m.opts, m.getSegmentDir(), m.maxParallel)
+
+	var progressName string
 	if m.showProgress {
-		progress = NewDownloadProgress(path.Base(m.output), int64(totalSegments), int64(len(state.DownloadedSegments)))
+		progressName = path.Base(m.output)
 	}
+	return pool.download(ctx, jobs, outFile, m.getStateFilePath(), progressName)
+}
 
-	// 下载所有片段
+// segmentJobs 把播放列表中的分片转换为下载任务
+func (m *M3U8Downloader) segmentJobs(playlist *m3u8.MediaPlaylist) ([]segmentJob, error) {
+	b := m.newJobBuilder(playlist)
 	for _, segment := range playlist.Segments {
 		if segment == nil {
 			continue
 		}
-
-		// 如果该片段已下载，跳过
-		if state.DownloadedSegments[segment.URI] {
-			continue
+		if err := b.add(segment, true); err != nil {
+			return nil, err
 		}
+	}
+	return b.take(), nil
+}
 
-		// 构建完整的 segment URL
-		segmentURL := m.buildSegmentURL(segment.URI)
+// jobBuilder 把分片逐个转换为下载任务，并记录跨分片生效的密钥和初始化段。
+// 录制直播时在多次刷新播放列表之间复用。
+type jobBuilder struct {
+	m    *M3U8Downloader
+	fmp4 bool
+	live bool // 直播源会复用分片的文件名，任务按媒体序号标识
+	jobs []segmentJob
 
-		// 下载分片
-		resp, err := m.client.GetStream("GET", segmentURL, m.opts, nil)
-		if err != nil {
-			if progress != nil {
-				progress.Fail(err)
-			}
-			return fmt.Errorf("failed to download segment %s: %w", segment.URI, err)
-		}
+	currentKey *m3u8.Key
+	currentMap *m3u8.Map
+}
 
-		// 获取文件当前位置用于写入
-		currentPos, err := outFile.Seek(0, io.SeekEnd)
-		if err != nil {
-			resp.Body.Close()
-			return fmt.Errorf("failed to seek file: %w", err)
-		}
+func (m *M3U8Downloader) newJobBuilder(playlist *m3u8.MediaPlaylist) *jobBuilder {
+	return &jobBuilder{m: m, fmp4: isFragmentedMP4(playlist)}
+}
 
-		// 写入分片数据
-		_, err = io.Copy(outFile, resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			if progress != nil {
-				progress.Fail(err)
-			}
-			// 如果写入失败，回滚文件位置
-			outFile.Truncate(currentPos)
-			return fmt.Errorf("failed to write segment: %w", err)
+// add 处理一个分片。emit 为 false 时只更新密钥等状态，不生成任务（用于已经下载过的分片）。
+func (b *jobBuilder) add(segment *m3u8.MediaSegment, emit bool) error {
+	// EXT-X-KEY 只出现在密钥切换的分片上，之后的分片沿用同一个密钥
+	if segment.Key != nil {
+		b.currentKey = segment.Key
+	}
+
+	// EXT-X-BYTERANGE：分片是大文件中的一段，省略的偏移已由 decodePlaylist 补全
+	var r *byteRange
+	if segment.Limit > 0 {
+		r = &byteRange{start: segment.Offset, end: segment.Offset + segment.Limit - 1}
+	}
+
+	if !emit {
+		if segment.Map != nil {
+			b.currentMap = segment.Map
 		}
+		return nil
+	}
 
-		// 标记该片段已下载
-		state.DownloadedSegments[segment.URI] = true
-		m.saveDownloadState(state)
+	encryption, err := b.m.segmentEncryption(b.currentKey, segment.SeqId)
+	if err != nil {
+		return fmt.Errorf("failed to prepare decryption for segment %s: %w", segment.URI, err)
+	}
+	if b.fmp4 && encryption != nil && encryption.method == encryptionSampleAES {
+		return fmt.Errorf("SAMPLE-AES encrypted fMP4 segments are not supported")
+	}
 
-		if progress != nil {
-			progress.Update(1)
+	// EXT-X-MAP 出现或变化时，先写入新的初始化段
+	if segment.Map != nil && !sameMap(segment.Map, b.currentMap) {
+		if b.currentMap != nil {
+			log.Printf("Warning: playlist switches initialization section at segment %s", segment.URI)
 		}
+		b.currentMap = segment.Map
+		b.jobs = appendJob(b.jobs, b.m.mapJob(b.currentMap, encryption))
 	}
 
-	if progress != nil {
-		progress.Success()
+	job := segmentJob{
+		key:        segment.URI,
+		url:        b.m.buildSegmentURL(segment.URI),
+		seq:        segment.SeqId,
+		duration:   time.Duration(segment.Duration * float64(time.Second)),
+		encryption: encryption,
+		byteRange:  r,
 	}
+	if b.live {
+		job.key = fmt.Sprintf("#%d %s", segment.SeqId, segment.URI)
+	} else if r != nil {
+		job.key = job.url + "@" + r.String()
+	}
+	b.jobs = appendJob(b.jobs, job)
 	return nil
 }
 
-func (m *M3U8Downloader) convertToMP4(inputFile, outputFile string) error {
+// take 返回已生成的任务并清空，下一批任务的序号重新从 0 开始
+func (b *jobBuilder) take() []segmentJob {
+	jobs := b.jobs
+	b.jobs = nil
+	return jobs
+}
+
+// mapJob 构造下载 EXT-X-MAP 初始化段的任务，BYTERANGE 指定时只下载其中一段
+func (m *M3U8Downloader) mapJob(xmap *m3u8.Map, encryption *segmentEncryption) segmentJob {
+	job := segmentJob{
+		key:        "map:" + xmap.URI,
+		url:        m.buildSegmentURL(xmap.URI),
+		init:       true,
+		encryption: encryption,
+	}
+	if xmap.Limit > 0 {
+		job.byteRange = &byteRange{start: xmap.Offset, end: xmap.Offset + xmap.Limit - 1}
+		job.key += "@" + job.byteRange.String()
+	}
+	return job
+}
+
+func sameMap(a, b *m3u8.Map) bool {
+	return a != nil && b != nil && a.URI == b.URI && a.Limit == b.Limit && a.Offset == b.Offset
+}
+
+// segmentEncryption 根据当前生效的 EXT-X-KEY 返回分片的解密信息，未加密时返回 nil
+func (m *M3U8Downloader) segmentEncryption(key *m3u8.Key, seqID uint64) (*segmentEncryption, error) {
+	if key == nil || key.Method == "" || strings.EqualFold(key.Method, "NONE") {
+		return nil, nil
+	}
+	if key.URI == "" {
+		return nil, fmt.Errorf("missing key URI for method %s", key.Method)
+	}
+	return newSegmentEncryption(key, m.buildSegmentURL(key.URI), seqID)
+}
+
+// convertToMP4 将 ts 文件转换为 mp4，同时混入单独下载的音轨和字幕。
+// 优先使用内置的转封装器，遇到它不支持的流时再交给 ffmpeg。
+func convertToMP4(inputFile, outputFile string, tracks []*rendition, fragmented bool) error {
 	// 检查输入文件是否存在
 	if _, err := os.Stat(inputFile); err != nil {
 		return fmt.Errorf("input ts file not found: %s, %w", inputFile, err)
 	}
 
+	outputFile = mp4Path(outputFile)
+
+	err := remuxToMP4(inputFile, outputFile, tracks, fragmented)
+	if err == nil {
+		log.Printf("Successfully remuxed ts to MP4: %s", outputFile)
+		return nil
+	}
+	if !errors.Is(err, remux.ErrUnsupported) {
+		return fmt.Errorf("failed to remux %s to %s: %w", inputFile, outputFile, err)
+	}
+	log.Printf("Native remuxer cannot handle %s (%v), falling back to ffmpeg", inputFile, err)
+
 	// 检查 ffmpeg 是否可用
 	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		// fMP4 分片拼接后本身就是可播放的 fragmented MP4，没有需要混流的轨道时直接使用
+		if isMP4File(inputFile) && len(tracks) == 0 {
+			log.Printf("ffmpeg not found, keeping downloaded fragmented MP4 as %s", outputFile)
+			return os.Rename(inputFile, outputFile)
+		}
 		return fmt.Errorf("ffmpeg not found, please install ffmpeg to convert ts to mp4: %w", err)
 	}
 
-	// 如果输出文件已经是 mp4 格式，则不需要添加扩展名
-	if !strings.HasSuffix(strings.ToLower(outputFile), ".mp4") {
-		outputFile = outputFile + ".mp4"
-	}
-
 	log.Printf("Converting %s to %s using ffmpeg...", inputFile, outputFile)
 
 	// 构建 ffmpeg 命令
-	cmd := exec.Command("ffmpeg",
-		"-i", inputFile,
-		"-c", "copy", // 直接复制流，不重新编码
-		"-bsf:a", "aac_adtstoasc", // 修复音频
-		"-y",                   // 覆盖已存在的文件
-		"-loglevel", "warning", // 减少 ffmpeg 输出
-		outputFile,
-	)
+	cmd := exec.Command("ffmpeg", ffmpegArgs(inputFile, outputFile, tracks, fragmented)...)
 
 	// 执行命令
 	if output, err := cmd.CombinedOutput(); err != nil {
@@ -253,31 +510,194 @@ func (m *M3U8Downloader) convertToMP4(inputFile, outputFile string) error {
 	return nil
 }
 
-// handleMasterPlaylist 处理 master 播放列表，获取分片 m3u8 链接并继续下载
-func (m *M3U8Downloader) handleMasterPlaylist(masterPlaylist *m3u8.MasterPlaylist, masterURL string, outFile *os.File) error {
-	log.Printf("Processing master playlist with %d variants", len(masterPlaylist.Variants))
+// remuxToMP4 使用内置转封装器生成 mp4。内置转封装器只处理 MPEG-TS 输入：
+// fMP4 输入（CMAF HLS、DASH）和需要转换为 mov_text 的字幕仍由 ffmpeg 处理，见 needsFFmpeg
+func remuxToMP4(inputFile, outputFile string, tracks []*rendition, fragmented bool) error {
+	if isMP4File(inputFile) {
+		return fmt.Errorf("%w: fragmented MP4 input", remux.ErrUnsupported)
+	}
+
+	var audio []remux.Input
+	for _, track := range tracks {
+		if track.isSubtitle() {
+			return fmt.Errorf("%w: subtitle tracks", remux.ErrUnsupported)
+		}
+		audio = append(audio, remux.Input{Path: track.path, Language: iso639_2(track.alt.Language)})
+	}
+	return remux.TSToMP4(inputFile, audio, outputFile, remux.Options{Fragmented: fragmented})
+}
+
+// checkFFmpeg 确认 ffmpeg 可用，purpose 说明需要它的原因
+func checkFFmpeg(purpose string) error {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("ffmpeg is required to %s, please install ffmpeg: %w", purpose, err)
+	}
+	return nil
+}
+
+// needsFFmpeg 判断下载完成后的转换是否必须使用 ffmpeg：fMP4 分片需要混入单独的音轨或字幕，
+// 或者字幕要混入 mp4。只有视频轨的 fMP4 没有 ffmpeg 时直接保留为 fragmented MP4。
+func (m *M3U8Downloader) needsFFmpeg(playlist *m3u8.MediaPlaylist, recording bool) bool {
+	if m.master == nil || recording {
+		return false
+	}
+	fmp4 := isFragmentedMP4(playlist)
+	for _, alt := range m.renditionPolicy.Select(m.master) {
+		if strings.EqualFold(alt.Type, renditionSubtitle) {
+			if m.renditionPolicy.SubtitleMode != SubtitleModeSidecar {
+				return true
+			}
+		} else if fmp4 {
+			return true
+		}
+	}
+	return false
+}
+
+// ffmpegArgs 构建 ffmpeg 参数。单独下载的音轨排在视频自带音轨之前，
+// 这样第 N 个外部音轨在输出中的序号就是 N，可以直接设置语言和名称。
+func ffmpegArgs(inputFile, outputFile string, tracks []*rendition, fragmented bool) []string {
+	args := []string{"-i", inputFile}
+	for _, track := range tracks {
+		args = append(args, "-i", track.path)
+	}
+
+	var movflags []string
+	if fragmented {
+		movflags = []string{"-movflags", "frag_keyframe+empty_moov+default_base_moof"}
+	}
+
+	// ADTS 音频只出现在 MPEG-TS 中，fMP4 中的 AAC 不需要也不能使用 aac_adtstoasc
+	var bsf []string
+	if hasTSInput(inputFile, tracks) {
+		bsf = []string{"-bsf:a", "aac_adtstoasc"}
+	}
+
+	if len(tracks) == 0 {
+		args = append(args, movflags...)
+		args = append(args, "-c", "copy") // 直接复制流，不重新编码
+		args = append(args, bsf...)       // 修复音频
+		return append(args,
+			"-y",                   // 覆盖已存在的文件
+			"-loglevel", "warning", // 减少 ffmpeg 输出
+			outputFile,
+		)
+	}
+
+	args = append(args, "-map", "0:v")
+	var metadata []string
+	audioIndex, subtitleIndex := 0, 0
+	for i, track := range tracks {
+		if track.isSubtitle() {
+			continue
+		}
+		args = append(args, "-map", fmt.Sprintf("%d:a", i+1))
+		metadata = append(metadata, trackMetadata("a", audioIndex, track)...)
+		audioIndex++
+	}
+	args = append(args, "-map", "0:a?")
+	for i, track := range tracks {
+		if !track.isSubtitle() {
+			continue
+		}
+		args = append(args, "-map", fmt.Sprintf("%d:s", i+1))
+		metadata = append(metadata, trackMetadata("s", subtitleIndex, track)...)
+		subtitleIndex++
+	}
+	if audioIndex > 0 {
+		args = append(args, "-disposition:a:0", "default")
+	}
+
+	args = append(args, metadata...)
+	args = append(args, movflags...)
+	args = append(args,
+		"-c", "copy",
+		"-c:s", "mov_text", // mp4 只支持 mov_text 字幕
+	)
+	args = append(args, bsf...)
+	return append(args,
+		"-y",
+		"-loglevel", "warning",
+		outputFile,
+	)
+}
 
-	// 查找合适的变体（优先选择第一个可用的）
-	var selectedVariant *m3u8.Variant
-	for _, variant := range masterPlaylist.Variants {
-		if variant != nil && variant.URI != "" {
-			selectedVariant = variant
-			break
+// hasTSInput 判断输入中是否有 MPEG-TS 文件
+func hasTSInput(inputFile string, tracks []*rendition) bool {
+	if !isMP4File(inputFile) {
+		return true
+	}
+	for _, track := range tracks {
+		if !track.isSubtitle() && !isMP4File(track.path) {
+			return true
 		}
 	}
+	return false
+}
+
+// isMP4File 根据文件开头的 box 类型判断是否为 MP4（包括 fMP4 分片拼接的文件）
+func isMP4File(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+	switch string(header[4:8]) {
+	case "ftyp", "styp", "moov", "moof", "sidx", "free":
+		return true
+	}
+	return false
+}
+
+// trackMetadata 为输出中的一个流设置语言和名称
+func trackMetadata(kind string, index int, track *rendition) []string {
+	spec := fmt.Sprintf("-metadata:s:%s:%d", kind, index)
+	args := []string{spec, "language=" + iso639_2(track.alt.Language)}
+	if track.alt.Name != "" {
+		args = append(args, spec, "title="+track.alt.Name)
+	}
+	return args
+}
 
-	if selectedVariant == nil {
-		return fmt.Errorf("no valid variant found in master playlist")
+// mp4Path 返回转换后的 mp4 文件路径，如果输出文件已经是 mp4 格式，则不需要添加扩展名
+func mp4Path(output string) string {
+	if !strings.HasSuffix(strings.ToLower(output), ".mp4") {
+		return output + ".mp4"
 	}
+	return output
+}
 
-	log.Printf("Selected variant: %s", selectedVariant.URI)
+// handleMasterPlaylist 处理 master 播放列表，按策略选择变体并获取其媒体播放列表
+func (m *M3U8Downloader) handleMasterPlaylist(ctx context.Context, masterPlaylist *m3u8.MasterPlaylist, masterURL string) (*m3u8.MediaPlaylist, error) {
+	log.Printf("Processing master playlist with %d variants", len(masterPlaylist.Variants))
+
+	// 按策略选择变体
+	selectedVariant, selection, err := m.variantPolicy.Select(masterPlaylist.Variants)
+	if err != nil {
+		return nil, err
+	}
+	m.variant = selection
+
+	log.Printf("Selected variant %d (policy %s): %s, bandwidth %d, resolution %s",
+		selection.Selected.Index, selection.Policy, selectedVariant.URI, selectedVariant.Bandwidth, selectedVariant.Resolution)
 
 	// 构造分片 m3u8 URL
 	segmentURL, err := m.buildVariantURL(selectedVariant.URI, masterURL)
 	if err != nil {
-		return fmt.Errorf("failed to build segment URL: %w", err)
+		return nil, fmt.Errorf("failed to build segment URL: %w", err)
 	}
 
+	// 记录选中的变体，分片下载完成后再下载 EXT-X-MEDIA 中的备用音轨和字幕。
+	// 备用音轨和字幕只使用调用方指定的前缀，未指定时按各自的播放列表解析相对路径
+	m.master = selectedVariant
+	m.masterURL = masterURL
+	m.renditionPrefix = m.urlPrefix
+
 	// 更新 URL 前缀以便后续分片下载使用
 	if m.urlPrefix == "" {
 		m.urlPrefix = m.extractURLPrefix(masterURL)
@@ -286,8 +706,8 @@ func (m *M3U8Downloader) handleMasterPlaylist(masterPlaylist *m3u8.MasterPlaylis
 
 	log.Printf("Requesting segment m3u8 from: %s", segmentURL)
 
-	// 递归下载分片 m3u8
-	return m.downloadM3U8Content(segmentURL, outFile)
+	// 递归获取分片 m3u8
+	return m.loadMediaPlaylist(ctx, segmentURL)
 }
 
 // buildVariantURL 根据 variant URI 和 master URL 构造完整的分片 URL
@@ -322,16 +742,27 @@ func (m *M3U8Downloader) extractURLPrefix(masterURL string) string {
 	return masterURL[:lastSlash]
 }
 
-// buildSegmentURL 根据 segment URI 和 urlPrefix 构建完整的 URL
+// buildSegmentURL 根据 segment URI 和 urlPrefix 构建完整的 URL，也用于密钥 URI
 func (m *M3U8Downloader) buildSegmentURL(segmentURI string) string {
 	// 如果 segment URI 已经是完整的 URL，直接返回
 	if strings.HasPrefix(segmentURI, "http://") || strings.HasPrefix(segmentURI, "https://") {
 		return segmentURI
 	}
 
-	// 如果没有设置前缀，直接返回原始 URI
+	// 如果没有设置前缀，基于当前播放列表的 URL 解析相对路径
 	if m.urlPrefix == "" {
-		return segmentURI
+		if m.playlistURL == "" {
+			return segmentURI
+		}
+		base, err := url.Parse(m.playlistURL)
+		if err != nil {
+			return segmentURI
+		}
+		ref, err := url.Parse(segmentURI)
+		if err != nil {
+			return segmentURI
+		}
+		return base.ResolveReference(ref).String()
 	}
 
 	// 组合前缀和 segment URI
@@ -346,24 +777,7 @@ func (m *M3U8Downloader) getStateFilePath() string {
 	return m.output + ".state.json"
 }
 
-func (m *M3U8Downloader) loadDownloadState() *downloadState {
-	stateFile := m.getStateFilePath()
-	data, err := os.ReadFile(stateFile)
-	if err != nil {
-		return nil
-	}
-
-	var state downloadState
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil
-	}
-	return &state
-}
-
-func (m *M3U8Downloader) saveDownloadState(state *downloadState) error {
-	data, err := json.Marshal(state)
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(m.getStateFilePath(), data, 0644)
+// getSegmentDir 返回并发下载时存放分片临时文件的目录
+func (m *M3U8Downloader) getSegmentDir() string {
+	return m.output + ".segments"
 }
@@ -0,0 +1,244 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestIsFragmentedMP4(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		want     bool
+	}{
+		{"no map", "#EXTINF:4,\n0.ts\n", false},
+		{"mp4 map", "#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4,\n0.m4s\n", true},
+		{"map with query", "#EXT-X-MAP:URI=\"init.mp4?token=1\"\n#EXTINF:4,\n0.m4s\n", true},
+		// TS 分片也可以有 EXT-X-MAP，此时仍然是 MPEG-TS
+		{"ts map", "#EXT-X-MAP:URI=\"init.ts?token=1\"\n#EXTINF:4,\n0.ts\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:4\n" + tt.playlist + "#EXT-X-ENDLIST\n"
+			playlist, _, err := decodePlaylist(strings.NewReader(text))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isFragmentedMP4(playlist.(*m3u8.MediaPlaylist)); got != tt.want {
+				t.Errorf("isFragmentedMP4() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsMP4File(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"ftyp", []byte("\x00\x00\x00\x18ftypiso6"), true},
+		{"moof", []byte("\x00\x00\x00\x10moof"), true},
+		{"ts", append([]byte{0x47, 0x40, 0x00, 0x10}, make([]byte, 184)...), false},
+		{"short", []byte("ftyp"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(name, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := isMP4File(name); got != tt.want {
+				t.Errorf("isMP4File() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if isMP4File(filepath.Join(dir, "missing")) {
+		t.Error("isMP4File() = true for a missing file")
+	}
+}
+
+func TestFFmpegArgs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ts := write("video.ts", []byte{0x47, 0x40, 0x00, 0x10, 0, 0, 0, 0})
+	fmp4 := write("video.m4s", []byte("\x00\x00\x00\x18ftypiso6"))
+	tsAudio := &rendition{alt: &m3u8.Alternative{Type: "AUDIO", Language: "en", Name: "English"}, path: write("audio.ts", []byte{0x47, 0, 0, 0, 0, 0, 0, 0})}
+	mp4Audio := &rendition{alt: &m3u8.Alternative{Type: "AUDIO", Language: "en"}, path: write("audio.m4s", []byte("\x00\x00\x00\x10moof"))}
+	subtitles := &rendition{alt: &m3u8.Alternative{Type: "SUBTITLES", Language: "zh"}, path: write("video.zh.vtt", []byte("WEBVTT\n"))}
+
+	tests := []struct {
+		name       string
+		input      string
+		tracks     []*rendition
+		fragmented bool
+		want       string
+	}{
+		{"ts", ts, nil, false, "-i video.ts -c copy -bsf:a aac_adtstoasc -y -loglevel warning out.mp4"},
+		// fMP4 中的 AAC 不是 ADTS，不能使用 aac_adtstoasc
+		{"fmp4", fmp4, nil, false, "-i video.m4s -c copy -y -loglevel warning out.mp4"},
+		{"fragmented output", ts, nil, true, "-i video.ts -movflags frag_keyframe+empty_moov+default_base_moof -c copy -bsf:a aac_adtstoasc -y -loglevel warning out.mp4"},
+		{"fmp4 with fmp4 audio", fmp4, []*rendition{mp4Audio}, false,
+			"-i video.m4s -i audio.m4s -map 0:v -map 1:a -map 0:a? -disposition:a:0 default -metadata:s:a:0 language=eng -c copy -c:s mov_text -y -loglevel warning out.mp4"},
+		// 任何一个输入是 MPEG-TS 时都需要转换 ADTS
+		{"fmp4 with ts audio and subtitles", fmp4, []*rendition{tsAudio, subtitles}, false,
+			"-i video.m4s -i audio.ts -i video.zh.vtt -map 0:v -map 1:a -map 0:a? -map 2:s -disposition:a:0 default " +
+				"-metadata:s:a:0 language=eng -metadata:s:a:0 title=English -metadata:s:s:0 language=chi -c copy -c:s mov_text -bsf:a aac_adtstoasc -y -loglevel warning out.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.Join(ffmpegArgs(tt.input, "out.mp4", tt.tracks, tt.fragmented), " ")
+			got = strings.ReplaceAll(got, dir+string(filepath.Separator), "")
+			if got != tt.want {
+				t.Errorf("ffmpegArgs() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadFMP4InitSegment(t *testing.T) {
+	// 初始化段是 init.mp4 中的一段，每个分片都重复声明同一个 EXT-X-MAP
+	const playlist = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="4@2"
+#EXTINF:4,
+0.m4s
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="4@2"
+#EXTINF:4,
+1.m4s
+#EXTINF:4,
+2.m4s
+#EXT-X-ENDLIST
+`
+	files := map[string]string{
+		"/init.mp4": "..INIT..",
+		"/0.m4s":    "[0]",
+		"/1.m4s":    "[1]",
+		"/2.m4s":    "[2]",
+	}
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/index.m3u8" {
+			w.Write([]byte(playlist))
+			return
+		}
+		// 初始化段最后完成，仍然要写在最前面
+		if r.URL.Path == "/init.mp4" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(files[r.URL.Path]))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	m := NewM3U8Downloader(&testClient{}, filepath.Join(t.TempDir(), "video"), nil, false)
+	p, err := m.loadMediaPlaylist(ctx, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := m.segmentJobs(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 4 || !jobs[0].init || jobs[0].byteRange == nil || *jobs[0].byteRange != (byteRange{2, 5}) {
+		t.Fatalf("got jobs %+v, want the init segment range 2-5 first", jobs)
+	}
+
+	tempFile := m.tempFilePath(p)
+	if filepath.Ext(tempFile) != ".m4s" {
+		t.Errorf("temp file %s should use the fMP4 extension", tempFile)
+	}
+	if err := m.downloadToFile(ctx, p, tempFile); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(tempFile); !bytes.Equal(data, []byte("INIT[0][1][2]")) {
+		t.Errorf("got %q, want the init segment once followed by the media segments", data)
+	}
+	if requests["/init.mp4"] != 1 {
+		t.Errorf("init segment requested %d times, want 1", requests["/init.mp4"])
+	}
+}
+
+func TestNeedsFFmpeg(t *testing.T) {
+	ts, fmp4 := &m3u8.MediaPlaylist{}, &m3u8.MediaPlaylist{Map: &m3u8.Map{URI: "init.mp4"}}
+	tests := []struct {
+		name      string
+		playlist  *m3u8.MediaPlaylist
+		audio     string
+		subtitles string
+		mode      string
+		want      bool
+	}{
+		{"ts with audio and sidecar subtitles", ts, "", "", "", false},
+		{"ts with muxed subtitles", ts, "none", "en", "mux", true},
+		{"fmp4 with audio", fmp4, "", "none", "", true},
+		{"fmp4 with sidecar subtitles only", fmp4, "none", "en", "", false},
+		{"fmp4 without renditions", fmp4, "none", "none", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParseRenditionPolicy(tt.audio, tt.subtitles, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &M3U8Downloader{master: testRenditionVariant(t), renditionPolicy: policy}
+			if got := m.needsFFmpeg(tt.playlist, false); got != tt.want {
+				t.Errorf("needsFFmpeg() = %v, want %v", got, tt.want)
+			}
+			// 录制直播时不下载备用音轨和字幕
+			if m.needsFFmpeg(tt.playlist, true) {
+				t.Error("needsFFmpeg() = true while recording")
+			}
+		})
+	}
+}
+
+func TestDownloadChecksFFmpegFirst(t *testing.T) {
+	// CMAF 视频加单独的音轨，没有 ffmpeg 时在下载分片前失败
+	files := map[string]string{
+		"/master.m3u8": "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",LANGUAGE=\"en\",NAME=\"English\",URI=\"audio.m3u8\"\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=800000,AUDIO=\"aud\"\nvideo.m3u8\n",
+		"/video.m3u8": "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:4\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4,\n0.m4s\n#EXT-X-ENDLIST\n",
+	}
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte(files[r.URL.Path]))
+	}))
+	defer srv.Close()
+
+	t.Setenv("PATH", "")
+	m := NewM3U8Downloader(&testClient{}, filepath.Join(t.TempDir(), "video"), nil, false)
+	_, err := m.DownloadFromURL(context.Background(), srv.URL+"/master.m3u8")
+	if err == nil || !strings.Contains(err.Error(), "ffmpeg") {
+		t.Fatalf("got error %v, want a missing ffmpeg error", err)
+	}
+	if got := strings.Join(requests, ","); got != "/master.m3u8,/video.m3u8" {
+		t.Errorf("requested %s, want only the playlists", got)
+	}
+}
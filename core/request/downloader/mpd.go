@@ -0,0 +1,419 @@
+package downloader
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MPD 清单中用到的元素，只包含下载所需的字段
+
+type mpdManifest struct {
+	XMLName                   xml.Name    `xml:"MPD"`
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   []string    `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        []string           `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID                string              `xml:"id,attr"`
+	ContentType       string              `xml:"contentType,attr"`
+	MimeType          string              `xml:"mimeType,attr"`
+	Codecs            string              `xml:"codecs,attr"`
+	Lang              string              `xml:"lang,attr"`
+	Label             string              `xml:"Label"`
+	Roles             []mpdDescriptor     `xml:"Role"`
+	ContentProtection []mpdDescriptor     `xml:"ContentProtection"`
+	BaseURL           []string            `xml:"BaseURL"`
+	SegmentTemplate   *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList       *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase       *mpdSegmentBase     `xml:"SegmentBase"`
+	Representations   []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID                string              `xml:"id,attr"`
+	Bandwidth         uint32              `xml:"bandwidth,attr"`
+	Width             int                 `xml:"width,attr"`
+	Height            int                 `xml:"height,attr"`
+	Codecs            string              `xml:"codecs,attr"`
+	MimeType          string              `xml:"mimeType,attr"`
+	ContentProtection []mpdDescriptor     `xml:"ContentProtection"`
+	BaseURL           []string            `xml:"BaseURL"`
+	SegmentTemplate   *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList       *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase       *mpdSegmentBase     `xml:"SegmentBase"`
+}
+
+type mpdDescriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdSegmentTemplate struct {
+	Media                  string           `xml:"media,attr"`
+	Initialization         string           `xml:"initialization,attr"`
+	StartNumber            *uint64          `xml:"startNumber,attr"`
+	Timescale              *uint64          `xml:"timescale,attr"`
+	Duration               uint64           `xml:"duration,attr"`
+	PresentationTimeOffset uint64           `xml:"presentationTimeOffset,attr"`
+	Timeline               *mpdTimeline     `xml:"SegmentTimeline"`
+	InitializationElement  *mpdURLWithRange `xml:"Initialization"`
+}
+
+type mpdTimeline struct {
+	S []struct {
+		T *uint64 `xml:"t,attr"`
+		D uint64  `xml:"d,attr"`
+		R int64   `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+type mpdSegmentList struct {
+	Timescale      *uint64          `xml:"timescale,attr"`
+	Duration       uint64           `xml:"duration,attr"`
+	Initialization *mpdURLWithRange `xml:"Initialization"`
+	SegmentURLs    []mpdSegmentURL  `xml:"SegmentURL"`
+}
+
+type mpdSegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr"`
+}
+
+type mpdURLWithRange struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+type mpdSegmentBase struct {
+	IndexRange     string           `xml:"indexRange,attr"`
+	Initialization *mpdURLWithRange `xml:"Initialization"`
+}
+
+// dashSegment 是展开后的一个分片地址
+type dashSegment struct {
+	url       string
+	byteRange *byteRange
+}
+
+// parseMPD 解析 MPD 清单
+func parseMPD(data []byte) (*mpdManifest, error) {
+	var manifest mpdManifest
+	if err := xml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode mpd: %w", err)
+	}
+	if len(manifest.Periods) == 0 {
+		return nil, fmt.Errorf("no period found in mpd")
+	}
+	return &manifest, nil
+}
+
+// kind 返回 AdaptationSet 的类型：video、audio 或 text
+func (a *mpdAdaptationSet) kind() string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	mimeType := a.MimeType
+	if mimeType == "" && len(a.Representations) > 0 {
+		mimeType = a.Representations[0].MimeType
+	}
+	kind, _, _ := strings.Cut(mimeType, "/")
+	if kind == "application" {
+		return "text"
+	}
+	return kind
+}
+
+// isMain 判断 AdaptationSet 是否带有 main 角色
+func (a *mpdAdaptationSet) isMain() bool {
+	for _, role := range a.Roles {
+		if role.Value == "main" {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveBaseURL 依次叠加各层 BaseURL，得到 Representation 的基准地址
+func resolveBaseURL(base string, levels ...[]string) (string, error) {
+	current, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	for _, level := range levels {
+		if len(level) == 0 || strings.TrimSpace(level[0]) == "" {
+			continue
+		}
+		ref, err := url.Parse(strings.TrimSpace(level[0]))
+		if err != nil {
+			return "", err
+		}
+		current = current.ResolveReference(ref)
+	}
+	return current.String(), nil
+}
+
+func resolveReference(base, ref string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(refURL).String(), nil
+}
+
+// parseMPDRange 解析 "start-end" 格式的字节范围
+func parseMPDRange(s string) (*byteRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	startStr, endStr, found := strings.Cut(s, "-")
+	if !found {
+		return nil, fmt.Errorf("invalid byte range: %s", s)
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid byte range: %s", s)
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start {
+		return nil, fmt.Errorf("invalid byte range: %s", s)
+	}
+	return &byteRange{start: start, end: end}, nil
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration 解析 xs:duration，例如 PT1H2M3.5S，返回秒数
+func parseISODuration(s string) (float64, error) {
+	matches := isoDurationPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if matches[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(matches[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		seconds += v * unit
+	}
+	return seconds, nil
+}
+
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0(\d+)d)?\$`)
+
+// expandTemplate 替换 SegmentTemplate 中的 $RepresentationID$、$Number$、$Bandwidth$、$Time$ 标识符
+func expandTemplate(template string, rep *mpdRepresentation, number, time uint64) string {
+	result := templateIdentifier.ReplaceAllStringFunc(template, func(match string) string {
+		parts := templateIdentifier.FindStringSubmatch(match)
+		var value string
+		switch parts[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			value = strconv.FormatUint(number, 10)
+		case "Bandwidth":
+			value = strconv.FormatUint(uint64(rep.Bandwidth), 10)
+		case "Time":
+			value = strconv.FormatUint(time, 10)
+		}
+		if parts[3] != "" {
+			width, _ := strconv.Atoi(parts[3])
+			for len(value) < width {
+				value = "0" + value
+			}
+		}
+		return value
+	})
+	return strings.ReplaceAll(result, "$$", "$")
+}
+
+// templateSegments 展开 SegmentTemplate，支持 SegmentTimeline 和固定时长两种方式
+func templateSegments(tmpl *mpdSegmentTemplate, rep *mpdRepresentation, baseURL string, periodDuration float64) (*dashSegment, []dashSegment, error) {
+	var init *dashSegment
+	if tmpl.Initialization != "" {
+		initURL, err := resolveReference(baseURL, expandTemplate(tmpl.Initialization, rep, 0, 0))
+		if err != nil {
+			return nil, nil, err
+		}
+		init = &dashSegment{url: initURL}
+	}
+
+	startNumber := uint64(1)
+	if tmpl.StartNumber != nil {
+		startNumber = *tmpl.StartNumber
+	}
+	timescale := uint64(1)
+	if tmpl.Timescale != nil && *tmpl.Timescale > 0 {
+		timescale = *tmpl.Timescale
+	}
+
+	var segments []dashSegment
+	add := func(number, time uint64) error {
+		segURL, err := resolveReference(baseURL, expandTemplate(tmpl.Media, rep, number, time))
+		if err != nil {
+			return err
+		}
+		segments = append(segments, dashSegment{url: segURL})
+		return nil
+	}
+
+	switch {
+	case tmpl.Timeline != nil:
+		number := startNumber
+		var t uint64
+		periodEnd := tmpl.PresentationTimeOffset + uint64(periodDuration*float64(timescale))
+		for i, s := range tmpl.Timeline.S {
+			if s.T != nil {
+				t = *s.T
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// r=-1 表示一直重复到下一个 S 元素或 Period 结束
+				end := periodEnd
+				if i+1 < len(tmpl.Timeline.S) && tmpl.Timeline.S[i+1].T != nil {
+					end = *tmpl.Timeline.S[i+1].T
+				}
+				if s.D == 0 || end <= t {
+					repeat = 0
+				} else {
+					repeat = int64((end-t+s.D-1)/s.D) - 1
+				}
+			}
+			for r := int64(0); r <= repeat; r++ {
+				if err := add(number, t); err != nil {
+					return nil, nil, err
+				}
+				number++
+				t += s.D
+			}
+		}
+	case tmpl.Duration > 0:
+		if periodDuration <= 0 {
+			return nil, nil, fmt.Errorf("cannot determine segment count without period duration")
+		}
+		count := uint64(math.Ceil(periodDuration * float64(timescale) / float64(tmpl.Duration)))
+		for i := uint64(0); i < count; i++ {
+			// $Time$ 是媒体时间，Period 开始对应 presentationTimeOffset
+			if err := add(startNumber+i, tmpl.PresentationTimeOffset+i*tmpl.Duration); err != nil {
+				return nil, nil, err
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("segment template has neither timeline nor duration")
+	}
+
+	return init, segments, nil
+}
+
+// listSegments 展开 SegmentList
+func listSegments(list *mpdSegmentList, baseURL string) (*dashSegment, []dashSegment, error) {
+	var init *dashSegment
+	if list.Initialization != nil {
+		seg, err := rangedSegment(baseURL, list.Initialization.SourceURL, list.Initialization.Range)
+		if err != nil {
+			return nil, nil, err
+		}
+		init = &seg
+	}
+
+	segments := make([]dashSegment, 0, len(list.SegmentURLs))
+	for _, segURL := range list.SegmentURLs {
+		seg, err := rangedSegment(baseURL, segURL.Media, segURL.MediaRange)
+		if err != nil {
+			return nil, nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return init, segments, nil
+}
+
+func rangedSegment(baseURL, ref, rangeStr string) (dashSegment, error) {
+	segURL := baseURL
+	if ref != "" {
+		var err error
+		if segURL, err = resolveReference(baseURL, ref); err != nil {
+			return dashSegment{}, err
+		}
+	}
+	r, err := parseMPDRange(rangeStr)
+	if err != nil {
+		return dashSegment{}, err
+	}
+	return dashSegment{url: segURL, byteRange: r}, nil
+}
+
+// parseSidx 解析 sidx box，返回各个子分片的字节范围。
+// indexEnd 是 sidx box 最后一个字节在文件中的偏移。
+func parseSidx(data []byte, indexEnd int64) ([]byteRange, error) {
+	// 查找 sidx box
+	for pos := 0; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		boxType := string(data[pos+4 : pos+8])
+		if size < 8 || pos+size > len(data) {
+			break
+		}
+		if boxType != "sidx" {
+			pos += size
+			continue
+		}
+
+		box := data[pos+8 : pos+size]
+		if len(box) < 4 {
+			break
+		}
+		version := box[0]
+		p := 4 + 4 + 4 // version/flags + reference_ID + timescale
+		var firstOffset uint64
+		if version == 0 {
+			if len(box) < p+8 {
+				break
+			}
+			firstOffset = uint64(binary.BigEndian.Uint32(box[p+4:]))
+			p += 8
+		} else {
+			if len(box) < p+16 {
+				break
+			}
+			firstOffset = binary.BigEndian.Uint64(box[p+8:])
+			p += 16
+		}
+		if len(box) < p+4 {
+			break
+		}
+		count := int(binary.BigEndian.Uint16(box[p+2:]))
+		p += 4
+
+		ranges := make([]byteRange, 0, count)
+		offset := indexEnd + 1 + int64(firstOffset)
+		for i := 0; i < count && p+12 <= len(box); i++ {
+			refSize := int64(binary.BigEndian.Uint32(box[p:]) & 0x7fffffff)
+			ranges = append(ranges, byteRange{start: offset, end: offset + refSize - 1})
+			offset += refSize
+			p += 12
+		}
+		return ranges, nil
+	}
+	return nil, fmt.Errorf("sidx box not found")
+}
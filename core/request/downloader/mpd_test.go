@@ -0,0 +1,130 @@
+package downloader
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+const testMPD = `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT7S">
+  <BaseURL>media/</BaseURL>
+  <Period>
+    <AdaptationSet contentType="video">
+      <SegmentTemplate timescale="1000" startNumber="5"
+        media="$RepresentationID$/seg-$Number%03d$-$Time$.m4s" initialization="$RepresentationID$/init.mp4">
+        <SegmentTimeline><S t="0" d="2000" r="2"/><S d="1000"/></SegmentTimeline>
+      </SegmentTemplate>
+      <Representation id="v720" bandwidth="1500000" width="1280" height="720"/>
+    </AdaptationSet>
+    <AdaptationSet contentType="audio" lang="en">
+      <SegmentTemplate media="a-$Number$.m4s" duration="3"/>
+      <Representation id="a1" bandwidth="128000"/>
+    </AdaptationSet>
+    <AdaptationSet contentType="audio" lang="fr">
+      <SegmentTemplate media="b-$Time$.m4s" timescale="90000" duration="270000" presentationTimeOffset="900000"/>
+      <Representation id="b1" bandwidth="128000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+func TestTemplateSegments(t *testing.T) {
+	manifest, err := parseMPD([]byte(testMPD))
+	if err != nil {
+		t.Fatalf("failed to parse mpd: %v", err)
+	}
+	duration, err := parseISODuration(manifest.MediaPresentationDuration)
+	if err != nil {
+		t.Fatalf("failed to parse duration: %v", err)
+	}
+	base, err := resolveBaseURL("https://example.com/v/manifest.mpd", manifest.BaseURL)
+	if err != nil {
+		t.Fatalf("failed to resolve base URL: %v", err)
+	}
+
+	sets := manifest.Periods[0].AdaptationSets
+	tests := []struct {
+		set  mpdAdaptationSet
+		init string
+		want []string
+	}{
+		{
+			set:  sets[0],
+			init: "https://example.com/v/media/v720/init.mp4",
+			want: []string{
+				"https://example.com/v/media/v720/seg-005-0.m4s",
+				"https://example.com/v/media/v720/seg-006-2000.m4s",
+				"https://example.com/v/media/v720/seg-007-4000.m4s",
+				"https://example.com/v/media/v720/seg-008-6000.m4s",
+			},
+		},
+		{
+			set: sets[1],
+			want: []string{
+				"https://example.com/v/media/a-1.m4s",
+				"https://example.com/v/media/a-2.m4s",
+				"https://example.com/v/media/a-3.m4s",
+			},
+		},
+		{
+			// $Time$ 是媒体时间，从 presentationTimeOffset 开始
+			set: sets[2],
+			want: []string{
+				"https://example.com/v/media/b-900000.m4s",
+				"https://example.com/v/media/b-1170000.m4s",
+				"https://example.com/v/media/b-1440000.m4s",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		rep := &tt.set.Representations[0]
+		init, segments, err := templateSegments(tt.set.SegmentTemplate, rep, base, duration)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", rep.ID, err)
+		}
+		if (init == nil) != (tt.init == "") || (init != nil && init.url != tt.init) {
+			t.Errorf("%s: init = %+v, want %q", rep.ID, init, tt.init)
+		}
+		if len(segments) != len(tt.want) {
+			t.Fatalf("%s: got %d segments, want %d", rep.ID, len(segments), len(tt.want))
+		}
+		for i, seg := range segments {
+			if seg.url != tt.want[i] {
+				t.Errorf("%s: segment %d = %q, want %q", rep.ID, i, seg.url, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestParseSidx(t *testing.T) {
+	// version 0 的 sidx，first_offset 为 0，包含三个引用
+	body := make([]byte, 0, 64)
+	body = append(body, 0, 0, 0, 0)
+	body = binary.BigEndian.AppendUint32(body, 1)    // reference_ID
+	body = binary.BigEndian.AppendUint32(body, 1000) // timescale
+	body = binary.BigEndian.AppendUint32(body, 0)    // earliest_presentation_time
+	body = binary.BigEndian.AppendUint32(body, 0)    // first_offset
+	body = binary.BigEndian.AppendUint16(body, 0)
+	body = binary.BigEndian.AppendUint16(body, 3)
+	for _, size := range []uint32{100, 200, 50} {
+		body = binary.BigEndian.AppendUint32(body, size)
+		body = binary.BigEndian.AppendUint32(body, 1000)
+		body = binary.BigEndian.AppendUint32(body, 0x90000000)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	box = append(append(box, "sidx"...), body...)
+
+	ranges, err := parseSidx(box, 999)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []byteRange{{1000, 1099}, {1100, 1299}, {1300, 1349}}
+	if len(ranges) != len(want) {
+		t.Fatalf("got %d ranges, want %d", len(ranges), len(want))
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Errorf("range %d = %v, want %v", i, ranges[i], want[i])
+		}
+	}
+}
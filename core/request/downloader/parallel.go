@@ -0,0 +1,389 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"MediaNinja/core/request/retry"
+)
+
+const (
+	minChunkSize = 1 << 20  // 小于两个分块的文件直接单连接下载
+	maxChunkSize = 16 << 20 // 分块越小，连接之间的负载越均衡，断点续传时重复下载的数据也越少
+
+	manifestSaveInterval = time.Second
+)
+
+// chunkState 表示闭区间 [Start, End]，Written 是从 Start 开始已确认写入的字节数
+type chunkState struct {
+	Start   int64 `json:"start"`
+	End     int64 `json:"end"`
+	Written int64 `json:"written"`
+}
+
+func (c *chunkState) done() bool {
+	return c.Start+c.Written > c.End
+}
+
+// contiguousSize 返回从文件开头起没有空洞的已写入字节数，也就是单连接下载可以续传的位置
+func (m *partManifest) contiguousSize() int64 {
+	var size int64
+	for _, c := range m.Chunks {
+		if c.Start != size {
+			break
+		}
+		size += c.Written
+		if !c.done() {
+			break
+		}
+	}
+	return size
+}
+
+// newChunks 把文件切分为分块。.part 文件中已有的前缀（单连接下载留下的）不再下载。
+func newChunks(size, existing int64, connections int) []chunkState {
+	chunkSize := size / int64(connections)
+	chunkSize = min(max(chunkSize, minChunkSize), maxChunkSize)
+
+	var chunks []chunkState
+	for start := int64(0); start < size; start += chunkSize {
+		c := chunkState{Start: start, End: min(start+chunkSize, size) - 1}
+		c.Written = min(max(existing-start, 0), c.End-c.Start+1)
+		chunks = append(chunks, c)
+	}
+	return chunks
+}
+
+// probeRanges 用 Range: bytes=0-0 探测服务器是否支持分块下载，返回包含文件总大小和校验信息的清单。
+// 部分 CDN 不支持 HEAD，因此用 GET 探测。只有服务器明确不支持 Range 时 ok 才为 false，
+// 网络错误和异常状态码作为错误返回，由重试策略处理。
+func (d *Downloader) probeRanges(ctx context.Context, url string, opts *RequestOption) (manifest *partManifest, ok bool, err error) {
+	resp, err := d.client.GetStream(ctx, "GET", url, opts, map[string]string{"Range": "bytes=0-0"})
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusRequestedRangeNotSatisfiable:
+		// 忽略 Range 的服务器返回完整文件，空文件没有可以请求的范围
+		return nil, false, nil
+	case http.StatusPartialContent:
+	default:
+		return nil, false, retry.NewStatusError(resp)
+	}
+	if strings.EqualFold(resp.Header.Get("Accept-Ranges"), "none") {
+		return nil, false, nil
+	}
+	_, _, total, found := parseContentRange(resp.Header.Get("Content-Range"))
+	if !found || total <= 0 {
+		return nil, false, nil
+	}
+	return newPartManifest(url, resp, total), true, nil
+}
+
+// parseContentRange 解析 "bytes start-end/total"，总大小未知（*）时 total 为 -1。
+// 416 响应中的 "bytes */total" 没有范围，start 和 end 为 -1。
+func parseContentRange(s string) (start, end, total int64, ok bool) {
+	s, found := strings.CutPrefix(strings.TrimSpace(s), "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rangePart, totalPart, found := strings.Cut(s, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+
+	var err error
+	start, end = -1, -1
+	if rangePart != "*" {
+		startPart, endPart, found := strings.Cut(rangePart, "-")
+		if !found {
+			return 0, 0, 0, false
+		}
+		if start, err = strconv.ParseInt(startPart, 10, 64); err != nil {
+			return 0, 0, 0, false
+		}
+		if end, err = strconv.ParseInt(endPart, 10, 64); err != nil || end < start {
+			return 0, 0, 0, false
+		}
+	}
+	total = -1
+	if totalPart != "*" {
+		if total, err = strconv.ParseInt(totalPart, 10, 64); err != nil {
+			return 0, 0, 0, false
+		}
+	}
+	return start, end, total, true
+}
+
+// downloadParallel 用多个连接分块下载到预先分配好大小的 .part 文件，分块进度记录在清单中。
+// 服务器明确不支持 Range 或文件太小时返回 handled 为 false，由调用方改用单连接下载。
+// ctx 取消时保存分块进度后返回，下次运行从清单继续。
+func (d *Downloader) downloadParallel(ctx context.Context, url string, filepath string, opts *RequestOption) (handled bool, finalPath string, err error) {
+	var probe *partManifest
+	var ok bool
+	err = d.retryPolicy().Do(ctx, func() (err error) {
+		probe, ok, err = d.probeRanges(ctx, url, opts)
+		return err
+	}, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return true, "", fmt.Errorf("download interrupted: %w", context.Cause(ctx))
+		}
+		return true, "", fmt.Errorf("failed to check range support: %w", err)
+	}
+	if !ok || probe.Size < 2*minChunkSize {
+		return false, "", nil
+	}
+
+	part, manifestFile := partPath(filepath), manifestPath(filepath)
+	manifest := loadPartManifest(manifestFile)
+	if manifest != nil && !manifest.sameResource(probe) {
+		fmt.Printf("Remote file %s changed, restarting download\n", url)
+		manifest = nil
+	}
+	if manifest == nil {
+		os.Remove(part)
+	}
+	if manifest == nil || manifest.Chunks == nil {
+		// 单连接下载留下的 .part 文件作为已完成的前缀
+		var existing int64
+		if fi, err := os.Stat(part); err == nil && manifest != nil {
+			existing = fi.Size()
+		}
+		manifest = probe
+		manifest.Chunks = newChunks(manifest.Size, existing, d.connections)
+	} else if fi, err := os.Stat(part); err == nil {
+		// 单连接续传截断了 .part 文件但没来得及更新清单时，超出文件的进度作废
+		for i := range manifest.Chunks {
+			c := &manifest.Chunks[i]
+			c.Written = min(c.Written, max(fi.Size()-c.Start, 0))
+		}
+	}
+
+	file, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return true, "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(manifest.Size); err != nil {
+		return true, "", fmt.Errorf("failed to preallocate file: %w", err)
+	}
+	if err := savePartManifest(manifestFile, manifest); err != nil {
+		return true, "", fmt.Errorf("failed to save download manifest: %w", err)
+	}
+
+	var written int64
+	var pending []int
+	for i := range manifest.Chunks {
+		written += manifest.Chunks[i].Written
+		if !manifest.Chunks[i].done() {
+			pending = append(pending, i)
+		}
+	}
+
+	var progress *DownloadProgress
+	if d.showProgress {
+		progress = NewDownloadProgress(path.Base(filepath), manifest.Size, written)
+	}
+
+	p := &parallelDownload{
+		d:        d,
+		url:      url,
+		opts:     opts,
+		file:     file,
+		manifest: manifest,
+		progress: progress,
+	}
+	err = p.run(ctx, pending, manifestFile)
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		finalPath, err = finishPartFile(filepath, manifest)
+	}
+	if err != nil {
+		if errors.Is(err, errRemoteChanged) {
+			removePartFile(filepath)
+		} else if ctx.Err() != nil {
+			err = fmt.Errorf("download interrupted, progress saved in %s: %w", manifestFile, context.Cause(ctx))
+		}
+		if progress != nil {
+			progress.Fail(err)
+		}
+		return true, "", err
+	}
+
+	if progress != nil {
+		progress.Success()
+	}
+	return true, finalPath, nil
+}
+
+// parallelDownload 是一次分块下载的共享状态，manifest 中分块的 Written 字段由 mu 保护
+type parallelDownload struct {
+	d        *Downloader
+	url      string
+	opts     *RequestOption
+	file     *os.File
+	progress *DownloadProgress
+
+	mu       sync.Mutex
+	manifest *partManifest
+}
+
+// run 使用 d.connections 个协程下载 pending 中的分块，并定期保存分块进度。
+// 返回前总会保存一次进度，包括 ctx 被取消的情况。
+func (p *parallelDownload) run(ctx context.Context, pending []int, manifestFile string) error {
+	queue := make(chan int)
+	errs := make(chan error, len(pending))
+	done := make(chan struct{})
+
+	go func() {
+		defer close(queue)
+		for _, i := range pending {
+			select {
+			case queue <- i:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < min(p.d.connections, len(pending)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				if err := p.fetchChunk(ctx, index); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	save := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		savePartManifest(manifestFile, p.manifest)
+	}
+
+	ticker := time.NewTicker(manifestSaveInterval)
+	defer ticker.Stop()
+	var err error
+	for {
+		select {
+		case <-ticker.C:
+			save()
+		case e := <-errs:
+			// 第一个分块失败后不再派发新的分块，等待正在下载的分块结束
+			if err == nil {
+				err = e
+				close(done)
+			}
+		case <-finished:
+			save()
+			if err == nil {
+				select {
+				case err = <-errs:
+				default:
+				}
+			}
+			if err == nil && ctx.Err() != nil {
+				// 取消时可能还有未派发的分块，不能当作下载完成
+				err = context.Cause(ctx)
+			}
+			return err
+		}
+	}
+}
+
+// fetchChunk 下载一个分块，失败时按重试策略从已写入的位置重试
+func (p *parallelDownload) fetchChunk(ctx context.Context, index int) error {
+	err := p.d.retryPolicy().Do(ctx, func() error {
+		err := p.fetchChunkOnce(ctx, index)
+		if errors.Is(err, errRemoteChanged) {
+			// 远程文件变化后已下载的分块全部作废，重试单个分块没有意义
+			return retry.Stop(err)
+		}
+		return err
+	}, nil)
+	if err == nil || errors.Is(err, errRemoteChanged) || ctx.Err() != nil {
+		return err
+	}
+	return fmt.Errorf("failed to download bytes %d-%d: %w", p.manifest.Chunks[index].Start, p.manifest.Chunks[index].End, err)
+}
+
+func (p *parallelDownload) fetchChunkOnce(ctx context.Context, index int) error {
+	p.mu.Lock()
+	chunk := p.manifest.Chunks[index]
+	p.mu.Unlock()
+
+	offset := chunk.Start + chunk.Written
+	resp, err := p.d.client.GetStream(ctx, "GET", p.url, p.opts, p.manifest.rangeHeaders(offset, chunk.End))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		// If-Range 不匹配，服务器返回了新的完整文件
+		return errRemoteChanged
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return retry.NewStatusError(resp)
+	}
+	if start, _, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || start != offset {
+		return fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+	}
+
+	buf := make([]byte, 32*1024)
+	body := io.LimitReader(resp.Body, chunk.End-offset+1)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := p.file.WriteAt(buf[:n], offset); werr != nil {
+				return werr
+			}
+			offset += int64(n)
+
+			p.mu.Lock()
+			p.manifest.Chunks[index].Written += int64(n)
+			p.mu.Unlock()
+			if p.progress != nil {
+				p.progress.Update(int64(n))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if offset <= chunk.End {
+		return fmt.Errorf("connection closed after %d of %d bytes", offset-chunk.Start, chunk.End-chunk.Start+1)
+	}
+	return nil
+}
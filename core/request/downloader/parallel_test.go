@@ -0,0 +1,196 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer 提供支持 Range 的文件，并记录收到的 Range 请求头
+func rangeServer(content []byte) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+func TestDownloadParallel(t *testing.T) {
+	content := make([]byte, 5*minChunkSize+123)
+	rand.New(rand.NewSource(1)).Read(content)
+	srv, requests := rangeServer(content)
+	defer srv.Close()
+
+	d := NewDownloader(&testClient{option: DownloadOption{Connections: 4}}, false)
+	url := srv.URL + "/video.mp4"
+	target := filepath.Join(t.TempDir(), "video.mp4")
+
+	// 模拟上次运行中第一个分块已经完成
+	manifest := &partManifest{URL: url, Size: int64(len(content))}
+	manifest.Chunks = newChunks(manifest.Size, 0, 4)
+	first := manifest.Chunks[0]
+	manifest.Chunks[0].Written = first.End - first.Start + 1
+	if err := os.WriteFile(partPath(target), content[:first.End+1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePartManifest(manifestPath(target), manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.DownloadFile(context.Background(), url, target, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded content differs from source")
+	}
+	for _, leftover := range []string{partPath(target), manifestPath(target)} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed after download", leftover)
+		}
+	}
+	for _, r := range requests() {
+		if strings.HasPrefix(r, "bytes=0-") && r != "bytes=0-0" {
+			t.Errorf("completed chunk was downloaded again: %s", r)
+		}
+	}
+}
+
+func TestDownloadParallelResumeSingleConnection(t *testing.T) {
+	content := make([]byte, 4*minChunkSize)
+	rand.New(rand.NewSource(4)).Read(content)
+
+	// 第二个分块发送一半后卡住，直到客户端取消，其余分块正常返回
+	sent := make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == fmt.Sprintf("bytes=%d-%d", minChunkSize, 2*minChunkSize-1) {
+			first := false
+			once.Do(func() { first = true })
+			if first {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", minChunkSize, 2*minChunkSize-1, len(content)))
+				w.Header().Set("Content-Length", fmt.Sprint(minChunkSize))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[minChunkSize : minChunkSize+minChunkSize/2])
+				w.(http.Flusher).Flush()
+				close(sent)
+				<-r.Context().Done()
+				return
+			}
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	url := srv.URL + "/video.mp4"
+	target := filepath.Join(t.TempDir(), "video.mp4")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-sent
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	parallel := NewDownloader(&testClient{option: DownloadOption{Connections: 4}}, false)
+	if _, err := parallel.DownloadFile(ctx, url, target, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	// 预先分配的 .part 文件已经是完整大小，不能按文件大小续传
+	if fi, err := os.Stat(partPath(target)); err != nil || fi.Size() != int64(len(content)) {
+		t.Fatalf("expected a preallocated .part file: %v", err)
+	}
+
+	single := NewDownloader(&testClient{option: DownloadOption{Connections: 1}}, false)
+	if _, err := single.DownloadFile(context.Background(), url, target, nil); err != nil {
+		t.Fatalf("unexpected error on resume: %v", err)
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("resumed download differs from source")
+	}
+}
+
+func TestContiguousSize(t *testing.T) {
+	m := &partManifest{Chunks: []chunkState{
+		{Start: 0, End: 9, Written: 10},
+		{Start: 10, End: 19, Written: 4},
+		{Start: 20, End: 29, Written: 10},
+	}}
+	if got := m.contiguousSize(); got != 14 {
+		t.Errorf("contiguousSize() = %d, want 14", got)
+	}
+}
+
+func TestDownloadParallelProbeRetry(t *testing.T) {
+	content := make([]byte, 4*minChunkSize)
+	rand.New(rand.NewSource(5)).Read(content)
+
+	// 第一次探测返回 503，不能当作服务器不支持 Range
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	url := srv.URL + "/video.mp4"
+	target := filepath.Join(t.TempDir(), "video.mp4")
+	d := NewDownloader(&testClient{option: DownloadOption{Connections: 4}, retries: 2}, false)
+	if _, err := d.DownloadFile(context.Background(), url, target, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := os.ReadFile(target); !bytes.Equal(got, content) {
+		t.Errorf("downloaded content differs from source")
+	}
+	for _, r := range ranges[2:] {
+		if r == "" || r == "bytes=0-0" {
+			t.Errorf("fell back to a single connection after the probe failed: %q", ranges)
+			break
+		}
+	}
+
+	// 探测一直失败时返回错误，而不是改用单连接下载
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(content)
+	})
+	if _, err := d.DownloadFile(context.Background(), url, filepath.Join(t.TempDir(), "other.mp4"), nil); err == nil {
+		t.Error("expected an error when the probe keeps failing")
+	}
+}
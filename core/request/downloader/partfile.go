@@ -0,0 +1,195 @@
+package downloader
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// errRemoteChanged 表示续传时服务器上的文件已经变化，已下载的部分作废
+var errRemoteChanged = errors.New("remote file changed since the download started")
+
+// partManifest 保存在 .part 文件旁边，记录续传时确认远程文件没有变化所需的信息
+type partManifest struct {
+	URL          string       `json:"url"`
+	ETag         string       `json:"etag,omitempty"`
+	LastModified string       `json:"last_modified,omitempty"`
+	Size         int64        `json:"size"`               // 预期大小，-1 表示未知
+	Checksum     string       `json:"checksum,omitempty"` // 服务器提供的摘要，格式为 "算法:十六进制"
+	ContentType  string       `json:"content_type,omitempty"`
+	Filename     string       `json:"filename,omitempty"` // Content-Disposition 中的文件名
+	Chunks       []chunkState `json:"chunks,omitempty"`   // 多连接下载时每个分块的进度
+	Final        string       `json:"final,omitempty"`    // 下载完成后改名得到的路径，见 existingDownload
+}
+
+func partPath(filepath string) string {
+	return filepath + ".part"
+}
+
+func manifestPath(filepath string) string {
+	return filepath + ".part.json"
+}
+
+func loadPartManifest(file string) *partManifest {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var m partManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	return &m
+}
+
+func savePartManifest(file string, m *partManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// newPartManifest 从响应头中读取校验信息
+func newPartManifest(url string, resp *http.Response, size int64) *partManifest {
+	return &partManifest{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         size,
+		Checksum:     responseChecksum(resp),
+		ContentType:  resp.Header.Get("Content-Type"),
+		Filename:     dispositionFilename(resp.Header.Get("Content-Disposition")),
+	}
+}
+
+// sameResource 判断两次请求拿到的是否是同一个文件
+func (m *partManifest) sameResource(other *partManifest) bool {
+	return m.URL == other.URL && m.Size == other.Size && m.ETag == other.ETag && m.LastModified == other.LastModified
+}
+
+// ifRange 返回续传请求的 If-Range 值。弱 ETag 不能用于 If-Range，此时改用 Last-Modified。
+func (m *partManifest) ifRange() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// rangeHeaders 返回续传请求头，服务器上的文件变化时 If-Range 让服务器返回完整的 200 响应
+func (m *partManifest) rangeHeaders(start, end int64) map[string]string {
+	headers := map[string]string{"Range": fmt.Sprintf("bytes=%d-", start)}
+	if end >= 0 {
+		headers["Range"] += fmt.Sprint(end)
+	}
+	if v := m.ifRange(); v != "" {
+		headers["If-Range"] = v
+	}
+	return headers
+}
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// responseChecksum 从 Repr-Digest（RFC 9530）、Digest（RFC 3230）或 Content-MD5 中读取整个文件的摘要。
+// Content-MD5 只描述响应体本身，因此只在完整的 200 响应中使用。
+func responseChecksum(resp *http.Response) string {
+	for _, name := range []string{"Repr-Digest", "Digest"} {
+		for _, item := range strings.Split(resp.Header.Get(name), ",") {
+			algorithm, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				continue
+			}
+			algorithm = strings.ToLower(algorithm)
+			if _, known := checksumAlgorithms[algorithm]; !known {
+				continue
+			}
+			if sum, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":")); err == nil {
+				return algorithm + ":" + hex.EncodeToString(sum)
+			}
+		}
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		if sum, err := base64.StdEncoding.DecodeString(resp.Header.Get("Content-MD5")); err == nil && len(sum) == md5.Size {
+			return "md5:" + hex.EncodeToString(sum)
+		}
+	}
+	return ""
+}
+
+// verifyPartFile 检查 .part 文件的大小和摘要是否与清单一致
+func verifyPartFile(part string, m *partManifest) error {
+	file, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if m.Size >= 0 && info.Size() != m.Size {
+		return fmt.Errorf("size mismatch: got %d bytes, want %d", info.Size(), m.Size)
+	}
+
+	if m.Checksum == "" {
+		return nil
+	}
+	algorithm, want, _ := strings.Cut(m.Checksum, ":")
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil
+	}
+	h := newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%s checksum mismatch: got %s, want %s", algorithm, got, want)
+	}
+	return nil
+}
+
+// finishPartFile 校验通过后把 .part 文件重命名为最终路径（见 finalPath）并返回该路径，
+// 校验失败时删除已下载的数据。最终路径与 filepath 不同时把它记录在清单中，再次下载时据此跳过。
+func finishPartFile(filepath string, m *partManifest) (string, error) {
+	part := partPath(filepath)
+	if err := verifyPartFile(part, m); err != nil {
+		removePartFile(filepath)
+		return "", fmt.Errorf("failed to verify download: %w", err)
+	}
+	final := finalPath(filepath, part, m)
+	if err := os.Rename(part, final); err != nil {
+		return "", fmt.Errorf("failed to move download into place: %w", err)
+	}
+	if final == filepath {
+		os.Remove(manifestPath(filepath))
+		return final, nil
+	}
+	m.Chunks, m.Final = nil, final
+	if err := savePartManifest(manifestPath(filepath), m); err != nil {
+		return "", fmt.Errorf("failed to save download manifest: %w", err)
+	}
+	return final, nil
+}
+
+// removePartFile 删除 .part 文件和清单，下次从头下载
+func removePartFile(filepath string) {
+	os.Remove(partPath(filepath))
+	os.Remove(manifestPath(filepath))
+}
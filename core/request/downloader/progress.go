@@ -36,19 +36,28 @@ type DownloadProgress struct {
 	bar        *mpb.Bar
 	totalSize  int64
 	lastUpdate time.Time
+	mu         sync.Mutex // 多个连接可能同时更新进度
 }
 
 func NewDownloadProgress(fileName string, totalSize, startPos int64) *DownloadProgress {
 	manager := GetProgressManager()
 
+	// Total size is unknown for streamed (chunked) responses, show only the downloaded size
+	counters := decor.CountersKiloByte("%.1f / %.1f", decor.WC{W: 20})
+	percentage := decor.Percentage(decor.WC{W: 5})
+	if totalSize <= 0 {
+		counters = decor.CurrentKiloByte("%.1f / ?", decor.WC{W: 20})
+		percentage = decor.Name("", decor.WC{W: 5})
+	}
+
 	// Create progress bar with decorators
 	bar := manager.progress.AddBar(totalSize,
 		mpb.PrependDecorators(
 			decor.Name(fileName, decor.WC{W: len(fileName) + 1, C: decor.DindentRight}),
-			decor.CountersKiloByte("%.1f / %.1f", decor.WC{W: 20}),
+			counters,
 		),
 		mpb.AppendDecorators(
-			decor.Percentage(decor.WC{W: 5}),
+			percentage,
 			decor.Name("] ", decor.WC{W: 1}),
 			decor.EwmaSpeed(decor.SizeB1024(0), "% .2f", 30, decor.WCSyncSpace),
 		),
@@ -74,11 +83,17 @@ func NewDownloadProgress(fileName string, totalSize, startPos int64) *DownloadPr
 }
 
 func (dp *DownloadProgress) Update(n int64) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
 	dp.bar.EwmaIncrBy(int(n), time.Since(dp.lastUpdate))
 	dp.lastUpdate = time.Now()
 }
 
 func (dp *DownloadProgress) Success() {
+	if dp.totalSize <= 0 {
+		// Bars of unknown size never reach their total, complete them explicitly
+		dp.bar.SetTotal(-1, true)
+	}
 	dp.bar.Completed()
 	GetProgressManager().RemoveTask(dp.fileName)
 }
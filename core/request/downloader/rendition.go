@@ -0,0 +1,463 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"MediaNinja/core/request/types"
+	"MediaNinja/utils/format"
+
+	"github.com/grafov/m3u8"
+)
+
+type RenditionInfo = types.RenditionInfo
+
+const (
+	renditionAudio    = "AUDIO"
+	renditionSubtitle = "SUBTITLES"
+
+	// SubtitleModeSidecar 将字幕保存为与视频同名的 .vtt 文件
+	SubtitleModeSidecar = "sidecar"
+	// SubtitleModeMux 将字幕写入最终的 mp4 文件
+	SubtitleModeMux = "mux"
+)
+
+// RenditionPolicy 描述 EXT-X-MEDIA 中备用音轨和字幕的选择方式
+type RenditionPolicy struct {
+	AudioLanguages    []string // 为空时选择默认音轨
+	SubtitleLanguages []string // 为空时选择全部字幕
+	SubtitleMode      string   // sidecar 或 mux
+}
+
+// ParseRenditionPolicy 解析音轨和字幕的选择条件。
+// 语言使用逗号分隔（如 "en,zh"），"all" 表示全部，"none" 表示不下载。
+func ParseRenditionPolicy(audio, subtitles, subtitleMode string) (RenditionPolicy, error) {
+	policy := RenditionPolicy{
+		AudioLanguages:    splitLanguages(audio),
+		SubtitleLanguages: splitLanguages(subtitles),
+		SubtitleMode:      strings.ToLower(strings.TrimSpace(subtitleMode)),
+	}
+
+	switch policy.SubtitleMode {
+	case "":
+		policy.SubtitleMode = SubtitleModeSidecar
+	case SubtitleModeSidecar, SubtitleModeMux:
+	default:
+		return policy, fmt.Errorf("unknown subtitle mode: %s", subtitleMode)
+	}
+	return policy, nil
+}
+
+func splitLanguages(s string) []string {
+	var languages []string
+	for _, lang := range strings.Split(s, ",") {
+		if lang = strings.ToLower(strings.TrimSpace(lang)); lang != "" {
+			languages = append(languages, lang)
+		}
+	}
+	return languages
+}
+
+// rendition 是一个需要下载的备用音轨或字幕
+type rendition struct {
+	alt  *m3u8.Alternative
+	url  string
+	path string // 下载完成后的文件路径
+}
+
+// Select 从变体关联的 EXT-X-MEDIA 中选出需要下载的音轨和字幕。
+// 没有 URI 的音轨已包含在视频流中，无需单独下载。
+func (p RenditionPolicy) Select(variant *m3u8.Variant) []*m3u8.Alternative {
+	var audios, subtitles []*m3u8.Alternative
+	seen := make(map[*m3u8.Alternative]bool)
+	for _, alt := range variant.Alternatives {
+		if alt == nil || seen[alt] {
+			continue
+		}
+		seen[alt] = true
+
+		switch strings.ToUpper(alt.Type) {
+		case renditionAudio:
+			audios = append(audios, alt)
+		case renditionSubtitle:
+			subtitles = append(subtitles, alt)
+		}
+	}
+
+	var selected []*m3u8.Alternative
+	if len(p.AudioLanguages) == 0 {
+		// 默认选择 DEFAULT=YES 的音轨，没有时选择第一个
+		var chosen *m3u8.Alternative
+		for _, alt := range audios {
+			if alt.Default {
+				chosen = alt
+				break
+			}
+		}
+		if chosen == nil && len(audios) > 0 {
+			chosen = audios[0]
+		}
+		if chosen != nil {
+			selected = append(selected, chosen)
+		}
+	} else {
+		selected = append(selected, matchLanguages(audios, p.AudioLanguages)...)
+	}
+
+	if len(p.SubtitleLanguages) == 0 {
+		selected = append(selected, subtitles...)
+	} else {
+		selected = append(selected, matchLanguages(subtitles, p.SubtitleLanguages)...)
+	}
+
+	result := selected[:0]
+	for _, alt := range selected {
+		if alt.URI != "" {
+			result = append(result, alt)
+		}
+	}
+	return result
+}
+
+// matchLanguages 按语言筛选，语言前缀匹配即可（"zh" 匹配 "zh-Hans"）
+func matchLanguages(alts []*m3u8.Alternative, languages []string) []*m3u8.Alternative {
+	var result []*m3u8.Alternative
+	for _, alt := range alts {
+		lang := strings.ToLower(alt.Language)
+		for _, want := range languages {
+			if want == "none" {
+				return nil
+			}
+			if want == "all" || lang == want || strings.HasPrefix(lang, want+"-") {
+				result = append(result, alt)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// info 返回写入 metadata.json 的描述信息
+func (r *rendition) info(sidecar bool) RenditionInfo {
+	info := RenditionInfo{
+		Type:     strings.ToLower(r.alt.Type),
+		Language: r.alt.Language,
+		Name:     r.alt.Name,
+		URI:      r.url,
+	}
+	if sidecar {
+		info.Path = r.path
+	}
+	return info
+}
+
+func (r *rendition) isSubtitle() bool {
+	return strings.EqualFold(r.alt.Type, renditionSubtitle)
+}
+
+// label 返回用于文件名的标签，优先使用语言
+func (r *rendition) label() string {
+	label := r.alt.Language
+	if label == "" {
+		label = r.alt.Name
+	}
+	if label == "" {
+		label = "und"
+	}
+	return format.SanitizeWindowsPath(label)
+}
+
+// sidecarPath 返回字幕文件路径，如 video.en.vtt
+func sidecarPath(output string, r *rendition) string {
+	base := strings.TrimSuffix(mp4Path(output), ".mp4")
+	return base + "." + r.label() + ".vtt"
+}
+
+// mpegtsClock 是 MPEG-TS 时间戳的时钟频率
+const mpegtsClock = 90000
+
+// maxStartPTSPackets 是查找视频起始 PTS 时最多读取的 TS 包数
+const maxStartPTSPackets = 4096
+
+// mergeWebVTT 合并多个 WebVTT 分片：只保留第一个文件头，去掉其余分片的 WEBVTT 头部。
+// 分片头部的 X-TIMESTAMP-MAP 把分片的 LOCAL 时间对应到 MPEG-TS 时间戳，合并时据此调整提示时间，
+// 使其相对于视频的第一帧 startPTS；startPTS 小于 0 表示未知，以第一个 X-TIMESTAMP-MAP 为起点。
+func mergeWebVTT(data []byte, startPTS int64) []byte {
+	var out bytes.Buffer
+	out.WriteString("WEBVTT\n\n")
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	inHeader := false
+	var offset time.Duration // 当前分片的提示时间需要加上的偏移
+	for scanner.Scan() {
+		line := strings.TrimPrefix(scanner.Text(), "\ufeff")
+		if strings.HasPrefix(line, "WEBVTT") {
+			inHeader = true
+			offset = 0
+			continue
+		}
+		if inHeader {
+			if mpegts, local, ok := parseTimestampMap(line); ok {
+				if startPTS < 0 {
+					startPTS = mpegts
+				}
+				offset = ptsDuration(mpegts-startPTS) - local
+			}
+			// 文件头在第一个空行处结束，其余头部字段一并丢弃
+			if strings.TrimSpace(line) == "" {
+				inHeader = false
+			}
+			continue
+		}
+		if offset != 0 && strings.Contains(line, "-->") {
+			line = shiftCueTiming(line, offset)
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+	return out.Bytes()
+}
+
+// parseTimestampMap 解析 X-TIMESTAMP-MAP=MPEGTS:<pts>,LOCAL:<时间>
+func parseTimestampMap(line string) (mpegts int64, local time.Duration, ok bool) {
+	value, found := strings.CutPrefix(strings.TrimSpace(line), "X-TIMESTAMP-MAP=")
+	if !found {
+		return 0, 0, false
+	}
+	var hasMPEGTS, hasLocal bool
+	for _, field := range strings.Split(value, ",") {
+		key, v, _ := strings.Cut(strings.TrimSpace(field), ":")
+		var err error
+		switch strings.ToUpper(key) {
+		case "MPEGTS":
+			mpegts, err = strconv.ParseInt(v, 10, 64)
+			hasMPEGTS = err == nil
+		case "LOCAL":
+			local, hasLocal = parseVTTTimestamp(v)
+		}
+	}
+	return mpegts, local, hasMPEGTS && hasLocal
+}
+
+// ptsDuration 把 90kHz 时间戳的差值转换为时长，差值跨过 33 位回绕时取较近的一侧
+func ptsDuration(delta int64) time.Duration {
+	const wrap = int64(1) << 33
+	if delta < -wrap/2 {
+		delta += wrap
+	} else if delta > wrap/2 {
+		delta -= wrap
+	}
+	return time.Duration(delta) * time.Second / mpegtsClock
+}
+
+// parseVTTTimestamp 解析 WebVTT 时间戳，格式为 hh:mm:ss.ttt 或 mm:ss.ttt
+func parseVTTTimestamp(s string) (time.Duration, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"0"}, parts...)
+	}
+	if len(parts) != 3 {
+		return 0, false
+	}
+	hours, err1 := strconv.Atoi(parts[0])
+	minutes, err2 := strconv.Atoi(parts[1])
+	seconds, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+	d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+	return d + time.Duration(seconds*float64(time.Second)).Round(time.Millisecond), true
+}
+
+func formatVTTTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// shiftCueTiming 把提示时间行（"开始 --> 结束 设置"）中的两个时间加上 offset，设置保持不变
+func shiftCueTiming(line string, offset time.Duration) string {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[1] != "-->" {
+		return line
+	}
+	start, ok1 := parseVTTTimestamp(fields[0])
+	end, ok2 := parseVTTTimestamp(fields[2])
+	if !ok1 || !ok2 {
+		return line
+	}
+	fields[0], fields[2] = formatVTTTimestamp(start+offset), formatVTTTimestamp(end+offset)
+	return strings.Join(fields, " ")
+}
+
+// tsStartPTS 返回 MPEG-TS 文件开头的音视频 PES 中最小的 PTS，不是 MPEG-TS 或找不到时返回 -1
+func tsStartPTS(name string) int64 {
+	file, err := os.Open(name)
+	if err != nil {
+		return -1
+	}
+	defer file.Close()
+
+	start := int64(-1)
+	pkt := make([]byte, tsPacketSize)
+	for i := 0; i < maxStartPTSPackets; i++ {
+		if _, err := io.ReadFull(file, pkt); err != nil || pkt[0] != 0x47 {
+			break
+		}
+		if pkt[1]&0x40 == 0 {
+			continue
+		}
+		_, payload := splitTSPacket(pkt)
+		if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			continue
+		}
+		// 只看音频（0xc0-0xdf）和视频（0xe0-0xef）流中带 PTS 的 PES
+		if id := payload[3]; id < 0xc0 || id > 0xef || payload[7]&0x80 == 0 {
+			continue
+		}
+		b := payload[9:14]
+		pts := int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+		if start < 0 || pts < start {
+			start = pts
+		}
+	}
+	return start
+}
+
+// iso639_2 把 HLS 中的 RFC 5646 语言标签转换为 mp4 使用的三字母语言代码
+func iso639_2(lang string) string {
+	primary, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	if len(primary) == 3 {
+		return primary
+	}
+	if code, ok := iso639Codes[primary]; ok {
+		return code
+	}
+	return "und"
+}
+
+var iso639Codes = map[string]string{
+	"ar": "ara", "de": "ger", "en": "eng", "es": "spa", "fr": "fre",
+	"hi": "hin", "id": "ind", "it": "ita", "ja": "jpn", "ko": "kor",
+	"ms": "may", "nl": "dut", "pl": "pol", "pt": "por", "ru": "rus",
+	"th": "tha", "tr": "tur", "uk": "ukr", "vi": "vie", "zh": "chi",
+}
+
+// downloadRenditions 下载选中的音轨和字幕。音轨失败时返回错误，字幕失败时只记录警告。
+// startPTS 是视频第一帧的 PTS，用于对齐字幕时间，未知时为 -1。
+func (m *M3U8Downloader) downloadRenditions(ctx context.Context, variant *m3u8.Variant, masterURL string, urlPrefix string, startPTS int64) error {
+	alts := m.renditionPolicy.Select(variant)
+	for i, alt := range alts {
+		altURL, err := m.buildVariantURL(alt.URI, masterURL)
+		if err != nil {
+			return fmt.Errorf("failed to build rendition URL: %w", err)
+		}
+
+		r := &rendition{alt: alt, url: altURL}
+		log.Printf("Downloading %s rendition %q (%s): %s", strings.ToLower(alt.Type), alt.Name, alt.Language, altURL)
+		if err := m.downloadRendition(ctx, r, i, urlPrefix, startPTS); err != nil {
+			if r.isSubtitle() && ctx.Err() == nil {
+				log.Printf("Warning: failed to download subtitle %q: %v", alt.Name, err)
+				continue
+			}
+			return fmt.Errorf("failed to download audio rendition %q: %w", alt.Name, err)
+		}
+		m.renditions = append(m.renditions, r)
+	}
+	return nil
+}
+
+// downloadRendition 使用独立的下载器下载一个备用播放列表，断点续传状态与视频分开保存
+func (m *M3U8Downloader) downloadRendition(ctx context.Context, r *rendition, index int, urlPrefix string, startPTS int64) error {
+	child := NewM3U8DownloaderWithPrefix(m.client, fmt.Sprintf("%s.%s%d", m.output, strings.ToLower(r.alt.Type), index), m.opts, m.showProgress, urlPrefix)
+	defer func() {
+		// 被取消时保留断点续传状态
+		if ctx.Err() == nil {
+			os.Remove(child.getStateFilePath())
+			os.RemoveAll(child.getSegmentDir())
+		}
+	}()
+
+	playlist, err := child.loadMediaPlaylist(ctx, r.url)
+	if err != nil {
+		return err
+	}
+	if r.isSubtitle() && isFragmentedMP4(playlist) {
+		return fmt.Errorf("fMP4 subtitle renditions are not supported")
+	}
+
+	tempFile := child.tempFilePath(playlist)
+	if err := child.downloadToFile(ctx, playlist, tempFile); err != nil {
+		return err
+	}
+
+	if !r.isSubtitle() {
+		r.path = tempFile
+		return nil
+	}
+
+	// 字幕分片合并为一个 WebVTT 文件
+	data, err := os.ReadFile(tempFile)
+	os.Remove(tempFile)
+	if err != nil {
+		return err
+	}
+	r.path = child.output + ".vtt"
+	if m.renditionPolicy.SubtitleMode == SubtitleModeSidecar {
+		r.path = m.uniqueSidecarPath(r, index)
+	}
+	return os.WriteFile(r.path, mergeWebVTT(data, startPTS), 0644)
+}
+
+// uniqueSidecarPath 返回字幕文件路径，同一语言有多个字幕时在文件名中加上序号
+func (m *M3U8Downloader) uniqueSidecarPath(r *rendition, index int) string {
+	path := sidecarPath(m.output, r)
+	for _, other := range m.renditions {
+		if other.path == path {
+			return strings.TrimSuffix(path, ".vtt") + fmt.Sprintf(".%d.vtt", index)
+		}
+	}
+	return path
+}
+
+// muxedRenditions 返回需要写入 mp4 的音轨和字幕
+func (m *M3U8Downloader) muxedRenditions() []*rendition {
+	var result []*rendition
+	for _, r := range m.renditions {
+		if r.isSubtitle() && m.renditionPolicy.SubtitleMode == SubtitleModeSidecar {
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// renditionInfos 返回写入 metadata.json 的音轨和字幕信息
+func (m *M3U8Downloader) renditionInfos() []RenditionInfo {
+	var infos []RenditionInfo
+	for _, r := range m.renditions {
+		sidecar := r.isSubtitle() && m.renditionPolicy.SubtitleMode == SubtitleModeSidecar
+		infos = append(infos, r.info(sidecar))
+	}
+	return infos
+}
+
+// cleanupRenditions 删除混流后不再需要的临时文件
+func (m *M3U8Downloader) cleanupRenditions() {
+	for _, r := range m.muxedRenditions() {
+		if r.path != "" {
+			os.Remove(r.path)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+const testRenditionMaster = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",LANGUAGE="en",NAME="English",DEFAULT=YES,URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",LANGUAGE="fr",NAME="French",URI="audio/fr.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",LANGUAGE="ja",NAME="Japanese"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",LANGUAGE="en",NAME="English",URI="subs/en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",LANGUAGE="zh-Hans",NAME="Chinese",URI="subs/zh.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,AUDIO="aud",SUBTITLES="subs"
+video.m3u8
+`
+
+func testRenditionVariant(t *testing.T) *m3u8.Variant {
+	t.Helper()
+	playlist, _, err := m3u8.DecodeFrom(strings.NewReader(testRenditionMaster), true)
+	if err != nil {
+		t.Fatalf("failed to decode master playlist: %v", err)
+	}
+	return playlist.(*m3u8.MasterPlaylist).Variants[0]
+}
+
+func TestRenditionPolicySelect(t *testing.T) {
+	variant := testRenditionVariant(t)
+	tests := []struct {
+		name      string
+		audio     string
+		subtitles string
+		want      []string
+	}{
+		{"defaults", "", "", []string{"AUDIO en", "SUBTITLES en", "SUBTITLES zh-Hans"}},
+		{"languages", "fr", "zh", []string{"AUDIO fr", "SUBTITLES zh-Hans"}},
+		{"all and none", "all", "none", []string{"AUDIO en", "AUDIO fr"}},
+		// 没有 URI 的音轨已包含在视频中
+		{"embedded audio", "ja", "en", []string{"SUBTITLES en"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParseRenditionPolicy(tt.audio, tt.subtitles, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, alt := range policy.Select(variant) {
+				got = append(got, alt.Type+" "+alt.Language)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Select() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseRenditionPolicy("", "", "burn-in"); err == nil {
+		t.Error("expected an error for an unknown subtitle mode")
+	}
+}
+
+// vttSegment 构造一个带 X-TIMESTAMP-MAP 的 WebVTT 分片
+func vttSegment(mpegts int64, local string, cues string) string {
+	return fmt.Sprintf("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:%s\n\n%s\n", mpegts, local, cues)
+}
+
+func TestMergeWebVTT(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		startPTS int64
+		want     string
+	}{
+		{
+			name: "segments anchored to the video start",
+			data: vttSegment(900000, "00:00:00.000", "00:00:01.000 --> 00:00:02.500 align:start\nHello\n") +
+				vttSegment(1800000, "00:00:00.000", "00:00:00.500 --> 00:00:01.000\nWorld\n"),
+			startPTS: 900000,
+			want:     "WEBVTT\n\n00:00:01.000 --> 00:00:02.500 align:start\nHello\n\n00:00:10.500 --> 00:00:11.000\nWorld\n\n",
+		},
+		{
+			name:     "local offset",
+			data:     vttSegment(900000, "00:00:10.000", "00:00:12.000 --> 00:00:13.000\nHello\n"),
+			startPTS: 900000,
+			want:     "WEBVTT\n\n00:00:02.000 --> 00:00:03.000\nHello\n\n",
+		},
+		{
+			name:     "video starts before subtitles",
+			data:     vttSegment(900000, "00:00:00.000", "00:01.000 --> 00:02.000\nHello\n"),
+			startPTS: 810000,
+			want:     "WEBVTT\n\n00:00:02.000 --> 00:00:03.000\nHello\n\n",
+		},
+		{
+			name: "unknown video start uses the first map",
+			data: vttSegment(183600, "00:00:00.000", "00:00:01.000 --> 00:00:02.000\nHello\n") +
+				vttSegment(183600+6*90000, "00:00:00.000", "00:00:01.000 --> 00:00:02.000\nWorld\n"),
+			startPTS: -1,
+			want:     "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n\n00:00:07.000 --> 00:00:08.000\nWorld\n\n",
+		},
+		{
+			name:     "timestamp rollover",
+			data:     vttSegment(0, "00:00:00.000", "00:00:01.000 --> 00:00:02.000\nHello\n"),
+			startPTS: 1<<33 - 90000,
+			want:     "WEBVTT\n\n00:00:02.000 --> 00:00:03.000\nHello\n\n",
+		},
+		{
+			name:     "no timestamp map",
+			data:     "WEBVTT\n\n00:01.000 --> 00:02.000\nHello\n",
+			startPTS: 900000,
+			want:     "WEBVTT\n\n00:01.000 --> 00:02.000\nHello\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(mergeWebVTT([]byte(tt.data), tt.startPTS)); got != tt.want {
+				t.Errorf("mergeWebVTT() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+// pesPacket 构造一个只包含 PES 头的 TS 包
+func pesPacket(pid uint16, streamID byte, pts int64) []byte {
+	pes := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5,
+		byte(0x21 | pts>>29&0x0e), byte(pts >> 22), byte(pts>>14 | 1), byte(pts >> 7), byte(pts<<1 | 1)}
+	return buildTSPacket(pid, true, nil, pes)
+}
+
+func TestTSStartPTS(t *testing.T) {
+	dir := t.TempDir()
+	ts := filepath.Join(dir, "video.ts")
+	data := append(pesPacket(0x100, 0xe0, 900090), pesPacket(0x101, 0xc0, 900000)...)
+	if err := os.WriteFile(ts, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := tsStartPTS(ts); got != 900000 {
+		t.Errorf("tsStartPTS() = %d, want 900000", got)
+	}
+
+	mp4 := filepath.Join(dir, "video.m4s")
+	if err := os.WriteFile(mp4, append([]byte("\x00\x00\x00\x18ftypiso6"), make([]byte, 400)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := tsStartPTS(mp4); got != -1 {
+		t.Errorf("tsStartPTS() = %d for fMP4, want -1", got)
+	}
+}
+
+func TestDownloadRenditions(t *testing.T) {
+	files := map[string]string{
+		"/audio/en.m3u8": "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\na0.aac\n#EXTINF:10,\na1.aac\n#EXT-X-ENDLIST\n",
+		"/audio/a0.aac":  "A0",
+		"/audio/a1.aac":  "A1",
+		"/subs/en.m3u8":  "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\ns0.vtt\n#EXTINF:10,\ns1.vtt\n#EXT-X-ENDLIST\n",
+		"/subs/s0.vtt":   vttSegment(900000, "00:00:00.000", "00:00:01.000 --> 00:00:02.000\nHello\n"),
+		"/subs/s1.vtt":   vttSegment(1800000, "00:00:00.000", "00:00:01.000 --> 00:00:02.000\nWorld\n"),
+		// subs/zh.m3u8 和 audio/fr.m3u8 不存在
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	variant := testRenditionVariant(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	m := NewM3U8Downloader(&testClient{retries: 1}, filepath.Join(dir, "video"), nil, false)
+	// 字幕下载失败只记录警告
+	if err := m.downloadRenditions(ctx, variant, srv.URL+"/master.m3u8", "", 900000); err != nil {
+		t.Fatalf("downloadRenditions() error = %v", err)
+	}
+	if len(m.renditions) != 2 {
+		t.Fatalf("got %d renditions, want audio and English subtitles", len(m.renditions))
+	}
+
+	audio, subtitles := m.renditions[0], m.renditions[1]
+	if data, _ := os.ReadFile(audio.path); string(data) != "A0A1" {
+		t.Errorf("audio = %q", data)
+	}
+	if want := filepath.Join(dir, "video.en.vtt"); subtitles.path != want {
+		t.Errorf("subtitle path = %s, want %s", subtitles.path, want)
+	}
+	want := "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n\n00:00:11.000 --> 00:00:12.000\nWorld\n\n"
+	if data, _ := os.ReadFile(subtitles.path); string(data) != want {
+		t.Errorf("subtitles =\n%q\nwant\n%q", data, want)
+	}
+	// sidecar 字幕不混入 mp4
+	if muxed := m.muxedRenditions(); len(muxed) != 1 || muxed[0] != audio {
+		t.Errorf("muxedRenditions() = %v, want only the audio track", muxed)
+	}
+
+	// 音轨下载失败时返回错误
+	m = NewM3U8Downloader(&testClient{retries: 1}, filepath.Join(dir, "french"), nil, false)
+	m.renditionPolicy, _ = ParseRenditionPolicy("fr", "none", "")
+	if err := m.downloadRenditions(ctx, variant, srv.URL+"/master.m3u8", "", 900000); err == nil {
+		t.Error("expected an error for a missing audio rendition")
+	}
+}
@@ -0,0 +1,440 @@
+package downloader
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+const tsPacketSize = 188
+
+// SAMPLE-AES 加密流在 PMT 中使用的流类型，以及解密后对应的明文流类型
+var sampleAESStreamTypes = map[byte]byte{
+	0xdb: 0x1b, // H.264
+	0xcf: 0x0f, // AAC (ADTS)
+}
+
+// decryptSampleAES 解密 SAMPLE-AES 加密的 MPEG-TS 分片。
+// 只有视频 NAL 单元和音频帧的部分数据被加密，因此需要先解出 PES，
+// 解密其中的样本后再重新打包成 TS 包，并把 PMT 中的流类型改回明文类型。
+func decryptSampleAES(data, key, iv []byte) ([]byte, error) {
+	if len(data)%tsPacketSize != 0 {
+		return nil, fmt.Errorf("SAMPLE-AES segment is not a valid MPEG-TS stream")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &sampleAESDemuxer{
+		block:   block,
+		iv:      iv,
+		streams: make(map[uint16]byte),
+		pending: make(map[uint16]*sampleAESPES),
+	}
+	return d.process(data)
+}
+
+// sampleAESPES 收集同一个 PES 的所有 TS 包
+type sampleAESPES struct {
+	streamType byte
+	firstAF    []byte // 第一个 TS 包的自适应字段（PCR 等），重新打包时保留
+	payload    []byte
+	slot       int // 重新打包后的 TS 包写回的位置（PES 第一个包的位置）
+}
+
+type sampleAESDemuxer struct {
+	block   cipher.Block
+	iv      []byte
+	pmtPID  int
+	streams map[uint16]byte // 加密流的 PID -> 加密流类型
+	pending map[uint16]*sampleAESPES
+	out     [][][]byte // 每个原始 TS 包的位置对应零个或多个输出包
+}
+
+func (d *sampleAESDemuxer) process(data []byte) ([]byte, error) {
+	d.pmtPID = -1
+	for off := 0; off < len(data); off += tsPacketSize {
+		pkt := append([]byte(nil), data[off:off+tsPacketSize]...)
+		if pkt[0] != 0x47 {
+			return nil, fmt.Errorf("lost MPEG-TS sync at offset %d", off)
+		}
+
+		pusi := pkt[1]&0x40 != 0
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		af, payload := splitTSPacket(pkt)
+
+		switch {
+		case pid == 0 && pusi:
+			d.parsePAT(payload)
+		case int(pid) == d.pmtPID && pusi:
+			d.rewritePMT(payload)
+		}
+
+		streamType, encrypted := d.streams[pid]
+		if !encrypted {
+			d.out = append(d.out, [][]byte{pkt})
+			continue
+		}
+
+		if pusi {
+			if err := d.flush(pid); err != nil {
+				return nil, err
+			}
+			d.pending[pid] = &sampleAESPES{
+				streamType: streamType,
+				firstAF:    trimAdaptationField(af),
+				slot:       len(d.out),
+			}
+		}
+
+		pes := d.pending[pid]
+		if pes == nil {
+			// PES 起始之前的数据无法解密，原样保留
+			d.out = append(d.out, [][]byte{pkt})
+			continue
+		}
+		pes.payload = append(pes.payload, payload...)
+		d.out = append(d.out, nil)
+	}
+
+	for pid := range d.pending {
+		if err := d.flush(pid); err != nil {
+			return nil, err
+		}
+	}
+
+	// 重新计算加密流的连续计数器
+	counters := make(map[uint16]byte)
+	result := make([]byte, 0, len(data))
+	for _, pkts := range d.out {
+		for _, pkt := range pkts {
+			pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+			if _, ok := d.streams[pid]; ok && pkt[3]&0x10 != 0 {
+				pkt[3] = pkt[3]&0xf0 | counters[pid]
+				counters[pid] = (counters[pid] + 1) & 0x0f
+			}
+			result = append(result, pkt...)
+		}
+	}
+	return result, nil
+}
+
+func (d *sampleAESDemuxer) parsePAT(payload []byte) {
+	section := psiSection(payload)
+	if len(section) < 12 {
+		return
+	}
+	sectionLen := int(section[1]&0x0f)<<8 | int(section[2])
+	end := min(3+sectionLen-4, len(section))
+	for i := 8; i+4 <= end; i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program != 0 {
+			d.pmtPID = int(section[i+2]&0x1f)<<8 | int(section[i+3])
+			return
+		}
+	}
+}
+
+// rewritePMT 记录加密流并把流类型改回明文类型，随后重新计算 CRC
+func (d *sampleAESDemuxer) rewritePMT(payload []byte) {
+	section := psiSection(payload)
+	if len(section) < 16 || section[0] != 0x02 {
+		return
+	}
+	sectionLen := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+sectionLen > len(section) {
+		return
+	}
+	end := 3 + sectionLen - 4
+	programInfoLen := int(section[10]&0x0f)<<8 | int(section[11])
+	for i := 12 + programInfoLen; i+5 <= end; {
+		pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+		if clear, ok := sampleAESStreamTypes[section[i]]; ok {
+			d.streams[pid] = section[i]
+			section[i] = clear
+		}
+		esInfoLen := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		i += 5 + esInfoLen
+	}
+
+	crc := crc32MPEG2(section[:end])
+	section[end] = byte(crc >> 24)
+	section[end+1] = byte(crc >> 16)
+	section[end+2] = byte(crc >> 8)
+	section[end+3] = byte(crc)
+}
+
+// flush 解密已收集完整的 PES 并重新打包
+func (d *sampleAESDemuxer) flush(pid uint16) error {
+	pes := d.pending[pid]
+	delete(d.pending, pid)
+	if pes == nil || len(pes.payload) < 9 {
+		return nil
+	}
+
+	raw := pes.payload
+	if raw[0] != 0 || raw[1] != 0 || raw[2] != 1 {
+		return fmt.Errorf("invalid PES start code on PID %d", pid)
+	}
+	headerLen := 9 + int(raw[8])
+	if headerLen > len(raw) {
+		return fmt.Errorf("truncated PES header on PID %d", pid)
+	}
+
+	var es []byte
+	switch pes.streamType {
+	case 0xdb:
+		es = d.decryptH264(raw[headerLen:])
+	case 0xcf:
+		es = d.decryptADTS(raw[headerLen:])
+	}
+
+	rebuilt := append(append([]byte(nil), raw[:headerLen]...), es...)
+	if raw[4] != 0 || raw[5] != 0 {
+		length := len(rebuilt) - 6
+		if length > 0xffff {
+			length = 0
+		}
+		rebuilt[4], rebuilt[5] = byte(length>>8), byte(length)
+	}
+
+	d.out[pes.slot] = packetizePES(pid, pes.firstAF, rebuilt)
+	return nil
+}
+
+// decryptH264 解密 H.264 码流中的 NAL 单元：
+// 仅处理长度大于 48 字节的 slice（类型 1 和 5），前 32 字节为明文，
+// 之后每 160 字节中的前 16 字节被加密，末尾不足 16 字节的部分为明文。
+func (d *sampleAESDemuxer) decryptH264(es []byte) []byte {
+	out := make([]byte, 0, len(es))
+	for _, nal := range splitAnnexB(es) {
+		out = append(out, 0, 0, 0, 1)
+		nalType := nal[0] & 0x1f
+		if len(nal) <= 48 || (nalType != 1 && nalType != 5) {
+			out = append(out, nal...)
+			continue
+		}
+
+		unescaped := removeEmulationPrevention(nal)
+		mode := cipher.NewCBCDecrypter(d.block, d.iv)
+		for pos := 32; len(unescaped)-pos > 16; pos += 160 {
+			mode.CryptBlocks(unescaped[pos:pos+16], unescaped[pos:pos+16])
+		}
+		out = append(out, addEmulationPrevention(unescaped)...)
+	}
+	return out
+}
+
+// decryptADTS 解密 AAC 音频帧：跳过 ADTS 头和随后的 16 字节明文，
+// 其余完整的 16 字节块被加密，末尾不足 16 字节的部分为明文。
+func (d *sampleAESDemuxer) decryptADTS(es []byte) []byte {
+	out := append([]byte(nil), es...)
+	for pos := 0; pos+7 <= len(out); {
+		if out[pos] != 0xff || out[pos+1]&0xf0 != 0xf0 {
+			break
+		}
+		headerLen := 7
+		if out[pos+1]&0x01 == 0 {
+			headerLen = 9
+		}
+		frameLen := int(out[pos+3]&0x03)<<11 | int(out[pos+4])<<3 | int(out[pos+5]>>5)
+		if frameLen < headerLen || pos+frameLen > len(out) {
+			break
+		}
+
+		start := pos + headerLen + 16
+		blocks := (frameLen - headerLen - 16) / aes.BlockSize
+		if blocks > 0 {
+			enc := out[start : start+blocks*aes.BlockSize]
+			cipher.NewCBCDecrypter(d.block, d.iv).CryptBlocks(enc, enc)
+		}
+		pos += frameLen
+	}
+	return out
+}
+
+// splitTSPacket 返回 TS 包的自适应字段（不含长度字节）和负载
+func splitTSPacket(pkt []byte) (af, payload []byte) {
+	control := (pkt[3] >> 4) & 0x03
+	pos := 4
+	if control&0x02 != 0 {
+		afLen := int(pkt[4])
+		if 5+afLen > tsPacketSize {
+			return nil, nil
+		}
+		af = pkt[5 : 5+afLen]
+		pos = 5 + afLen
+	}
+	if control&0x01 != 0 {
+		payload = pkt[pos:]
+	}
+	return af, payload
+}
+
+// trimAdaptationField 去掉自适应字段末尾的填充字节
+func trimAdaptationField(af []byte) []byte {
+	if len(af) == 0 {
+		return nil
+	}
+	flags := af[0]
+	n := 1
+	if flags&0x10 != 0 { // PCR
+		n += 6
+	}
+	if flags&0x08 != 0 { // OPCR
+		n += 6
+	}
+	if flags&0x04 != 0 { // splice countdown
+		n++
+	}
+	if flags&0x02 != 0 && n < len(af) { // private data
+		n += 1 + int(af[n])
+	}
+	if flags&0x01 != 0 && n < len(af) { // extension
+		n += 1 + int(af[n])
+	}
+	if n > len(af) {
+		return append([]byte(nil), af...)
+	}
+	return append([]byte(nil), af[:n]...)
+}
+
+// packetizePES 把 PES 重新切分为 TS 包，连续计数器在最后统一填写
+func packetizePES(pid uint16, firstAF []byte, pes []byte) [][]byte {
+	var packets [][]byte
+	af := firstAF
+	for first := true; first || len(pes) > 0; first = false {
+		capacity := 184
+		if af != nil {
+			capacity -= 1 + len(af)
+		}
+		n := min(capacity, len(pes))
+		packets = append(packets, buildTSPacket(pid, first, af, pes[:n]))
+		pes = pes[n:]
+		af = nil
+	}
+	return packets
+}
+
+// buildTSPacket 构造一个 TS 包，负载不足时用自适应字段填充
+func buildTSPacket(pid uint16, pusi bool, af []byte, payload []byte) []byte {
+	pkt := make([]byte, 4, tsPacketSize)
+	pkt[0] = 0x47
+	pkt[1] = byte(pid>>8) & 0x1f
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+
+	afSize := 184 - len(payload) // 包括长度字节在内的自适应字段长度
+	if af == nil && afSize == 0 {
+		pkt[3] = 0x10
+		return append(pkt, payload...)
+	}
+
+	pkt[3] = 0x30
+	pkt = append(pkt, byte(afSize-1))
+	if afSize > 1 {
+		if len(af) == 0 {
+			af = []byte{0x00}
+		}
+		pkt = append(pkt, af...)
+		for len(pkt) < 4+afSize {
+			pkt = append(pkt, 0xff)
+		}
+	}
+	return append(pkt, payload...)
+}
+
+// psiSection 根据 pointer_field 定位 PSI 表
+func psiSection(payload []byte) []byte {
+	if len(payload) == 0 {
+		return nil
+	}
+	start := 1 + int(payload[0])
+	if start >= len(payload) {
+		return nil
+	}
+	return payload[start:]
+}
+
+// splitAnnexB 按起始码拆分 NAL 单元
+func splitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				for end > start && data[end-1] == 0 {
+					end--
+				}
+				nals = append(nals, data[start:end])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	}
+	return nals
+}
+
+// removeEmulationPrevention 去掉 NAL 单元中的防竞争字节（00 00 03 -> 00 00）
+func removeEmulationPrevention(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// addEmulationPrevention 重新插入防竞争字节
+func addEmulationPrevention(nal []byte) []byte {
+	out := make([]byte, 0, len(nal)+len(nal)/64)
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b <= 0x03 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// crc32MPEG2 计算 PSI 表使用的 CRC32/MPEG-2 校验值
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,100 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+// NIST SP 800-38A F.2.1 中前两个块的明文和 CBC 密文
+var (
+	nistPlain  = mustHex("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51")
+	nistCipher = mustHex("7649abac8119b246cee98e9b12e9197d5086cb9b507219ee95db113a917678b2")
+)
+
+func newTestDemuxer(t *testing.T) *sampleAESDemuxer {
+	t.Helper()
+	block, err := aes.NewCipher(nistKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sampleAESDemuxer{block: block, iv: nistIV}
+}
+
+// h264NAL 构造一个 IDR slice：32 字节明文开头，加密块位于 32 和 192，末尾 5 字节明文
+func h264NAL(first, second []byte) []byte {
+	nal := bytes.Repeat([]byte{0xaa}, 32+160+16+5)
+	nal[0] = 0x65
+	copy(nal[32:48], first)
+	copy(nal[192:208], second)
+	return nal
+}
+
+func TestSampleAESDecryptH264(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac}
+	short := append([]byte{0x65}, bytes.Repeat([]byte{0xbb}, 47)...) // 不超过 48 字节的 slice 不加密
+	nonSlice := append([]byte{0x06}, bytes.Repeat([]byte{0xcc}, 99)...)
+
+	var es []byte
+	for _, nal := range [][]byte{sps, short, nonSlice, h264NAL(nistCipher[:16], nistCipher[16:])} {
+		es = append(append(es, 0, 0, 0, 1), nal...)
+	}
+	var want []byte
+	for _, nal := range [][]byte{sps, short, nonSlice, h264NAL(nistPlain[:16], nistPlain[16:])} {
+		want = append(append(want, 0, 0, 0, 1), nal...)
+	}
+
+	if got := newTestDemuxer(t).decryptH264(es); !bytes.Equal(got, want) {
+		t.Errorf("got  %s\nwant %s", hex.EncodeToString(got), hex.EncodeToString(want))
+	}
+}
+
+func TestSampleAESDecryptH264EmulationPrevention(t *testing.T) {
+	// 明文开头的 00 00 03 01 是防竞争字节，解密前去掉，解密后重新插入
+	nal := h264NAL(nistCipher[:16], nistCipher[16:])
+	escaped := append(append([]byte{}, nal[:8]...), 0, 0, 3, 1)
+	escaped = append(escaped, nal[11:]...)
+	want := h264NAL(nistPlain[:16], nistPlain[16:])
+	wantEscaped := append(append([]byte{}, want[:8]...), 0, 0, 3, 1)
+	wantEscaped = append(wantEscaped, want[11:]...)
+
+	got := newTestDemuxer(t).decryptH264(append([]byte{0, 0, 0, 1}, escaped...))
+	if !bytes.Equal(got, append([]byte{0, 0, 0, 1}, wantEscaped...)) {
+		t.Errorf("got %s", hex.EncodeToString(got))
+	}
+}
+
+// adtsFrame 构造一个没有 CRC 的 ADTS 帧
+func adtsFrame(payload []byte) []byte {
+	frameLen := 7 + len(payload)
+	header := []byte{0xff, 0xf1, 0x50, 0x80 | byte(frameLen>>11)&0x03, byte(frameLen >> 3), byte(frameLen&0x07)<<5 | 0x1f, 0xfc}
+	return append(header, payload...)
+}
+
+func TestSampleAESDecryptADTS(t *testing.T) {
+	lead := bytes.Repeat([]byte{0x11}, 16)
+	tail := []byte{0x22, 0x22, 0x22, 0x22, 0x22}
+	frame := func(enc []byte) []byte {
+		return adtsFrame(append(append(append([]byte{}, lead...), enc...), tail...))
+	}
+	// 不足 16 字节的帧没有加密块
+	small := adtsFrame([]byte{0x33, 0x33, 0x33})
+
+	es := append(append(frame(nistCipher), small...), frame(nistCipher)...)
+	want := append(append(frame(nistPlain), small...), frame(nistPlain)...)
+
+	// 每一帧都从 IV 重新开始 CBC
+	if got := newTestDemuxer(t).decryptADTS(es); !bytes.Equal(got, want) {
+		t.Errorf("got  %s\nwant %s", hex.EncodeToString(got), hex.EncodeToString(want))
+	}
+}
+
+func TestDecryptSampleAESRejectsInvalidTS(t *testing.T) {
+	if _, err := decryptSampleAES(make([]byte, tsPacketSize+1), nistKey, nistIV); err == nil {
+		t.Error("expected an error for data that is not whole TS packets")
+	}
+	if _, err := decryptSampleAES(make([]byte, tsPacketSize), nistKey, nistIV); err == nil {
+		t.Error("expected an error for a packet without the sync byte")
+	}
+}
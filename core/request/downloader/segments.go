@@ -0,0 +1,404 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"MediaNinja/core/request/retry"
+)
+
+// defaultSegmentWorkers 在未配置并发数时使用的分片下载协程数
+const defaultSegmentWorkers = 8
+
+// 用于保存下载进度的结构
+type downloadState struct {
+	DownloadedSegments map[string]bool `json:"downloaded_segments"` // 已按顺序写入输出文件的分片
+	TotalSegments      int             `json:"total_segments"`
+	WrittenSize        int64           `json:"written_size"` // 输出文件中已确认写入的字节数
+}
+
+func loadDownloadState(stateFile string) *downloadState {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return nil
+	}
+
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+	return &state
+}
+
+func saveDownloadState(stateFile string, state *downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(stateFile, data, 0644)
+}
+
+// matches 判断状态是否属于 jobs：已写入的分片必须正好是 jobs 开头的若干个。
+// 变体或播放列表变化后，输出文件中已有的数据不能继续使用。
+func (s *downloadState) matches(jobs []segmentJob) bool {
+	if s.TotalSegments != len(jobs) || len(s.DownloadedSegments) > len(jobs) {
+		return false
+	}
+	for _, job := range jobs[:len(s.DownloadedSegments)] {
+		if !s.DownloadedSegments[job.key] {
+			return false
+		}
+	}
+	return true
+}
+
+// segmentJob 描述一个待下载的分片
+type segmentJob struct {
+	index int    // 分片在播放列表中的序号，同时决定写入顺序
+	key   string // 断点续传状态中使用的唯一标识
+	url   string
+	seq   uint64 // 分片的媒体序号（EXT-X-MEDIA-SEQUENCE），录制直播时用于断点续传
+	init  bool   // EXT-X-MAP 初始化段
+
+	duration time.Duration // 分片的媒体时长（EXTINF），合并的任务为各分片之和
+
+	encryption *segmentEncryption // 为 nil 表示分片未加密
+	byteRange  *byteRange         // 为 nil 表示下载整个文件
+}
+
+// byteRange 表示 HTTP Range 请求的闭区间 [start, end]
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (r *byteRange) header() string {
+	return fmt.Sprintf("bytes=%d-%d", r.start, r.end)
+}
+
+func (r *byteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+// maxMergedRange 是合并相邻字节范围后单个请求的最大长度，避免整个文件变成一个请求而失去并发
+const maxMergedRange = 4 << 20
+
+// appendJob 追加一个分片任务。如果它和上一个任务是同一文件中紧挨着的字节范围，
+// 就合并成一个请求；加密分片需要各自解密，不合并。
+func appendJob(jobs []segmentJob, job segmentJob) []segmentJob {
+	if n := len(jobs); n > 0 {
+		last := &jobs[n-1]
+		if last.byteRange != nil && job.byteRange != nil &&
+			last.encryption == nil && job.encryption == nil &&
+			last.url == job.url &&
+			job.byteRange.start == last.byteRange.end+1 &&
+			job.byteRange.end-last.byteRange.start < maxMergedRange {
+			last.byteRange = &byteRange{start: last.byteRange.start, end: job.byteRange.end}
+			last.key = last.url + "@" + last.byteRange.String()
+			last.seq, last.init = job.seq, job.init
+			last.duration += job.duration
+			return jobs
+		}
+	}
+	job.index = len(jobs)
+	return append(jobs, job)
+}
+
+type segmentResult struct {
+	index int
+	err   error
+}
+
+// segmentPool 使用固定数量的协程并发下载分片，每个分片先写入独立的临时文件
+type segmentPool struct {
+	client  ClientInterface
+	opts    *RequestOption
+	dir     string
+	workers int
+	keys    *keyCache
+	policy  retry.Policy
+}
+
+func newSegmentPool(client ClientInterface, opts *RequestOption, dir string, workers int) *segmentPool {
+	if workers <= 0 {
+		workers = defaultSegmentWorkers
+	}
+	return &segmentPool{
+		client:  client,
+		opts:    opts,
+		dir:     dir,
+		workers: workers,
+		keys:    newKeyCache(client, opts),
+		policy:  retry.NewPolicy(client.GetMaxRetries(), client.GetRetryDelay()),
+	}
+}
+
+// segmentPath 返回分片临时文件路径。文件名包含 job.key 的摘要，
+// 变体或播放列表变化后，上次运行留下的同序号分片不会被当作已完成。
+func (p *segmentPool) segmentPath(job segmentJob) string {
+	sum := sha256.Sum256([]byte(job.key))
+	return filepath.Join(p.dir, fmt.Sprintf("%06d-%x.seg", job.index, sum[:8]))
+}
+
+// run 启动下载，返回的 channel 按完成顺序（而非播放列表顺序）输出结果。
+// 调用 stop 或 ctx 取消后不再派发新的分片，已在下载中的分片会继续完成（ctx 取消时会中断）。
+func (p *segmentPool) run(ctx context.Context, jobs []segmentJob) (results <-chan segmentResult, stop func()) {
+	out := make(chan segmentResult, len(jobs))
+	queue := make(chan segmentJob)
+	done := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		defer close(queue)
+		for _, job := range jobs {
+			select {
+			case queue <- job:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				out <- segmentResult{index: job.index, err: p.fetchWithRetry(ctx, job)}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, func() { once.Do(func() { close(done) }) }
+}
+
+// download 并发下载 jobs 并按顺序写入 outFile，已写入的分片记录在 stateFile 中，
+// 再次运行时跳过。progressName 为空时不显示进度条。
+// ctx 取消时已完整写入的分片仍记录在 stateFile 中，返回 ctx 取消的原因。
+func (p *segmentPool) download(ctx context.Context, jobs []segmentJob, outFile *os.File, stateFile string, progressName string) error {
+	totalSegments := len(jobs)
+
+	// 获取或创建下载状态
+	state := loadDownloadState(stateFile)
+	if state != nil && !state.matches(jobs) {
+		log.Printf("Playlist changed since the last run, restarting download")
+		state = nil
+	}
+	if state == nil {
+		state = &downloadState{
+			DownloadedSegments: make(map[string]bool),
+			TotalSegments:      totalSegments,
+		}
+	}
+
+	// 丢弃上次运行中写入了一半、尚未记录到状态文件的数据
+	if state.WrittenSize > 0 || len(state.DownloadedSegments) == 0 {
+		if err := outFile.Truncate(state.WrittenSize); err != nil {
+			return fmt.Errorf("failed to truncate temp file: %w", err)
+		}
+	}
+
+	// 已写入的片段跳过
+	pending := make([]segmentJob, 0, totalSegments)
+	for _, job := range jobs {
+		if !state.DownloadedSegments[job.key] {
+			pending = append(pending, job)
+		}
+	}
+
+	// 创建进度显示器
+	var progress *DownloadProgress
+	if progressName != "" {
+		progress = NewDownloadProgress(progressName, int64(totalSegments), int64(totalSegments-len(pending)))
+	}
+
+	return p.writeInOrder(ctx, pending, outFile, progress, func(job segmentJob, size int64) {
+		// 标记该片段已写入
+		state.DownloadedSegments[job.key] = true
+		state.WrittenSize = size
+		saveDownloadState(stateFile, state)
+	})
+}
+
+// writeInOrder 并发下载 jobs 并按顺序追加到 outFile，每写入一个分片调用一次 written，size 为写入后的文件大小。
+// progress 为 nil 时不显示进度。ctx 取消时返回取消的原因。
+func (p *segmentPool) writeInOrder(ctx context.Context, jobs []segmentJob, outFile *os.File, progress *DownloadProgress, written func(job segmentJob, size int64)) error {
+	// 分片可能乱序完成，但必须按顺序写入输出文件
+	runCtx, cancel := context.WithCancel(ctx)
+	results, stop := p.run(runCtx, jobs)
+	defer func() {
+		// 出错返回时中断仍在下载的分片，并等待所有协程退出，调用方随后可能删除分片目录
+		stop()
+		cancel()
+		for range results {
+		}
+	}()
+
+	fail := func(err error) error {
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+		if progress != nil {
+			progress.Fail(err)
+		}
+		return err
+	}
+
+	finished := make(map[int]bool, len(jobs))
+	next := 0
+	for res := range results {
+		if res.err != nil {
+			return fail(res.err)
+		}
+
+		finished[res.index] = true
+		if progress != nil {
+			progress.Update(1)
+		}
+
+		for next < len(jobs) && finished[jobs[next].index] {
+			job := jobs[next]
+			size, err := p.appendTo(outFile, job)
+			if err != nil {
+				return fail(err)
+			}
+			written(job, size)
+
+			delete(finished, job.index)
+			next++
+		}
+	}
+
+	// 取消时未派发的分片不会产生结果
+	if next < len(jobs) {
+		return fail(fmt.Errorf("%d segments were not downloaded", len(jobs)-next))
+	}
+
+	if progress != nil {
+		progress.Success()
+	}
+	return nil
+}
+
+// fetchWithRetry 按重试策略下载单个分片，失败的分片不会写入临时文件，重试时从头下载
+func (p *segmentPool) fetchWithRetry(ctx context.Context, job segmentJob) error {
+	return p.policy.Do(ctx, func() error {
+		return p.fetch(ctx, job)
+	}, func(attempt int, err error, delay time.Duration) {
+		log.Printf("Segment %s failed (%s): %v, retrying in %s", job.key, retry.Classify(err), err, delay.Round(time.Millisecond))
+	})
+}
+
+// fetch 下载单个分片到临时文件，已存在的分片文件视为上次运行中已完成
+func (p *segmentPool) fetch(ctx context.Context, job segmentJob) error {
+	target := p.segmentPath(job)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+
+	var headers map[string]string
+	if job.byteRange != nil {
+		headers = map[string]string{"Range": job.byteRange.header()}
+	}
+
+	resp, err := p.client.GetStream(ctx, "GET", job.url, p.opts, headers)
+	if err != nil {
+		return fmt.Errorf("failed to download segment %s: %w", job.key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("failed to download segment %s: %w", job.key, retry.NewStatusError(resp))
+	}
+
+	var body io.Reader = resp.Body
+	if job.byteRange != nil && resp.StatusCode == http.StatusOK {
+		// 服务器忽略了 Range 请求头，从完整响应中截取需要的部分
+		if _, err := io.CopyN(io.Discard, resp.Body, job.byteRange.start); err != nil {
+			return fmt.Errorf("failed to skip to range start of segment %s: %w", job.key, err)
+		}
+		body = io.LimitReader(resp.Body, job.byteRange.end-job.byteRange.start+1)
+	}
+
+	// 先写入 .part 文件，完成后再重命名，保证存在的分片文件一定是完整的
+	partFile := target + ".part"
+	file, err := os.Create(partFile)
+	if err != nil {
+		return fmt.Errorf("failed to create segment file: %w", err)
+	}
+	if err := p.writeSegment(ctx, file, body, job); err != nil {
+		file.Close()
+		os.Remove(partFile)
+		return fmt.Errorf("failed to write segment %s: %w", job.key, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(partFile)
+		return fmt.Errorf("failed to close segment file: %w", err)
+	}
+
+	return os.Rename(partFile, target)
+}
+
+// writeSegment 写入分片数据，加密分片在写入前先解密
+func (p *segmentPool) writeSegment(ctx context.Context, w io.Writer, body io.Reader, job segmentJob) error {
+	if job.encryption == nil {
+		_, err := io.Copy(w, body)
+		return err
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	key, err := p.keys.get(ctx, job.encryption.uri)
+	if err != nil {
+		return err
+	}
+	plaintext, err := job.encryption.decrypt(data, key)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt segment: %w", err)
+	}
+
+	_, err = w.Write(plaintext)
+	return err
+}
+
+// appendTo 将分片临时文件追加到输出文件末尾并删除临时文件，返回追加后的文件大小
+func (p *segmentPool) appendTo(outFile *os.File, job segmentJob) (int64, error) {
+	currentPos, err := outFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seek file: %w", err)
+	}
+
+	segFile, err := os.Open(p.segmentPath(job))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment file: %w", err)
+	}
+	n, err := io.Copy(outFile, segFile)
+	segFile.Close()
+	if err != nil {
+		// 如果写入失败，回滚文件位置
+		outFile.Truncate(currentPos)
+		return 0, fmt.Errorf("failed to write segment: %w", err)
+	}
+
+	os.Remove(p.segmentPath(job))
+	return currentPos + n, nil
+}
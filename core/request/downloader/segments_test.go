@@ -0,0 +1,306 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"MediaNinja/core/request/retry"
+
+	"github.com/grafov/m3u8"
+)
+
+const testByteRangePlaylist = `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:10
+#EXTINF:10,
+#EXT-X-BYTERANGE:1000@0
+video.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:1000
+video.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:5000000
+video.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:500@9000000
+video.ts
+#EXT-X-ENDLIST
+`
+
+func TestSegmentJobsByteRange(t *testing.T) {
+	playlist, _, err := decodePlaylist(strings.NewReader(testByteRangePlaylist))
+	if err != nil {
+		t.Fatalf("failed to decode playlist: %v", err)
+	}
+	m := &M3U8Downloader{playlistURL: "https://example.com/hls/index.m3u8"}
+	jobs, err := m.segmentJobs(playlist.(*m3u8.MediaPlaylist))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 前两个分片紧挨着，合并为一个请求；第三个合并后超过上限；第四个不连续
+	want := []byteRange{{0, 1999}, {2000, 5001999}, {9000000, 9000499}}
+	if len(jobs) != len(want) {
+		t.Fatalf("got %d jobs, want %d", len(jobs), len(want))
+	}
+	for i, job := range jobs {
+		if job.index != i {
+			t.Errorf("job %d has index %d", i, job.index)
+		}
+		if job.url != "https://example.com/hls/video.ts" {
+			t.Errorf("job %d url = %s", i, job.url)
+		}
+		if job.byteRange == nil || *job.byteRange != want[i] {
+			t.Errorf("job %d range = %v, want %v", i, job.byteRange, want[i])
+			continue
+		}
+		if wantKey := job.url + "@" + want[i].String(); job.key != wantKey {
+			t.Errorf("job %d key = %s, want %s", i, job.key, wantKey)
+		}
+	}
+}
+
+func TestSegmentJobsExplicitZeroOffset(t *testing.T) {
+	// 显式的 @0 从文件开头重新读取，不能当作省略偏移接在上一个分片之后
+	const text = `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:10
+#EXTINF:10,
+#EXT-X-BYTERANGE:100@0
+video.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:100@0
+video.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:50
+video.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:10
+other.ts
+#EXT-X-ENDLIST
+`
+	playlist, _, err := decodePlaylist(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("failed to decode playlist: %v", err)
+	}
+	m := &M3U8Downloader{playlistURL: "https://example.com/hls/index.m3u8"}
+	jobs, err := m.segmentJobs(playlist.(*m3u8.MediaPlaylist))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 第二个分片与第一个不相邻，不合并；第三个紧接在第二个之后；other.ts 的第一个分片从 0 开始
+	want := []struct {
+		url string
+		r   byteRange
+	}{
+		{"https://example.com/hls/video.ts", byteRange{0, 99}},
+		{"https://example.com/hls/video.ts", byteRange{0, 149}},
+		{"https://example.com/hls/other.ts", byteRange{0, 9}},
+	}
+	if len(jobs) != len(want) {
+		t.Fatalf("got %d jobs, want %d", len(jobs), len(want))
+	}
+	for i, job := range jobs {
+		if job.url != want[i].url || job.byteRange == nil || *job.byteRange != want[i].r {
+			t.Errorf("job %d = %s %v, want %s %v", i, job.url, job.byteRange, want[i].url, want[i].r)
+		}
+	}
+}
+
+func TestSegmentPoolRetries(t *testing.T) {
+	var requests sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := requests.LoadOrStore(r.URL.Path, new(int32))
+		switch attempt := atomic.AddInt32(n.(*int32), 1); {
+		case r.URL.Path == "/missing.ts":
+			w.WriteHeader(http.StatusNotFound)
+		case attempt == 1:
+			// 每个分片第一次请求都失败，第二次成功
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			io.WriteString(w, r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	jobs := []segmentJob{
+		{index: 0, key: "a", url: srv.URL + "/a.ts"},
+		{index: 1, key: "b", url: srv.URL + "/b.ts"},
+	}
+	pool := newSegmentPool(&testClient{retries: 2}, nil, t.TempDir(), 2)
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := pool.download(context.Background(), jobs, out, out.Name()+".state", ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out.Name()); string(data) != "/a.ts/b.ts" {
+		t.Errorf("got %q", data)
+	}
+
+	// 4xx 不重试
+	missing := segmentJob{index: 0, key: "missing", url: srv.URL + "/missing.ts"}
+	err = newSegmentPool(&testClient{retries: 3}, nil, t.TempDir(), 1).fetchWithRetry(context.Background(), missing)
+	if retry.Classify(err) != retry.ClientError {
+		t.Errorf("got %v, want a client error", err)
+	}
+	if n, _ := requests.Load("/missing.ts"); atomic.LoadInt32(n.(*int32)) != 1 {
+		t.Errorf("missing segment requested %d times, want 1", atomic.LoadInt32(n.(*int32)))
+	}
+}
+
+// segmentServer 返回分片的路径作为内容，delays 中的分片延迟返回
+func segmentServer(delays map[string]time.Duration) (*httptest.Server, *sync.Map) {
+	var requests sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := requests.LoadOrStore(r.URL.Path, new(int32))
+		atomic.AddInt32(n.(*int32), 1)
+		time.Sleep(delays[r.URL.Path])
+		io.WriteString(w, r.URL.Path)
+	}))
+	return srv, &requests
+}
+
+func testSegmentJobs(base string, names ...string) []segmentJob {
+	var jobs []segmentJob
+	for i, name := range names {
+		jobs = append(jobs, segmentJob{index: i, key: name, url: base + "/" + name})
+	}
+	return jobs
+}
+
+func TestSegmentPoolOrderedReassembly(t *testing.T) {
+	// 前面的分片完成得最晚，仍然按播放列表顺序写入
+	srv, _ := segmentServer(map[string]time.Duration{"/0.ts": 60 * time.Millisecond, "/1.ts": 30 * time.Millisecond})
+	defer srv.Close()
+
+	jobs := testSegmentJobs(srv.URL, "0.ts", "1.ts", "2.ts", "3.ts")
+	dir := t.TempDir()
+	out, err := os.Create(filepath.Join(dir, "out.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := newSegmentPool(&testClient{}, nil, t.TempDir(), 4).download(context.Background(), jobs, out, out.Name()+".state", ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out.Name()); string(data) != "/0.ts/1.ts/2.ts/3.ts" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestSegmentPoolResume(t *testing.T) {
+	srv, requests := segmentServer(nil)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	segDir := filepath.Join(dir, "segments")
+	if err := os.MkdirAll(segDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	jobs := testSegmentJobs(srv.URL, "0.ts", "1.ts", "2.ts")
+	pool := newSegmentPool(&testClient{}, nil, segDir, 2)
+
+	// 上次运行写入了第一个分片，下载完第三个分片，输出文件末尾还有写了一半的数据
+	out, err := os.Create(filepath.Join(dir, "out.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	out.WriteString("/0.ts/1.")
+	stateFile := out.Name() + ".state"
+	saveDownloadState(stateFile, &downloadState{DownloadedSegments: map[string]bool{"0.ts": true}, TotalSegments: 3, WrittenSize: 5})
+	os.WriteFile(pool.segmentPath(jobs[2]), []byte("/2.ts"), 0644)
+
+	if err := pool.download(context.Background(), jobs, out, stateFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out.Name()); string(data) != "/0.ts/1.ts/2.ts" {
+		t.Errorf("got %q", data)
+	}
+	for _, name := range []string{"/0.ts", "/2.ts"} {
+		if _, ok := requests.Load(name); ok {
+			t.Errorf("%s was downloaded again", name)
+		}
+	}
+}
+
+func TestSegmentPoolPlaylistChanged(t *testing.T) {
+	srv, _ := segmentServer(nil)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	segDir := filepath.Join(dir, "segments")
+	if err := os.MkdirAll(segDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pool := newSegmentPool(&testClient{}, nil, segDir, 2)
+
+	// 上次运行下载的是另一个变体，同序号的分片和已写入的数据都不能使用
+	old := testSegmentJobs(srv.URL, "low/0.ts", "low/1.ts")
+	os.WriteFile(pool.segmentPath(old[1]), []byte("/low/1.ts"), 0644)
+	out, err := os.Create(filepath.Join(dir, "out.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	out.WriteString("/low/0.ts")
+	stateFile := out.Name() + ".state"
+	saveDownloadState(stateFile, &downloadState{DownloadedSegments: map[string]bool{"low/0.ts": true}, TotalSegments: 2, WrittenSize: 9})
+
+	jobs := testSegmentJobs(srv.URL, "high/0.ts", "high/1.ts")
+	if err := pool.download(context.Background(), jobs, out, stateFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out.Name()); string(data) != "/high/0.ts/high/1.ts" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestSegmentPoolErrorStopsWorkers(t *testing.T) {
+	// 第二个分片开始写入后第一个分片才失败，返回时第二个分片的下载必须已经结束
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/0.ts" {
+			<-started
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	segDir := filepath.Join(dir, "segments")
+	if err := os.MkdirAll(segDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(dir, "out.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	jobs := testSegmentJobs(srv.URL, "0.ts", "1.ts")
+	if err := newSegmentPool(&testClient{}, nil, segDir, 2).download(context.Background(), jobs, out, out.Name()+".state", ""); err == nil {
+		t.Fatal("expected an error for the missing segment")
+	}
+	if entries, _ := os.ReadDir(segDir); len(entries) != 0 {
+		t.Errorf("segment directory still has %d files after download returned", len(entries))
+	}
+}
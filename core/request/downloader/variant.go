@@ -0,0 +1,198 @@
+package downloader
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"MediaNinja/core/request/types"
+
+	"github.com/grafov/m3u8"
+)
+
+type VariantSelection = types.VariantSelection
+type VariantInfo = types.VariantInfo
+
+// VariantPolicy 描述从 master 播放列表中选择变体的策略
+type VariantPolicy struct {
+	Worst     bool   // 选择码率最低的变体，默认选择码率最高的
+	MaxHeight int    // 分辨率上限（高度），0 表示不限制
+	Codec     string // 优先选择的编码，如 avc1、hvc1
+	Index     int    // 指定变体序号（从 0 开始，不计 I-frame 变体），-1 表示不指定
+}
+
+// DefaultVariantPolicy 默认选择码率最高的变体
+func DefaultVariantPolicy() VariantPolicy {
+	return VariantPolicy{Index: -1}
+}
+
+// ParseVariantPolicy 解析逗号分隔的变体选择策略，例如：
+//
+//	best                 码率最高（默认）
+//	worst                码率最低
+//	<=1080p              分辨率不超过 1080p
+//	codec=hvc1           优先选择指定编码
+//	index=2              指定 master 播放列表中的第 3 个变体（不计 I-frame 变体）
+//
+// 多个条件可以组合使用，如 "best,<=1080p,codec=avc1"。
+func ParseVariantPolicy(s string) (VariantPolicy, error) {
+	policy := DefaultVariantPolicy()
+	for _, term := range strings.Split(s, ",") {
+		term = strings.ToLower(strings.TrimSpace(term))
+		switch {
+		case term == "" || term == "best":
+			policy.Worst = false
+		case term == "worst":
+			policy.Worst = true
+		case strings.HasPrefix(term, "<="):
+			height, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(term, "<="), "p"))
+			if err != nil || height <= 0 {
+				return policy, fmt.Errorf("invalid resolution limit: %s", term)
+			}
+			policy.MaxHeight = height
+		case strings.HasPrefix(term, "codec="):
+			policy.Codec = strings.TrimPrefix(term, "codec=")
+			if policy.Codec == "" {
+				return policy, fmt.Errorf("empty codec preference")
+			}
+		case strings.HasPrefix(term, "index="):
+			index, err := strconv.Atoi(strings.TrimPrefix(term, "index="))
+			if err != nil || index < 0 {
+				return policy, fmt.Errorf("invalid variant index: %s", term)
+			}
+			policy.Index = index
+		default:
+			return policy, fmt.Errorf("unknown variant policy: %s", term)
+		}
+	}
+	return policy, nil
+}
+
+// String 返回策略的文本形式，写入 metadata.json
+func (p VariantPolicy) String() string {
+	if p.Index >= 0 {
+		return fmt.Sprintf("index=%d", p.Index)
+	}
+
+	terms := []string{"best"}
+	if p.Worst {
+		terms[0] = "worst"
+	}
+	if p.MaxHeight > 0 {
+		terms = append(terms, fmt.Sprintf("<=%dp", p.MaxHeight))
+	}
+	if p.Codec != "" {
+		terms = append(terms, "codec="+p.Codec)
+	}
+	return strings.Join(terms, ",")
+}
+
+// Select 按策略选择变体，返回选中的变体及选择记录
+func (p VariantPolicy) Select(variants []*m3u8.Variant) (*m3u8.Variant, *VariantSelection, error) {
+	candidates := make([]int, 0, len(variants))
+	for i, variant := range variants {
+		if variant != nil && variant.URI != "" && !variant.Iframe {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("no valid variant found in master playlist")
+	}
+
+	chosen := -1
+	if p.Index >= 0 {
+		// 序号与其他策略一样只在可播放的变体中计算，I-frame 变体不能作为主视频
+		if p.Index >= len(candidates) {
+			return nil, nil, fmt.Errorf("variant index %d out of range (%d variants)", p.Index, len(candidates))
+		}
+		chosen = candidates[p.Index]
+	} else {
+		pool := candidates
+		if p.MaxHeight > 0 {
+			pool = filterVariants(pool, func(i int) bool {
+				height := variantHeight(variants[i])
+				return height == 0 || height <= p.MaxHeight
+			})
+			if len(pool) == 0 {
+				// 所有变体都超过上限时退而选择分辨率最低的
+				pool = append([]int(nil), candidates...)
+				sort.SliceStable(pool, func(a, b int) bool {
+					return variantHeight(variants[pool[a]]) < variantHeight(variants[pool[b]])
+				})
+				pool = pool[:1]
+			}
+		}
+		if p.Codec != "" {
+			if preferred := filterVariants(pool, func(i int) bool {
+				return strings.Contains(strings.ToLower(variants[i].Codecs), p.Codec)
+			}); len(preferred) > 0 {
+				pool = preferred
+			}
+		}
+
+		chosen = pool[0]
+		for _, i := range pool[1:] {
+			if p.better(variants[i], variants[chosen]) {
+				chosen = i
+			}
+		}
+	}
+
+	selection := &VariantSelection{Policy: p.String()}
+	for index, i := range candidates {
+		if i == chosen {
+			selection.Selected = newVariantInfo(index, i, variants[i])
+		} else {
+			selection.Rejected = append(selection.Rejected, newVariantInfo(index, i, variants[i]))
+		}
+	}
+	return variants[chosen], selection, nil
+}
+
+// better 判断 a 是否比 b 更符合策略：先比较码率，码率相同时比较分辨率
+func (p VariantPolicy) better(a, b *m3u8.Variant) bool {
+	if a.Bandwidth != b.Bandwidth {
+		return (a.Bandwidth > b.Bandwidth) != p.Worst
+	}
+	ha, hb := variantHeight(a), variantHeight(b)
+	if ha != hb {
+		return (ha > hb) != p.Worst
+	}
+	return false
+}
+
+func filterVariants(indexes []int, keep func(int) bool) []int {
+	var result []int
+	for _, i := range indexes {
+		if keep(i) {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// variantHeight 从 RESOLUTION 属性（如 1920x1080）中解析高度，未知时返回 0
+func variantHeight(variant *m3u8.Variant) int {
+	_, height, found := strings.Cut(strings.ToLower(variant.Resolution), "x")
+	if !found {
+		return 0
+	}
+	h, err := strconv.Atoi(height)
+	if err != nil {
+		return 0
+	}
+	return h
+}
+
+// newVariantInfo 记录变体，index 是它在可播放变体中的序号，position 是它在 variants 中的位置
+func newVariantInfo(index, position int, variant *m3u8.Variant) VariantInfo {
+	return VariantInfo{
+		Index:      index,
+		Position:   position,
+		URI:        variant.URI,
+		Bandwidth:  variant.Bandwidth,
+		Resolution: variant.Resolution,
+		Codecs:     variant.Codecs,
+	}
+}
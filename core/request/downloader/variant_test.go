@@ -0,0 +1,101 @@
+package downloader
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+const testMasterPlaylist = `#EXTM3U
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,RESOLUTION=640x360,CODECS="avc1.4d401e",URI="360-iframes.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2"
+360.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2"
+1080.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=4000000,RESOLUTION=1920x1080,CODECS="hvc1.1.6.L120,mp4a.40.2"
+1080-hevc.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=9000000,RESOLUTION=3840x2160,CODECS="hvc1.1.6.L150,mp4a.40.2"
+2160.m3u8
+`
+
+func TestVariantPolicySelect(t *testing.T) {
+	playlist, _, err := m3u8.DecodeFrom(strings.NewReader(testMasterPlaylist), true)
+	if err != nil {
+		t.Fatalf("failed to decode master playlist: %v", err)
+	}
+	variants := playlist.(*m3u8.MasterPlaylist).Variants
+
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{name: "best", policy: "best", want: "2160.m3u8"},
+		{name: "worst", policy: "worst", want: "360.m3u8"},
+		{name: "max resolution", policy: "<=1080p", want: "1080.m3u8"},
+		{name: "codec preference", policy: "<=1080p,codec=hvc1", want: "1080-hevc.m3u8"},
+		{name: "exact index", policy: "index=1", want: "1080.m3u8"},
+		{name: "index skips iframe variants", policy: "index=0", want: "360.m3u8"},
+		{name: "limit below all variants", policy: "<=240p", want: "360.m3u8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParseVariantPolicy(tt.policy)
+			if err != nil {
+				t.Fatalf("ParseVariantPolicy(%q) error = %v", tt.policy, err)
+			}
+			variant, selection, err := policy.Select(variants)
+			if err != nil {
+				t.Fatalf("Select() error = %v", err)
+			}
+			if variant.URI != tt.want {
+				t.Errorf("Select() = %s, want %s", variant.URI, tt.want)
+			}
+			// I-frame 变体不参与选择，也不出现在 Rejected 中
+			if len(selection.Rejected) != len(variants)-2 {
+				t.Errorf("Select() rejected %d variants, want %d", len(selection.Rejected), len(variants)-2)
+			}
+		})
+	}
+}
+
+func TestVariantSelectionIndex(t *testing.T) {
+	playlist, _, err := m3u8.DecodeFrom(strings.NewReader(testMasterPlaylist), true)
+	if err != nil {
+		t.Fatalf("failed to decode master playlist: %v", err)
+	}
+	// 记录的序号与 index=N 一致，原始位置包括前面的 I-frame 变体
+	policy, _ := ParseVariantPolicy("index=1")
+	_, selection, err := policy.Select(playlist.(*m3u8.MasterPlaylist).Variants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := selection.Selected; got.Index != 1 || got.Position != 2 {
+		t.Errorf("selected index %d position %d, want index 1 position 2", got.Index, got.Position)
+	}
+	if got := selection.Rejected[0]; got.URI != "360.m3u8" || got.Index != 0 || got.Position != 1 {
+		t.Errorf("first rejected variant = %+v, want 360.m3u8 at index 0 position 1", got)
+	}
+}
+
+func TestVariantPolicyIndexOutOfRange(t *testing.T) {
+	playlist, _, err := m3u8.DecodeFrom(strings.NewReader(testMasterPlaylist), true)
+	if err != nil {
+		t.Fatalf("failed to decode master playlist: %v", err)
+	}
+	// 5 个变体中有一个 I-frame 变体，index=4 超出范围
+	policy, _ := ParseVariantPolicy("index=4")
+	if variant, _, err := policy.Select(playlist.(*m3u8.MasterPlaylist).Variants); err == nil {
+		t.Errorf("Select() = %s, want an out of range error", variant.URI)
+	}
+}
+
+func TestParseVariantPolicyInvalid(t *testing.T) {
+	for _, s := range []string{"fastest", "<=abc", "index=-1", "codec="} {
+		if _, err := ParseVariantPolicy(s); err == nil {
+			t.Errorf("ParseVariantPolicy(%q) expected error", s)
+		}
+	}
+}
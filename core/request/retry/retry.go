@@ -0,0 +1,261 @@
+package retry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultMaxDelay 是指数退避的等待时间上限
+	DefaultMaxDelay = time.Minute
+	// DefaultJitter 是等待时间随机缩短的最大比例，避免多个协程同时重试
+	DefaultJitter = 0.2
+	// maxRetryAfter 是 Retry-After 等待时间的上限，防止服务器让下载挂起太久
+	maxRetryAfter = 5 * time.Minute
+)
+
+// Kind 是错误的分类，决定是否值得重试
+type Kind int
+
+const (
+	Unknown     Kind = iota // 无法识别的错误，例如读取中途连接断开，按临时错误重试
+	DNS                     // 域名解析失败
+	Reset                   // 连接被拒绝、重置或意外关闭
+	Timeout                 // 连接、响应头或读取数据超时
+	ClientError             // 4xx，请求本身有问题，重试没有意义
+	ServerError             // 5xx
+	Throttled               // 429 或带 Retry-After 的 503
+	Canceled                // ctx 被取消
+	Fatal                   // 证书错误等不可恢复的错误，或被 Stop 标记的错误
+)
+
+var kindNames = map[Kind]string{
+	Unknown:     "unknown",
+	DNS:         "dns",
+	Reset:       "connection reset",
+	Timeout:     "timeout",
+	ClientError: "client error",
+	ServerError: "server error",
+	Throttled:   "throttled",
+	Canceled:    "canceled",
+	Fatal:       "fatal",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// StatusError 表示服务器返回了非预期的状态码
+type StatusError struct {
+	Code       int
+	RetryAfter time.Duration // 响应中的 Retry-After，0 表示没有
+}
+
+// NewStatusError 从响应中读取状态码和 Retry-After
+func NewStatusError(resp *http.Response) *StatusError {
+	retryAfter, _ := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return &StatusError{Code: resp.StatusCode, RetryAfter: retryAfter}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.Code)
+}
+
+// HTTPStatus 返回状态码，其他包中携带状态码的错误实现同样的方法即可参与分类
+func (e *StatusError) HTTPStatus() int {
+	return e.Code
+}
+
+// RetryAfterDelay 返回服务器要求的等待时间
+func (e *StatusError) RetryAfterDelay() time.Duration {
+	return e.RetryAfter
+}
+
+// ParseRetryAfter 解析以秒数或 HTTP 日期表示的 Retry-After
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// stopError 标记不应重试的错误
+type stopError struct{ err error }
+
+func (e *stopError) Error() string { return e.err.Error() }
+func (e *stopError) Unwrap() error { return e.err }
+
+// Stop 包装 err，使 Do 不再重试，errors.Is/As 仍能看到原来的错误
+func Stop(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stopError{err}
+}
+
+// Classify 返回错误的分类
+func Classify(err error) Kind {
+	var stop *stopError
+	if errors.As(err, &stop) {
+		return Fatal
+	}
+
+	var status interface{ HTTPStatus() int }
+	if errors.As(err, &status) {
+		code := status.HTTPStatus()
+		switch {
+		case code == http.StatusTooManyRequests:
+			return Throttled
+		case code == http.StatusServiceUnavailable && retryAfter(err) > 0:
+			return Throttled
+		case code == http.StatusRequestTimeout:
+			return Timeout
+		case code >= 500:
+			return ServerError
+		case code >= 400:
+			return ClientError
+		}
+		return Unknown
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return Canceled
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return Fatal
+		}
+		return DNS
+	}
+
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &verifyErr) || errors.As(err, &authorityErr) || errors.As(err, &hostErr) || errors.As(err, &invalidErr) {
+		return Fatal
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Timeout
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return Timeout
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return Reset
+	}
+	return Unknown
+}
+
+// Retryable 判断错误是否值得重试
+func Retryable(err error) bool {
+	switch Classify(err) {
+	case ClientError, Canceled, Fatal:
+		return false
+	}
+	return true
+}
+
+// retryAfter 返回错误中携带的 Retry-After
+func retryAfter(err error) time.Duration {
+	var ra interface{ RetryAfterDelay() time.Duration }
+	if errors.As(err, &ra) {
+		return ra.RetryAfterDelay()
+	}
+	return 0
+}
+
+// Policy 是重试策略：第 n 次重试前等待 BaseDelay*2^(n-1)，不超过 MaxDelay，
+// 再随机缩短最多 Jitter 比例；服务器给出 Retry-After 时按它等待
+type Policy struct {
+	MaxAttempts int // 包括第一次在内的最多尝试次数
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+}
+
+// NewPolicy 按重试次数和初始等待时间创建策略，其余参数使用默认值
+func NewPolicy(maxAttempts int, baseDelay time.Duration) Policy {
+	return Policy{
+		MaxAttempts: max(maxAttempts, 1),
+		BaseDelay:   baseDelay,
+		MaxDelay:    max(DefaultMaxDelay, baseDelay),
+		Jitter:      DefaultJitter,
+	}
+}
+
+// Delay 返回第 attempt 次失败（从 1 开始）后、下一次尝试前的等待时间
+func (p Policy) Delay(attempt int, err error) time.Duration {
+	if ra := retryAfter(err); ra > 0 {
+		return min(ra, maxRetryAfter)
+	}
+
+	delay := p.BaseDelay << min(attempt-1, 30)
+	if delay > p.MaxDelay || delay < 0 {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// Do 执行 op，失败且错误值得重试时按策略等待后再次执行。notify 不为 nil 时在每次等待前调用。
+// 重试次数用完时返回的错误包含尝试次数；ctx 取消时返回取消的原因。
+func (p Policy) Do(ctx context.Context, op func() error, notify func(attempt int, err error, delay time.Duration)) error {
+	attempts := max(p.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if !Retryable(err) {
+			return err
+		}
+		if attempt >= attempts {
+			if attempts > 1 {
+				return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+			}
+			return err
+		}
+
+		delay := p.Delay(attempt, err)
+		if notify != nil {
+			notify(attempt, err, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return context.Cause(ctx)
+		case <-timer.C:
+		}
+	}
+}
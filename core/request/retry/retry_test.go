@@ -0,0 +1,149 @@
+package retry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string { return "i/o timeout" }
+func (timeoutErr) Timeout() bool { return true }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err  error
+		want Kind
+	}{
+		{&StatusError{Code: 429}, Throttled},
+		{&StatusError{Code: 503, RetryAfter: time.Second}, Throttled},
+		{&StatusError{Code: 503}, ServerError},
+		{fmt.Errorf("wrapped: %w", &StatusError{Code: 502}), ServerError},
+		{&StatusError{Code: 404}, ClientError},
+		{&StatusError{Code: 408}, Timeout},
+		{&net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, Fatal},
+		{&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, DNS},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, Reset},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, Reset},
+		{io.ErrUnexpectedEOF, Reset},
+		{timeoutErr{}, Timeout},
+		{context.DeadlineExceeded, Timeout},
+		{fmt.Errorf("request: %w", context.Canceled), Canceled},
+		{&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, Fatal},
+		{x509.HostnameError{Host: "example.com"}, Fatal},
+		{Stop(&StatusError{Code: 500}), Fatal},
+		{errors.New("something else"), Unknown},
+	}
+	for _, tt := range tests {
+		if got := Classify(tt.err); got != tt.want {
+			t.Errorf("Classify(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{"-3", 0, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseRetryAfter(%q) = %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPolicyDelay(t *testing.T) {
+	p := Policy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 60: 5 * time.Second} {
+		if got := p.Delay(attempt, errors.New("x")); got != want {
+			t.Errorf("attempt %d: got %s, want %s", attempt, got, want)
+		}
+	}
+
+	// Retry-After 优先于指数退避，但有上限
+	if got := p.Delay(1, &StatusError{Code: 429, RetryAfter: 30 * time.Second}); got != 30*time.Second {
+		t.Errorf("got %s, want Retry-After", got)
+	}
+	if got := p.Delay(1, &StatusError{Code: 429, RetryAfter: time.Hour}); got != maxRetryAfter {
+		t.Errorf("got %s, want %s", got, maxRetryAfter)
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.Delay(2, errors.New("x")); got < time.Second || got > 2*time.Second {
+			t.Fatalf("jittered delay %s outside [1s, 2s]", got)
+		}
+	}
+}
+
+func TestPolicyDo(t *testing.T) {
+	p := NewPolicy(3, time.Millisecond)
+
+	// 临时错误重试到成功为止
+	var delays []time.Duration
+	calls := 0
+	err := p.Do(context.Background(), func() error {
+		if calls++; calls < 3 {
+			return &StatusError{Code: 502}
+		}
+		return nil
+	}, func(attempt int, err error, delay time.Duration) {
+		delays = append(delays, delay)
+	})
+	if err != nil || calls != 3 || len(delays) != 2 {
+		t.Errorf("got %v after %d calls and %d notifications", err, calls, len(delays))
+	}
+
+	// 重试用完后返回最后一次的错误
+	calls = 0
+	err = p.Do(context.Background(), func() error {
+		calls++
+		return io.ErrUnexpectedEOF
+	}, nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || calls != 3 {
+		t.Errorf("got %v after %d calls", err, calls)
+	}
+
+	// 4xx 和被 Stop 标记的错误不重试
+	for _, want := range []error{&StatusError{Code: 403}, Stop(io.EOF)} {
+		calls = 0
+		err = p.Do(context.Background(), func() error {
+			calls++
+			return want
+		}, nil)
+		if err != want || calls != 1 {
+			t.Errorf("got %v after %d calls, want %v after 1", err, calls, want)
+		}
+	}
+
+	// ctx 取消后不再等待
+	ctx, cancel := context.WithCancel(context.Background())
+	err = NewPolicy(5, time.Hour).Do(ctx, func() error {
+		cancel()
+		return io.EOF
+	}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -1,18 +1,20 @@
 package types
 
 import (
+	"context"
 	"net/http"
 	"time"
 )
 
 type Downloader interface {
-	DownloadFile(url string, filepath string, opts *RequestOption) error
+	DownloadFile(ctx context.Context, url string, filepath string, opts *RequestOption) (*DownloadResult, error)
 }
 
 type ClientInterface interface {
-	GetStream(method, url string, opts *RequestOption, headers map[string]string) (*http.Response, error)
-	Get(url string, opts *RequestOption) (string, error)
+	GetStream(ctx context.Context, method, url string, opts *RequestOption, headers map[string]string) (*http.Response, error)
+	Get(ctx context.Context, url string, opts *RequestOption) (string, error)
 	GetProxy() string
 	GetMaxRetries() int
 	GetRetryDelay() time.Duration
+	GetDownloadOption() DownloadOption
 }
@@ -1,13 +1,36 @@
 package types
 
-// RequestOption 定义请求选项
+import "net/http"
+
+// RequestOption 定义请求选项。请求头在客户端默认值和站点请求头的基础上叠加，
+// 同名的请求头覆盖前面的值，RemoveHeaders 中的请求头最后删除。
 type RequestOption struct {
-	Headers map[string]string
+	Headers       map[string]string
+	RemoveHeaders []string // 不发送的请求头，包括默认请求头
+
+	Referer string
+	Origin  string
+	Cookies []*http.Cookie // 附加在 cookie jar 中的 cookie 之后
+
+	AllowErrorStatus bool // Get 返回任意状态码的响应内容，不检查状态码和反爬虫验证页
 }
 
 // DownloadOption 定义下载选项
 type DownloadOption struct {
-	MaxRetries  int
-	RetryDelay  int
-	MaxParallel int
+	MaxRetries    int
+	RetryDelay    int
+	MaxParallel   int    // 分片并发下载数
+	Connections   int    // 普通文件的并发连接数，小于等于 1 时单连接下载
+	VariantPolicy string // m3u8 变体选择策略，格式见 downloader.ParseVariantPolicy
+
+	AudioLanguages    string // 需要下载的备用音轨语言，逗号分隔
+	SubtitleLanguages string // 需要下载的字幕语言，逗号分隔
+	SubtitleMode      string // 字幕处理方式：sidecar 或 mux
+	FragmentedMP4     bool   // 输出 fragmented MP4
+
+	LiveRecord     bool  // 播放列表没有 EXT-X-ENDLIST 时持续刷新并录制
+	RecordDuration int   // 录制的最长时长（秒），0 表示不限制
+	RecordMaxSize  int64 // 录制的最大字节数，0 表示不限制
+
+	FileTimeout int // 单个文件下载的总时长上限（秒），0 表示不限制
 }
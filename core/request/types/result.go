@@ -0,0 +1,35 @@
+package types
+
+// DownloadResult 描述一次下载的结果，由 crawler 写入 metadata.json
+type DownloadResult struct {
+	Path    string            `json:"path"`              // 最终保存的文件路径
+	Variant *VariantSelection `json:"variant,omitempty"` // m3u8 master 播放列表的变体选择结果
+
+	Renditions []RenditionInfo `json:"renditions,omitempty"` // 单独下载的音轨和字幕
+}
+
+// VariantSelection 记录 master 播放列表中被选中和被放弃的变体
+type VariantSelection struct {
+	Policy   string        `json:"policy"`
+	Selected VariantInfo   `json:"selected"`
+	Rejected []VariantInfo `json:"rejected,omitempty"`
+}
+
+// VariantInfo 描述 master 播放列表中的一个变体
+type VariantInfo struct {
+	Index      int    `json:"index"`    // 在可播放变体中的序号（不计 I-frame 变体），与 --variant index=N 一致
+	Position   int    `json:"position"` // 在 master 播放列表中的原始位置
+	URI        string `json:"uri"`
+	Bandwidth  uint32 `json:"bandwidth,omitempty"`
+	Resolution string `json:"resolution,omitempty"`
+	Codecs     string `json:"codecs,omitempty"`
+}
+
+// RenditionInfo 描述一个单独下载的音轨或字幕（EXT-X-MEDIA）
+type RenditionInfo struct {
+	Type     string `json:"type"` // audio 或 subtitles
+	Language string `json:"language,omitempty"`
+	Name     string `json:"name,omitempty"`
+	URI      string `json:"uri"`
+	Path     string `json:"path,omitempty"` // 保存为独立文件时的路径，混流到视频中时为空
+}